@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
@@ -29,7 +30,16 @@ func newCITECollection(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	name := vars["name"] //the name of the new CITE collection
-	newCITECollectionToDB(user, name)
+	err = newCITECollectionToDB(user, name)
+	if err != nil {
+		log.Printf("newCITECollection: creating %s failed: %s\n", name, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errCollectionExists) {
+			status = http.StatusConflict
+		}
+		http.Error(res, err.Error(), status)
+		return
+	}
 	io.WriteString(res, "success")
 }
 
@@ -76,7 +86,16 @@ func addCITE(res http.ResponseWriter, req *http.Request) {
 		external = true
 	}
 	newimage := image{URN: imageurn, External: external, Protocol: protocol, Location: location}
-	// fmt.Println(user, name, newimage)
-	addImageToCITECollection(user, name, newimage)
+	err = checkImage(newimage)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = addImageToCITECollection(user, name, newimage)
+	if err != nil {
+		log.Printf("addCITE: adding %s to %s failed: %s\n", imageurn, name, err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	io.WriteString(res, "success")
 }
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/ThomasK81/gonwr"
+)
+
+// alignmentFiller fills the gaps of aligned texts
+const alignmentFiller = '#'
+
+// Tokenizers, deciding the units texts are aligned in and where words end
+const (
+	tokenizeWhitespace = "whitespace" //characters, words end at white space
+	tokenizeDanda      = "danda"      //characters, words also end at daṇḍas, which form words of their own
+	tokenizeAksara     = "aksara"     //akṣaras (syllables) in IAST or Devanagari, words end at white space and daṇḍas
+)
+
+// alignmentTokenizers lists the known tokenizers
+var alignmentTokenizers = []string{tokenizeWhitespace, tokenizeDanda, tokenizeAksara}
+
+var (
+	dandas         = regexp.MustCompile(`\s*([।॥|]+)\s*`)
+	alignmentSpace = regexp.MustCompile(`\s+`)
+)
+
+// prepareText removes the folio markers from text and applies the case and daṇḍa rules of settings.
+func prepareText(text string, settings AlignmentSettings) string {
+	text = folioMarker.ReplaceAllString(text, "")
+	if !settings.CaseSensitive {
+		text = strings.ToLower(text)
+	}
+	if settings.Tokenizer != tokenizeWhitespace {
+		text = dandas.ReplaceAllString(text, " $1 ")
+	}
+	return strings.TrimSpace(alignmentSpace.ReplaceAllString(text, " "))
+}
+
+// isIASTVowel reports whether the rune at i of runes starts a vowel in IAST,
+// including r and l with a combining dot or ring below (vocalic r and l).
+func isIASTVowel(runes []rune, i int) bool {
+	switch unicode.ToLower(runes[i]) {
+	case 'a', 'ā', 'i', 'ī', 'u', 'ū', 'ṛ', 'ṝ', 'ḷ', 'ḹ', 'e', 'o':
+		return true
+	case 'r', 'l':
+		return i+1 < len(runes) && (runes[i+1] == '\u0323' || runes[i+1] == '\u0325')
+	}
+	return false
+}
+
+// isDevanagariConsonant reports whether r is a Devanagari consonant (ka to ha, the nukta forms, and the additional consonants).
+func isDevanagariConsonant(r rune) bool {
+	return r >= '\u0915' && r <= '\u0939' || r >= '\u0958' && r <= '\u095F' || r >= '\u0978' && r <= '\u097F'
+}
+
+// aksaras splits text into akṣaras: the consonants before a vowel together with it and a
+// following anusvāra or visarga, in IAST or Devanagari. Consonants at the end of a word join
+// the akṣara before them. White space, daṇḍas, digits, and punctuation are units of their own.
+func aksaras(text string) []string {
+	runes := []rune(text)
+	var units []string
+	var current []rune
+	vowel := false     //whether current has its vowel already
+	diphthong := false //whether the vowel of current can still become ai or au
+	flush := func(wordEnd bool) {
+		if len(current) == 0 {
+			return
+		}
+		//consonants without vowel at the end of a word join the previous akṣara
+		if wordEnd && !vowel && len(units) > 0 && isWordUnit(units[len(units)-1]) {
+			units[len(units)-1] += string(current)
+		} else {
+			units = append(units, string(current))
+		}
+		current, vowel, diphthong = nil, false, false
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case unicode.IsMark(r):
+			if len(current) == 0 && len(units) > 0 {
+				units[len(units)-1] += string(r)
+				continue
+			}
+			current = append(current, r)
+			if r == '्' { //a virāma leaves the Devanagari consonant without vowel
+				vowel = false
+			}
+		case isDevanagariConsonant(r):
+			if len(current) == 0 || current[len(current)-1] != '्' {
+				flush(false)
+			}
+			current, vowel, diphthong = append(current, r), true, false
+		case r >= 'ऄ' && r <= 'औ' || r == 'ॠ' || r == 'ॡ':
+			flush(false)
+			current, vowel, diphthong = []rune{r}, true, false
+		case unicode.IsLetter(r) && isIASTVowel(runes, i):
+			lower := unicode.ToLower(r)
+			if vowel && diphthong && (lower == 'i' || lower == 'u') {
+				current, diphthong = append(current, r), false
+				continue
+			}
+			if vowel {
+				flush(false)
+			}
+			current, vowel, diphthong = append(current, r), true, lower == 'a'
+		case unicode.IsLetter(r):
+			lower := unicode.ToLower(r)
+			closing := lower == 'ṃ' || lower == 'ṁ' || lower == 'ḥ' ||
+				(lower == 'm' || lower == 'h') && i+1 < len(runes) && (runes[i+1] == '\u0323' || runes[i+1] == '\u0307')
+			if vowel && closing {
+				current, diphthong = append(current, r), false
+				continue
+			}
+			if vowel {
+				flush(false)
+			}
+			current = append(current, r)
+		default:
+			flush(true)
+			units = append(units, string(r))
+		}
+	}
+	flush(true)
+	return units
+}
+
+// isWordUnit reports whether unit is part of a word, i.e. no white space or punctuation.
+func isWordUnit(unit string) bool {
+	for _, r := range unit {
+		return unicode.IsLetter(r) || unicode.IsMark(r)
+	}
+	return false
+}
+
+// alignmentUnits splits a prepared text into the units it is aligned in.
+func alignmentUnits(text string, settings AlignmentSettings) []string {
+	if settings.Tokenizer == tokenizeAksara {
+		return aksaras(text)
+	}
+	return strings.Split(text, "")
+}
+
+// unitCoder maps alignment units of several runes to runes of the Private Use Area,
+// so that they can be aligned as a single rune.
+type unitCoder struct {
+	codes map[string]rune
+	units map[rune]string
+}
+
+func newUnitCoder() *unitCoder {
+	return &unitCoder{codes: make(map[string]rune), units: make(map[rune]string)}
+}
+
+// encode returns the runes standing for units.
+func (c *unitCoder) encode(units []string) []rune {
+	result := make([]rune, 0, len(units))
+	for _, unit := range units {
+		if runes := []rune(unit); len(runes) == 1 {
+			result = append(result, runes[0])
+			continue
+		}
+		code, ok := c.codes[unit]
+		if !ok {
+			code = rune(0xE000 + len(c.codes))
+			c.codes[unit] = code
+			c.units[code] = unit
+		}
+		result = append(result, code)
+	}
+	return result
+}
+
+// decode returns the text runes stand for.
+func (c *unitCoder) decode(runes []rune) string {
+	var result strings.Builder
+	for _, r := range runes {
+		if unit, ok := c.units[r]; ok {
+			result.WriteString(unit)
+		} else {
+			result.WriteRune(r)
+		}
+	}
+	return result.String()
+}
+
+// alignRunes aligns a and b with the scores of settings, filling gaps with alignmentFiller,
+// and returns the aligned sequences and the alignment score. Without gap opening penalty
+// gonwr aligns with linear gap costs, otherwise alignAffine with affine gap costs.
+func alignRunes(a, b []rune, settings AlignmentSettings) ([]rune, []rune, int) {
+	if settings.GapOpen == 0 {
+		return gonwr.Align(a, b, alignmentFiller, settings.Match, settings.Mismatch, settings.Gap)
+	}
+	return alignAffine(a, b, settings)
+}
+
+// alignAffine is the Gotoh variant of the Needleman-Wunsch algorithm: a gap of length n
+// costs GapOpen + n*Gap, so that few long gaps are preferred to many short ones.
+func alignAffine(a, b []rune, settings AlignmentSettings) ([]rune, []rune, int) {
+	const (
+		inMatch = iota //the cell ends with a pair of runes
+		inGapA         //the cell ends with a gap in a
+		inGapB         //the cell ends with a gap in b
+	)
+	n, m := len(a), len(b)
+	//minScore is below any score of an alignment of a and b, and stays in range of an int
+	//on 32-bit platforms when a few penalties are added to it
+	penalty := settings.GapOpen + settings.Gap - 1
+	if settings.Mismatch < 0 {
+		penalty += settings.Mismatch
+	}
+	minScore := 2 * (n + m + 1) * penalty
+	//score[k][i][j] is the best score of a[:i] and b[:j] ending in state k
+	var score [3][][]int
+	for k := range score {
+		score[k] = make([][]int, n+1)
+		for i := range score[k] {
+			score[k][i] = make([]int, m+1)
+			for j := range score[k][i] {
+				score[k][i][j] = minScore
+			}
+		}
+	}
+	score[inMatch][0][0] = 0
+	for i := 1; i <= n; i++ {
+		score[inGapB][i][0] = settings.GapOpen + i*settings.Gap
+	}
+	for j := 1; j <= m; j++ {
+		score[inGapA][0][j] = settings.GapOpen + j*settings.Gap
+	}
+	best := func(i, j int) (int, int) {
+		state, value := inMatch, score[inMatch][i][j]
+		for _, k := range []int{inGapA, inGapB} {
+			if score[k][i][j] > value {
+				state, value = k, score[k][i][j]
+			}
+		}
+		return state, value
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			pair := settings.Mismatch
+			if a[i-1] == b[j-1] {
+				pair = settings.Match
+			}
+			_, previous := best(i-1, j-1)
+			score[inMatch][i][j] = previous + pair
+			score[inGapB][i][j] = maxInt(score[inMatch][i-1][j]+settings.GapOpen, score[inGapA][i-1][j]+settings.GapOpen,
+				score[inGapB][i-1][j]) + settings.Gap
+			score[inGapA][i][j] = maxInt(score[inMatch][i][j-1]+settings.GapOpen, score[inGapB][i][j-1]+settings.GapOpen,
+				score[inGapA][i][j-1]) + settings.Gap
+		}
+	}
+
+	var alignedA, alignedB []rune
+	i, j := n, m
+	state, total := best(n, m)
+	for i > 0 || j > 0 {
+		switch {
+		case state == inMatch && i > 0 && j > 0:
+			alignedA, alignedB = append(alignedA, a[i-1]), append(alignedB, b[j-1])
+			i, j = i-1, j-1
+			state, _ = best(i, j)
+		case state == inGapB || j == 0:
+			alignedA, alignedB = append(alignedA, a[i-1]), append(alignedB, alignmentFiller)
+			//stay in the gap if it was extended, otherwise it was opened after the best state of the cell above
+			if i > 1 && score[inGapB][i][j] != score[inGapB][i-1][j]+settings.Gap {
+				state, _ = best(i-1, j)
+			} else if i == 1 {
+				state = inMatch
+			}
+			i--
+		default:
+			alignedA, alignedB = append(alignedA, alignmentFiller), append(alignedB, b[j-1])
+			if j > 1 && score[inGapA][i][j] != score[inGapA][i][j-1]+settings.Gap {
+				state, _ = best(i, j-1)
+			} else if j == 1 {
+				state = inMatch
+			}
+			j--
+		}
+	}
+	reverseRunes(alignedA)
+	reverseRunes(alignedB)
+	return alignedA, alignedB, total
+}
+
+// maxInt returns the largest of values.
+func maxInt(values ...int) int {
+	result := values[0]
+	for _, value := range values[1:] {
+		if value > result {
+			result = value
+		}
+	}
+	return result
+}
+
+func reverseRunes(runes []rune) {
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+}
+
+// alignTexts aligns the texts a and b following settings and returns the aligned texts,
+// with gaps filled by alignmentFiller, split into words at the places where both have
+// a word boundary.
+func alignTexts(a, b string, settings AlignmentSettings) ([]string, []string) {
+	a, b = prepareText(a, settings), prepareText(b, settings)
+	coder := newUnitCoder()
+	alignedA, alignedB, _ := alignRunes(coder.encode(alignmentUnits(a, settings)), coder.encode(alignmentUnits(b, settings)), settings)
+	var wordsA, wordsB []string
+	start := 0
+	for i := range alignedA {
+		if alignedA[i] == ' ' && alignedB[i] == ' ' {
+			wordsA, wordsB = append(wordsA, coder.decode(alignedA[start:i+1])), append(wordsB, coder.decode(alignedB[start:i+1]))
+			start = i + 1
+		}
+	}
+	wordsA, wordsB = append(wordsA, coder.decode(alignedA[start:])), append(wordsB, coder.decode(alignedB[start:]))
+	return wordsA, wordsB
+}
+
+// alignmentDistance returns how much the aligned words a and b differ, from 0 (equal) to 1,
+// ignoring gaps and punctuation. It is used to highlight variants.
+func alignmentDistance(a, b string, settings AlignmentSettings) float32 {
+	strip := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == alignmentFiller || !(unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsSpace(r)) {
+				return -1
+			}
+			return r
+		}, s)
+	}
+	coder := newUnitCoder()
+	unitsA := coder.encode(alignmentUnits(strip(a), settings))
+	unitsB := coder.encode(alignmentUnits(strip(b), settings))
+	_, _, score := alignRunes(unitsA, unitsB, settings)
+	base := len(unitsA)
+	if len(unitsB) > base {
+		base = len(unitsB)
+	}
+	switch {
+	case base == 0:
+		return 0.0
+	case score <= 0 || settings.Match <= 0:
+		return 1.0
+	case score >= base*settings.Match:
+		return 0.0
+	}
+	return 1.0 - float32(score)/float32(base*settings.Match)
+}
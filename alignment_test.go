@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAlignAffine(t *testing.T) {
+	settings := AlignmentSettings{Match: 1, Mismatch: -1, Gap: -1, GapOpen: -2, Tokenizer: tokenizeWhitespace, Layer: layerTXT}
+	tests := []struct {
+		a, b     string
+		alignedA string
+		alignedB string
+		score    int
+	}{
+		{"", "", "", "", 0},
+		{"abc", "abc", "abc", "abc", 3},
+		{"abc", "", "abc", "###", -5},
+		{"abcd", "ad", "abcd", "a##d", -2}, //one gap of two rather than two gaps
+		{"abxyzcd", "abcd", "abxyzcd", "ab###cd", -1},
+		{"abcd", "abzd", "abcd", "abzd", 2},
+	}
+	for _, test := range tests {
+		alignedA, alignedB, score := alignAffine([]rune(test.a), []rune(test.b), settings)
+		if string(alignedA) != test.alignedA || string(alignedB) != test.alignedB || score != test.score {
+			t.Errorf("alignAffine(%q, %q) = %q, %q, %d, want %q, %q, %d", test.a, test.b,
+				string(alignedA), string(alignedB), score, test.alignedA, test.alignedB, test.score)
+		}
+	}
+}
+
+func TestAksaras(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"saṃśaya", []string{"saṃ", "śa", "ya"}},
+		{"tathāpi", []string{"ta", "thā", "pi"}},
+		{"kaivalya", []string{"kai", "va", "lya"}},
+		{"pramāṇaḥ", []string{"pra", "mā", "ṇaḥ"}},
+		{"tat sat", []string{"tat", " ", "sat"}},
+		{"kṛta", []string{"kṛ", "ta"}},
+		{"ity uktam ।", []string{"ity", " ", "u", "ktam", " ", "।"}}, //consonants start the next akṣara within a word
+		{"संशय", []string{"सं", "श", "य"}},
+		{"धर्मः", []string{"ध", "र्मः"}},
+		{"आत्मा", []string{"आ", "त्मा"}},
+	}
+	for _, test := range tests {
+		if got := aksaras(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("aksaras(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
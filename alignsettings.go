@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Buckets of the alignment settings in the user database
+const (
+	alignmentPresetsBucket  = "alignmentPresets"  //AlignmentSettings by preset name
+	alignmentDefaultsBucket = "alignmentDefaults" //AlignmentSettings by work URN
+)
+
+// Text layers an alignment can be computed on
+const (
+	layerTXT        = "txt"
+	layerNormalised = "normalised"
+	layerDiplomatic = "diplomatic"
+)
+
+// alignmentLayers lists the text layers an alignment can be computed on
+var alignmentLayers = []string{layerTXT, layerNormalised, layerDiplomatic}
+
+// Errors of the alignment settings
+var (
+	errPresetNotFound    = errors.New("alignment preset not found")
+	errBadAlignment      = errors.New("bad alignment settings")
+	errAlignmentNotFound = errors.New("no alignment settings for the work")
+)
+
+// AlignmentSettings are the parameters of the Needleman-Wunsch collation of passages.
+// A gap of length n costs GapOpen + n*Gap.
+// The Tokenizer decides the units of the pairwise alignment and how similar two words score
+// in the multiple alignment (alignWitnesses), but not its columns: these are always the words
+// between white space and daṇḍas, so a sandhi like tathāpi stands against the two columns of tathā api.
+type AlignmentSettings struct {
+	Match         int    `json:"match"`
+	Mismatch      int    `json:"mismatch"`
+	Gap           int    `json:"gap"`
+	GapOpen       int    `json:"gapOpen"`       //0 for linear gap costs
+	Tokenizer     string `json:"tokenizer"`     //whitespace, danda, or aksara
+	Layer         string `json:"layer"`         //the text layer to align: txt, normalised, or diplomatic
+	CaseSensitive bool   `json:"caseSensitive"` //texts are lowercased otherwise
+}
+
+// AlignmentPreset is a named AlignmentSettings of a user.
+type AlignmentPreset struct {
+	Name     string            `json:"name"`
+	Settings AlignmentSettings `json:"settings"`
+}
+
+// defaultAlignmentSettings returns the scores Brucheion has always aligned with,
+// on the normalised text if config.UseNormalization is set.
+func defaultAlignmentSettings() AlignmentSettings {
+	settings := AlignmentSettings{Match: 1, Mismatch: -1, Gap: -1, Tokenizer: tokenizeWhitespace, Layer: layerTXT}
+	if config.UseNormalization {
+		settings.Layer = layerNormalised
+	}
+	return settings
+}
+
+// check returns an error wrapping errBadAlignment if the settings cannot be aligned with.
+func (settings AlignmentSettings) check() error {
+	switch {
+	case settings.Match <= settings.Mismatch:
+		return fmt.Errorf("match must score higher than mismatch: %w", errBadAlignment)
+	case settings.Gap > 0 || settings.GapOpen > 0:
+		return fmt.Errorf("gap and gapOpen must not be positive: %w", errBadAlignment)
+	case !contains(alignmentTokenizers, settings.Tokenizer):
+		return fmt.Errorf("unknown tokenizer %q, use one of %s: %w", settings.Tokenizer, strings.Join(alignmentTokenizers, ", "), errBadAlignment)
+	case !contains(alignmentLayers, settings.Layer):
+		return fmt.Errorf("unknown text layer %q, use one of %s: %w", settings.Layer, strings.Join(alignmentLayers, ", "), errBadAlignment)
+	}
+	return nil
+}
+
+// apply overrides the settings with the alignment query values (match, mismatch, gap,
+// gapOpen, tokenizer, layer, caseSensitive) given in query.
+func (settings *AlignmentSettings) apply(query url.Values) error {
+	for key, value := range map[string]*int{"match": &settings.Match, "mismatch": &settings.Mismatch,
+		"gap": &settings.Gap, "gapOpen": &settings.GapOpen} {
+		if query.Get(key) == "" {
+			continue
+		}
+		number, err := strconv.Atoi(query.Get(key))
+		if err != nil {
+			return fmt.Errorf("%s must be an integer: %w", key, errBadAlignment)
+		}
+		*value = number
+	}
+	if tokenizer := query.Get("tokenizer"); tokenizer != "" {
+		settings.Tokenizer = tokenizer
+	}
+	if layer := query.Get("layer"); layer != "" {
+		settings.Layer = layer
+	}
+	if value := query.Get("caseSensitive"); value != "" {
+		caseSensitive, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("caseSensitive must be true or false: %w", errBadAlignment)
+		}
+		settings.CaseSensitive = caseSensitive
+	}
+	return settings.check()
+}
+
+// alignmentText returns the text layer of passage selected by settings,
+// or its TXT layer if that layer is empty.
+func alignmentText(passage gocite.Passage, settings AlignmentSettings) string {
+	text := passage.Text.TXT
+	switch settings.Layer {
+	case layerNormalised:
+		text = passage.Text.Normalised
+	case layerDiplomatic:
+		text = passage.Text.Diplomatic
+	}
+	if text == "" {
+		return passage.Text.TXT
+	}
+	return text
+}
+
+// getAlignmentSettings returns the settings saved under key in the bucket with the given name
+// within tx, and whether there are any. They are decoded onto the default settings, so that
+// settings saved before a new parameter was added keep working.
+func getAlignmentSettings(tx *bolt.Tx, bucketName, key string) (AlignmentSettings, bool, error) {
+	settings := defaultAlignmentSettings()
+	bucket := tx.Bucket([]byte(bucketName))
+	if bucket == nil || bucket.Get([]byte(key)) == nil {
+		return settings, false, nil
+	}
+	err := json.Unmarshal(bucket.Get([]byte(key)), &settings)
+	return settings, err == nil, err
+}
+
+// putAlignmentSettings saves settings under key in the bucket with the given name within tx.
+func putAlignmentSettings(tx *bolt.Tx, bucketName, key string, settings AlignmentSettings) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), value)
+}
+
+// deleteAlignmentSettings deletes the settings saved under key in the bucket with the given
+// name within tx, returning notFound if there are none.
+func deleteAlignmentSettings(tx *bolt.Tx, bucketName, key string, notFound error) error {
+	bucket := tx.Bucket([]byte(bucketName))
+	if bucket == nil || bucket.Get([]byte(key)) == nil {
+		return fmt.Errorf("%s: %w", key, notFound)
+	}
+	return bucket.Delete([]byte(key))
+}
+
+// requestAlignmentSettings returns the alignment settings of a collation of the work with the
+// given URN: the defaults, replaced by the settings saved for the work, replaced by the preset
+// named by the query value preset, and finally overridden by the individual query values.
+func requestAlignmentSettings(db *UserDB, workID string, query url.Values) (AlignmentSettings, error) {
+	var settings AlignmentSettings
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		settings, _, err = getAlignmentSettings(tx, alignmentDefaultsBucket, workID)
+		if err != nil {
+			return err
+		}
+		if name := query.Get("preset"); name != "" {
+			var found bool
+			settings, found, err = getAlignmentSettings(tx, alignmentPresetsBucket, name)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%s: %w", name, errPresetNotFound)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return settings, err
+	}
+	err = settings.apply(query)
+	return settings, err
+}
+
+// listAlignmentPresets returns the alignment presets of a user database sorted by name.
+func listAlignmentPresets(db *UserDB) ([]AlignmentPreset, error) {
+	result := []AlignmentPreset{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(alignmentPresetsBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, _ []byte) error {
+			settings, _, err := getAlignmentSettings(tx, alignmentPresetsBucket, string(key))
+			result = append(result, AlignmentPreset{Name: string(key), Settings: settings})
+			return err
+		})
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, err
+}
+
+// decodeAlignmentSettings decodes settings from body onto the default settings and checks them.
+func decodeAlignmentSettings(body []byte) (AlignmentSettings, error) {
+	settings := defaultAlignmentSettings()
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&settings)
+	if err != nil {
+		return settings, fmt.Errorf("%s: %w", err, errBadAlignment)
+	}
+	return settings, settings.check()
+}
+
+// handleAlignmentPresets lists the alignment presets of the user.
+func handleAlignmentPresets(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	presets, err := listAlignmentPresets(db)
+	if err != nil {
+		log.Printf("handleAlignmentPresets: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	respondWithData(w, presets, 200)
+}
+
+// handleAlignmentPreset saves the AlignmentSettings in the request body as the preset {name} (PUT)
+// or deletes that preset (DELETE). Parameters missing from the body take their default values.
+func handleAlignmentPreset(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	name := strings.TrimSpace(mux.Vars(r)["name"])
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	if r.Method == http.MethodDelete {
+		err = db.Update(func(tx *bolt.Tx) error {
+			return deleteAlignmentSettings(tx, alignmentPresetsBucket, name, errPresetNotFound)
+		})
+		if err != nil {
+			respondWithAlignmentError(w, err)
+			return
+		}
+		respondWithJSON(w, "success", "preset_deleted", nil, 200)
+		return
+	}
+
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	settings, err := decodeAlignmentSettings(body.Bytes())
+	if err != nil {
+		respondWithAlignmentError(w, err)
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return putAlignmentSettings(tx, alignmentPresetsBucket, name, settings)
+	})
+	if err != nil {
+		respondWithAlignmentError(w, err)
+		return
+	}
+	respondWithData(w, AlignmentPreset{Name: name, Settings: settings}, 200)
+}
+
+// handleWorkAlignment returns (GET), saves (PUT), or deletes (DELETE) the alignment settings
+// used by default when passages of the work {urn} are collated. Without saved settings GET
+// returns the defaults.
+func handleWorkAlignment(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	err = checkWorkURN(urn)
+	if err != nil {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	var settings AlignmentSettings
+	switch r.Method {
+	case http.MethodGet:
+		err = db.View(func(tx *bolt.Tx) error {
+			if !workExists(tx, urn) {
+				return fmt.Errorf("%s: %w", urn, errWorkNotFound)
+			}
+			settings, _, err = getAlignmentSettings(tx, alignmentDefaultsBucket, urn)
+			return err
+		})
+	case http.MethodPut:
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		settings, err = decodeAlignmentSettings(body.Bytes())
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error {
+				if !workExists(tx, urn) {
+					return fmt.Errorf("%s: %w", urn, errWorkNotFound)
+				}
+				return putAlignmentSettings(tx, alignmentDefaultsBucket, urn, settings)
+			})
+		}
+	case http.MethodDelete:
+		err = db.Update(func(tx *bolt.Tx) error {
+			return deleteAlignmentSettings(tx, alignmentDefaultsBucket, urn, errAlignmentNotFound)
+		})
+		if err == nil {
+			respondWithJSON(w, "success", "alignment_deleted", nil, 200)
+			return
+		}
+	}
+	if err != nil {
+		respondWithAlignmentError(w, err)
+		return
+	}
+	respondWithData(w, settings, 200)
+}
+
+// alignmentErrorStatus returns the HTTP status code of an error returned by requestAlignmentSettings,
+// for the pages collating passages.
+func alignmentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBadAlignment):
+		return http.StatusBadRequest
+	case errors.Is(err, errPresetNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// respondWithAlignmentError answers with the status code matching an error of the alignment settings.
+func respondWithAlignmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errPresetNotFound):
+		respondWithError(w, "preset_not_found", 404)
+	case errors.Is(err, errAlignmentNotFound):
+		respondWithError(w, "alignment_not_found", 404)
+	case errors.Is(err, errWorkNotFound):
+		respondWithError(w, "work_not_found", 404)
+	case errors.Is(err, errBadAlignment):
+		respondWithJSON(w, "error", "bad_alignment", err.Error(), 400)
+	default:
+		log.Printf("alignment settings: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	}
+}
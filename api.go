@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
 )
 
@@ -24,6 +27,7 @@ type Passage struct {
 	ImageRefs          []string    `json:"imageRefs"`
 	TextRefs           []string    `json:"textRefs"`
 	Catalog            BoltCatalog `json:"catalog"`
+	Version            int         `json:"version"`
 }
 
 type User struct {
@@ -57,58 +61,218 @@ func handlePassage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbName := user + ".db"
-	textRefs := Buckets(dbName)
-	bucketName := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
-	log.Println(bucketName)
-
-	d, err := BoltRetrieve(dbName, bucketName, urn)
+	db, err := openUserDB(user)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal server error", 500)
 		return
 	}
-	c, err := BoltRetrieve(dbName, bucketName, bucketName)
+	defer db.Close()
+	p, err := loadPassage(db, user, urn)
+	if errors.Is(err, errPassageNotFound) {
+		log.Println(err)
+		http.Error(w, "Not found", 404)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Internal server error", 500)
 		return
 	}
 
-	catalog := BoltCatalog{}
-	passage := gocite.Passage{}
-	json.Unmarshal([]byte(d.JSON), &passage)
-	json.Unmarshal([]byte(c.JSON), &catalog)
+	w.Header().Set("ETag", etag(p.Version))
+	respondWithData(w, p, 200)
+}
 
-	log.Println("json unmarshalled")
+// loadPassage returns the passage urn with its context as a Passage.
+func loadPassage(db *UserDB, user, urn string) (Passage, error) {
+	textRefs, err := db.ListWorks()
+	if err != nil {
+		return Passage{}, err
+	}
+	passage, err := db.GetPassage(urn)
+	if err != nil {
+		return Passage{}, err
+	}
+	catalog, err := db.GetCatalog(workBucket(urn))
+	if err != nil {
+		return Passage{}, err
+	}
+	version, err := db.PassageVersion(urn)
+	if err != nil {
+		return Passage{}, err
+	}
 
 	text := passage.Text.TXT
 	passages := strings.Split(text, "\r\n")
-	work, _ := BoltRetrieveWork(dbName, bucketName)
+	bounds, _ := db.WorkBounds(workBucket(urn))
 
 	var imageRefs []string
 	for _, tmp := range passage.ImageLinks {
 		imageRefs = append(imageRefs, tmp.Object)
 	}
 
-	p := Passage{
+	return Passage{
 		ID:                 passage.PassageID,
 		Transcriber:        user,
 		TranscriptionLines: passages,
 		PreviousPassage:    passage.Prev.PassageID,
 		NextPassage:        passage.Next.PassageID,
-		FirstPassage:       work.First.PassageID,
-		LastPassage:        work.Last.PassageID,
+		FirstPassage:       bounds.First,
+		LastPassage:        bounds.Last,
 		ImageRefs:          imageRefs,
 		TextRefs:           textRefs,
 		Catalog:            catalog,
+		Version:            version,
+	}, nil
+}
+
+// PassageInput is the body of PUT and PATCH requests to /api/v1/passage/{urn}.
+// PATCH only changes the fields that are given, PUT replaces all of them.
+type PassageInput struct {
+	Lines     *[]string         `json:"lines"`     //the TXT layer, line by line
+	ImageRefs *[]string         `json:"imageRefs"` //CITE2 URNs of the images the passage appears on
+	Layers    map[string]string `json:"layers"`    //the other text layers by name (normalised, diplomatic, markdown, xml)
+	Version   *int              `json:"version"`   //the version the change is based on, see also If-Match
+}
+
+// apply applies the input to passage. With replace, missing fields are cleared.
+func (input PassageInput) apply(passage *gocite.Passage, replace bool) error {
+	for layer := range input.Layers {
+		if layer == cexLayerTXT || !contains(cexLayers, layer) {
+			return fmt.Errorf("unknown text layer %q: %w", layer, errBadPassage)
+		}
+	}
+	if input.ImageRefs != nil {
+		for _, ref := range *input.ImageRefs {
+			if !gocite.IsCITEURN(ref) {
+				return fmt.Errorf("%q is no CITE2 URN: %w", ref, errBadPassage)
+			}
+		}
 	}
 
-	respondWithData(w, p, 200)
+	if replace {
+		passage.Text = gocite.EncText{}
+		passage.ImageLinks = nil
+	}
+	if input.Lines != nil {
+		passage.Text.TXT = strings.Join(*input.Lines, "\r\n")
+		passage.Text.Brucheion = strings.Join(*input.Lines, "")
+	}
+	if input.ImageRefs != nil {
+		passage.ImageLinks = nil
+		for _, ref := range *input.ImageRefs {
+			passage.ImageLinks = append(passage.ImageLinks, gocite.Triple{Subject: passage.PassageID,
+				Verb:   "urn:cite2:dse:verbs.v1:appears_on",
+				Object: ref})
+		}
+	}
+	for layer, text := range input.Layers {
+		switch layer {
+		case cexLayerNormalised:
+			passage.Text.Normalised = text
+		case cexLayerDiplomatic:
+			passage.Text.Diplomatic = text
+		case cexLayerMarkDown:
+			passage.Text.MarkDown = text
+		case cexLayerXML:
+			passage.Text.XML = text
+		}
+	}
+	return nil
 }
 
-// handleCEXUpload reads a CEX file transferred in a POST request into memory
-// and attempts to load the contained CEX data into the user database.
+// handlePassageWrite saves the passage {urn} from a PassageInput. PATCH changes the given
+// fields of an existing passage. PUT replaces the passage, or appends it to its work if it
+// does not exist yet. The version in the body or the If-Match header is checked against
+// the current version; if it is stale, 409 is answered with the current text and version.
+func handlePassageWrite(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	if !gocite.IsCTSURN(urn) || passageReference(urn) == "" {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+	var input PassageInput
+	err = json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+		return
+	}
+	version := r.Header.Get("If-Match")
+	if input.Version != nil {
+		version = strconv.Itoa(*input.Version)
+	}
+	replace := r.Method == http.MethodPut
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	code := 200
+	_, err = db.GetPassage(urn)
+	if errors.Is(err, errPassageNotFound) && replace {
+		code = 201
+		passage := gocite.Passage{PassageID: urn}
+		err = input.apply(&passage, true)
+		if err == nil {
+			_, err = insertPassage(db, passage, "", "")
+		}
+	} else if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			err := checkVersion(tx, urn, version)
+			if err != nil {
+				return err
+			}
+			_, err = updatePassage(tx, urn, user, func(passage *gocite.Passage) error {
+				return input.apply(passage, replace)
+			})
+			return err
+		})
+	}
+
+	var stale *StaleVersionError
+	switch {
+	case errors.As(err, &stale):
+		w.Header().Set("ETag", etag(stale.Version))
+		respondWithJSON(w, "error", "stale_version", stale, 409)
+		return
+	case errors.Is(err, errPassageNotFound):
+		respondWithError(w, "passage_not_found", 404)
+		return
+	case errors.Is(err, errBadPassage):
+		respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+		return
+	case err != nil:
+		log.Printf("handlePassageWrite: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+
+	p, err := loadPassage(db, user, urn)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	w.Header().Set("ETag", etag(p.Version))
+	respondWithData(w, p, code)
+}
+
+// handleCEXUpload parses a CEX file transferred in a POST request and loads the
+// contained CEX data into the user database. The response carries a CEXReport.
+// With the form value dryRun=true only the report is returned and nothing is written.
+// The form value strategy (overwrite, keep-existing, fail-on-conflict) decides what happens
+// to passages that are already stored, and resolutions (a JSON object mapping passage URNs
+// to "incoming" or "existing") decides it for single passages. With fail-on-conflict,
+// unresolved conflicts are answered with 409 and the report listing both versions.
 // adapted example from <https://tutorialedge.net/golang/go-file-upload-tutorial/>
 func handleCEXUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -134,31 +298,77 @@ func handleCEXUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	data, err := ioutil.ReadAll(file)
+	opts := CEXImportOptions{Strategy: r.FormValue("strategy")}
+	if resolutions := r.FormValue("resolutions"); resolutions != "" {
+		err = json.Unmarshal([]byte(resolutions), &opts.Resolutions)
+		if err != nil {
+			respondWithJSON(w, "error", "bad_resolutions", err.Error(), 400)
+			return
+		}
+	}
+	err = opts.validate()
+	if err != nil {
+		respondWithJSON(w, "error", "bad_strategy", err.Error(), 400)
+		return
+	}
+
+	cex, err := ParseCEX(file)
 	if err != nil {
-		log.Printf("Error reading file:\n%s\n", err.Error())
+		log.Printf("Error parsing file:\n%s\n", err.Error())
+		if _, ok := err.(*CEXError); ok {
+			respondWithJSON(w, "error", "bad_cex_data", err.Error(), 400)
+			return
+		}
 		respondWithError(w, "bad_file_body", 500)
 		return
 	}
 
-	// loadCEX currently does not particular error cases and thus might panic
-	// on malformed file input. We'll handle any panics here in order to
-	// provide proper responses.
-	defer func() {
-		if r := recover(); r != nil {
-			err = r.(error)
-			log.Printf("Error loading file:\n%s\n", err.Error())
-			respondWithError(w, "bad_cex_data", 500)
-		}
-	}()
-	err = loadCEX(string(data), user)
+	report, err := reportCEX(cex, userDBPath(user))
+	if err != nil {
+		log.Printf("Error checking file against the user database:\n%s\n", err.Error())
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+
+	// in dry-run mode only the report is returned and nothing is written
+	if r.FormValue("dryRun") == "true" {
+		respondWithData(w, report, 200)
+		return
+	}
+	if !report.Valid() {
+		respondWithJSON(w, "error", "bad_cex_data", report, 400)
+		return
+	}
+
+	if unresolved := opts.unresolved(report); len(unresolved) > 0 {
+		respondWithJSON(w, "error", "conflict", report, 409)
+		return
+	}
+
+	err = importCEX(cex, user, opts)
 	if err != nil {
 		log.Printf("Error loading file:\n%s\n", err.Error())
 		respondWithError(w, "bad_cex_data", 500)
 		return
 	}
 
-	respondWithSuccess(w)
+	respondWithData(w, report, 200)
+}
+
+// handleCEXProgress reports the progress of the latest CEX import of the user.
+func handleCEXProgress(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	progress, ok := importProgress(user)
+	if !ok {
+		respondWithError(w, "no_import", 404)
+		return
+	}
+	respondWithData(w, progress, 200)
 }
 
 type JSONResponse struct {
@@ -198,6 +408,17 @@ func respondWithJSON(w http.ResponseWriter, status string, message string, data
 // stored in the request context.
 func requireAuth(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			user, err := resolveToken(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="brucheion"`)
+				respondWithError(w, "bad_token", http.StatusUnauthorized)
+				return
+			}
+			h(w, r.WithContext(context.WithValue(r.Context(), tokenUserKey, user)))
+			return
+		}
+
 		session, err := getSession(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
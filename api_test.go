@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPassageWrite(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	write := func(method, reference, body string, data interface{}) (int, string) {
+		w := serveAsUser(t, handlePassageWrite, method, map[string]string{"urn": testWork + reference}, body, data)
+		return w.Code, w.Header().Get("ETag")
+	}
+
+	var created Passage
+	code, tag := write("PUT", "1.11", `{"lines": ["ekādaśam", "padam"], "imageRefs": ["urn:cite2:test:img.v1:f1"]}`, &created)
+	if code != 201 || tag != `"1"` || created.Version != 1 {
+		t.Errorf("PUT of a new passage: %d %s %+v", code, tag, created)
+	}
+	if !reflect.DeepEqual(created.TranscriptionLines, []string{"ekādaśam", "padam"}) ||
+		!reflect.DeepEqual(created.ImageRefs, []string{"urn:cite2:test:img.v1:f1"}) ||
+		created.PreviousPassage != testWork+"1.10" || created.LastPassage != testWork+"1.11" {
+		t.Errorf("created passage %+v", created)
+	}
+	if got, want := readingOrder(t, db, testWork), []string{"1.1", "1.2", "1.9", "1.10", "1.11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+
+	var patched Passage
+	code, tag = write("PATCH", "1.11", `{"lines": ["ekādaśam"], "version": 1}`, &patched)
+	if code != 200 || tag != `"2"` || !reflect.DeepEqual(patched.TranscriptionLines, []string{"ekādaśam"}) ||
+		!reflect.DeepEqual(patched.ImageRefs, []string{"urn:cite2:test:img.v1:f1"}) {
+		t.Errorf("PATCH of the lines: %d %s %+v", code, tag, patched)
+	}
+
+	var stale StaleVersionError
+	code, tag = write("PATCH", "1.11", `{"lines": ["dvādaśam"], "version": 1}`, &stale)
+	if code != 409 || tag != `"2"` || stale.Version != 2 || stale.Text.TXT != "ekādaśam" {
+		t.Errorf("PATCH of an outdated version: %d %s %+v", code, tag, stale)
+	}
+
+	var replaced Passage
+	code, _ = write("PUT", "1.11", `{"lines": ["dvādaśam"]}`, &replaced)
+	if code != 200 || replaced.Version != 3 || len(replaced.ImageRefs) != 0 {
+		t.Errorf("PUT of an existing passage: %d %+v", code, replaced)
+	}
+
+	for _, test := range []struct {
+		method, reference, body string
+		want                    int
+	}{
+		{"PATCH", "1.12", `{"lines": ["dvādaśam"]}`, 404},
+		{"PATCH", "1.1", `{"layers": {"txt": "prathamam"}}`, 400},
+		{"PATCH", "1.1", `{"layers": {"latin": "primum"}}`, 400},
+		{"PATCH", "1.1", `{"imageRefs": ["f1"]}`, 400},
+		{"PATCH", "1.1", `{"lines": "prathamam"}`, 400},
+		{"PUT", "", `{"lines": ["prathamam"]}`, 400},
+	} {
+		if code, _ := write(test.method, test.reference, test.body, nil); code != test.want {
+			t.Errorf("%s %s %s: %d, want %d", test.method, test.reference, test.body, code, test.want)
+		}
+	}
+	if passage, _ := getPassage(t, db, testWork, testWork+"1.1"); passage.Text.TXT != "prathamam" {
+		t.Errorf("a rejected request changed 1.1 to %+v", passage.Text)
+	}
+}
+
+func TestPassageRead(t *testing.T) {
+	loadTestCEX(t, testCEX)
+	var passage Passage
+	w := serveAsUser(t, handlePassage, "GET", map[string]string{"urn": testWork + "1.2"}, "", &passage)
+	if w.Code != 200 || w.Header().Get("ETag") != `"1"` || passage.ID != testWork+"1.2" ||
+		passage.PreviousPassage != testWork+"1.1" || passage.NextPassage != testWork+"1.9" ||
+		passage.FirstPassage != testWork+"1.1" || passage.LastPassage != testWork+"1.10" {
+		t.Errorf("GET: %d %+v", w.Code, passage)
+	}
+	if w := serveAsUser(t, handlePassage, "GET", map[string]string{"urn": testWork + "1.3"}, "", nil); w.Code != 404 {
+		t.Errorf("GET of a missing passage: %d, want 404", w.Code)
+	}
+}
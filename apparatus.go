@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// alignmentsBucket holds the Alignments saved by the multicompare page by base passage URN
+const alignmentsBucket = "alignmentsCollection"
+
+// Types of variant readings
+const (
+	variantOmission      = "omission"      //the witness leaves out the lemma
+	variantAddition      = "addition"      //the witness has words the base text does not have
+	variantSubstitution  = "substitution"  //the witness reads differently
+	variantTransposition = "transposition" //the witness has the words of the base text at another place
+)
+
+// Errors of the stored collations
+var (
+	errCollationNotFound = errors.New("the passage has not been collated")
+	errStaleCollation    = errors.New("the witnesses of the collation are not aligned to the same base text, collate the passage again")
+)
+
+// ApparatusWitness is a witness of an apparatus, with the siglum it is cited by.
+type ApparatusWitness struct {
+	URN    string `json:"urn"`
+	Siglum string `json:"siglum"`
+}
+
+// Reading is a variant reading of a lemma and the witnesses supporting it.
+type Reading struct {
+	Text      string   `json:"text"` //empty for an omission
+	Type      string   `json:"type"` //omission, addition, substitution, or transposition
+	Witnesses []string `json:"witnesses"`
+}
+
+// ApparatusEntry is a lemma of an apparatus: a word (a column of the alignment) of the base text
+// with its variant readings. An empty Text marks words added by some witnesses.
+type ApparatusEntry struct {
+	Column     int       `json:"column"`
+	Text       string    `json:"text"`
+	Agreeing   []string  `json:"agreeing"`   //the witnesses reading the lemma
+	Readings   []Reading `json:"readings"`   //the variants, in the order of the witnesses
+	Divergence float32   `json:"divergence"` //how much the witnesses differ from the lemma on average, from 0 to 1
+}
+
+// Apparatus is the critical apparatus of a passage, computed from the stored alignment of its witnesses.
+type Apparatus struct {
+	Passage   string             `json:"passage"`
+	Aligned   string             `json:"aligned"` //the time of the alignment, as YYYYMMDDhhmmss
+	Base      ApparatusWitness   `json:"base"`
+	Witnesses []ApparatusWitness `json:"witnesses"`
+	Lemmata   []ApparatusEntry   `json:"lemmata"`
+}
+
+// transpositionWindow is the number of columns before and after a lemma within which
+// a word found again counts as transposed, so that a repeated particle like ca, tu, or iti
+// further away does not make a variant a transposition
+const transpositionWindow = 3
+
+// variantType returns the type of the reading of the witness aligned as target at column
+// of source. An added word the base text has nearby, an omitted word the witness has nearby,
+// and a reading and lemma swapping places nearby are transpositions (see transpositionWindow).
+func variantType(source, target []string, column int) string {
+	lemma, reading := source[column], target[column]
+	nearby := func(word string, in, other []string) bool {
+		for k := maxInt(0, column-transpositionWindow); k <= column+transpositionWindow && k < len(in); k++ {
+			if k != column && in[k] == word && (k >= len(other) || other[k] != word) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case lemma == "":
+		if nearby(reading, source, target) {
+			return variantTransposition
+		}
+		return variantAddition
+	case reading == "":
+		if nearby(lemma, target, source) {
+			return variantTransposition
+		}
+		return variantOmission
+	case nearby(reading, source, target) && nearby(lemma, target, source):
+		return variantTransposition
+	}
+	return variantSubstitution
+}
+
+// checkCollation returns an error wrapping errStaleCollation unless every witness of alignments
+// is aligned to the same base text as the first one, as the collations saved before the witnesses
+// shared their columns are not.
+func checkCollation(alignments Alignments) error {
+	for i, alignment := range alignments.Alignment {
+		if !equalWords(alignment.Source, alignments.Alignment[0].Source) {
+			name := ""
+			if i < len(alignments.Name) {
+				name = alignments.Name[i]
+			}
+			return fmt.Errorf("%s, witness %s: %w", alignments.AlignmentID, name, errStaleCollation)
+		}
+	}
+	return nil
+}
+
+// equalWords reports whether a and b hold the same words.
+func equalWords(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// buildApparatus computes the apparatus of the passage aligned in alignments, citing the
+// witnesses by the sigla returned by siglum for their passage URNs. A witness has a variant
+// at a lemma if its distance from it is above zero, so that differences of punctuation
+// alone are not variants. The alignments must have passed checkCollation.
+func buildApparatus(alignments Alignments, siglum func(urn string) string) Apparatus {
+	apparatus := Apparatus{Passage: alignments.AlignmentID, Aligned: alignments.AlignmentTime,
+		Base:      ApparatusWitness{URN: alignments.AlignmentID, Siglum: siglum(alignments.AlignmentID)},
+		Witnesses: []ApparatusWitness{}, Lemmata: []ApparatusEntry{}}
+	for i := range alignments.Alignment {
+		name := ""
+		if i < len(alignments.Name) {
+			name = alignments.Name[i]
+		}
+		apparatus.Witnesses = append(apparatus.Witnesses, ApparatusWitness{URN: name, Siglum: siglum(name)})
+	}
+	if len(alignments.Alignment) == 0 {
+		return apparatus
+	}
+
+	for column, text := range alignments.Alignment[0].Source {
+		lemma := ApparatusEntry{Column: column, Text: text, Agreeing: []string{apparatus.Base.Siglum}, Readings: []Reading{}}
+		compared := 0
+		for i, alignment := range alignments.Alignment {
+			if column >= len(alignment.Target) || column >= len(alignment.Score) {
+				continue
+			}
+			compared++
+			lemma.Divergence += alignment.Score[column]
+			witness := apparatus.Witnesses[i].Siglum
+			if alignment.Score[column] <= 0 {
+				lemma.Agreeing = append(lemma.Agreeing, witness)
+				continue
+			}
+			reading := Reading{Text: alignment.Target[column], Type: variantType(alignment.Source, alignment.Target, column)}
+			found := false
+			for r := range lemma.Readings {
+				if lemma.Readings[r].Text == reading.Text && lemma.Readings[r].Type == reading.Type {
+					lemma.Readings[r].Witnesses = append(lemma.Readings[r].Witnesses, witness)
+					found = true
+				}
+			}
+			if !found {
+				reading.Witnesses = []string{witness}
+				lemma.Readings = append(lemma.Readings, reading)
+			}
+		}
+		if compared > 0 {
+			lemma.Divergence /= float32(compared)
+		}
+		apparatus.Lemmata = append(apparatus.Lemmata, lemma)
+	}
+	return apparatus
+}
+
+// readingHTML renders a reading for the Variants card of the multicompare page,
+// with the usual abbreviations for omissions, additions, and transpositions.
+func readingHTML(reading Reading) string {
+	text := addSansHyphens(reading.Text)
+	switch reading.Type {
+	case variantOmission:
+		return "<i>om.</i>"
+	case variantAddition:
+		return "<i>add.</i> " + text
+	case variantTransposition:
+		return text + " <i>transp.</i>"
+	}
+	return text
+}
+
+// getAlignments returns the stored alignment of the witnesses of the passage with the given URN.
+// The error wraps errStaleCollation if they are not aligned to the same base text (see checkCollation).
+func getAlignments(db *UserDB, urn string) (Alignments, error) {
+	var alignments Alignments
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(alignmentsBucket))
+		if bucket == nil || bucket.Get([]byte(urn)) == nil {
+			return fmt.Errorf("%s: %w", urn, errCollationNotFound)
+		}
+		var err error
+		alignments, err = decodeAlignments(bucket.Get([]byte(urn)))
+		if err != nil {
+			return err
+		}
+		return checkCollation(alignments)
+	})
+	return alignments, err
+}
+
+// handleApparatus returns the Apparatus of the passage {urn} computed from the alignment
+// of its witnesses saved by the multicompare page, citing them by their sigla.
+func handleApparatus(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	if !gocite.IsCTSURN(urn) || workBucket(urn) == urn {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	siglum, err := loadSigla(db)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	alignments, err := getAlignments(db, urn)
+	switch {
+	case errors.Is(err, errCollationNotFound):
+		respondWithError(w, "collation_not_found", 404)
+	case errors.Is(err, errStaleCollation):
+		respondWithJSON(w, "error", "stale_collation", err.Error(), 409)
+	case err != nil:
+		log.Printf("handleApparatus: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	default:
+		respondWithData(w, buildApparatus(alignments, siglum), 200)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestVariantType(t *testing.T) {
+	tests := []struct {
+		name           string
+		source, target []string
+		column         int
+		want           string
+	}{
+		{"substitution", []string{"a", "b", "c"}, []string{"a", "x", "c"}, 1, variantSubstitution},
+		{"omission", []string{"a", "b", "c"}, []string{"a", "", "c"}, 1, variantOmission},
+		{"addition", []string{"a", "", "c"}, []string{"a", "x", "c"}, 1, variantAddition},
+		{"swap", []string{"a", "b", "c"}, []string{"b", "a", "c"}, 0, variantTransposition},
+		{"omitted word moved", []string{"a", "b", "c", "d"}, []string{"a", "", "c", "b"}, 1, variantTransposition},
+		{"added word moved", []string{"x", "a", "", "c"}, []string{"", "a", "x", "c"}, 2, variantTransposition},
+		{"reading elsewhere only", []string{"ca", "a", "tu"}, []string{"tu", "a", "x"}, 0, variantSubstitution},
+		{"swap too far", []string{"ca", "a", "b", "c", "d", "tu"}, []string{"tu", "a", "b", "c", "d", "ca"}, 0, variantSubstitution},
+	}
+	for _, test := range tests {
+		if got := variantType(test.source, test.target, test.column); got != test.want {
+			t.Errorf("%s: variantType(%q, %q, %d) = %s, want %s", test.name, test.source, test.target, test.column, got, test.want)
+		}
+	}
+}
+
+func TestBuildApparatus(t *testing.T) {
+	base := "urn:cts:sktlit:skt0001.nyaya002.M3D:1"
+	witnesses := []string{"urn:cts:sktlit:skt0001.nyaya002.C3D:1", "urn:cts:sktlit:skt0001.nyaya002.A1D:1"}
+	alignments := nwa2("tathā api ca", base, []string{"tathā ca", "tathā api tu"}, witnesses, defaultAlignmentSettings())
+	err := checkCollation(alignments)
+	if err != nil {
+		t.Fatalf("checkCollation: %s", err)
+	}
+	apparatus := buildApparatus(alignments, witnessSiglum)
+	var got [][]Reading
+	for _, lemma := range apparatus.Lemmata {
+		got = append(got, lemma.Readings)
+	}
+	want := [][]Reading{
+		{},
+		{{Text: "", Type: variantOmission, Witnesses: []string{"C3D"}}},
+		{{Text: "tu", Type: variantSubstitution, Witnesses: []string{"A1D"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildApparatus readings = %+v, want %+v", got, want)
+	}
+
+	//a witness aligned to another base text, as the pairwise collations were
+	alignments.Alignment[1].Source = []string{"tathā", "api", "", "ca"}
+	err = checkCollation(alignments)
+	if !errors.Is(err, errStaleCollation) {
+		t.Errorf("checkCollation of differing sources = %v, want %v", err, errStaleCollation)
+	}
+}
@@ -45,6 +45,10 @@ func main() {
 		}
 	}
 
+	if *checkDB != "" || *repairDB != "" {
+		os.Exit(runIntegrity(*checkDB, *repairDB, *repairOrdering))
+	}
+
 	if *localAssets && Version == "development" {
 		log.Println("Serving static assets from the local filesystem.")
 	} else if *localAssets && Version != "development" {
@@ -225,7 +229,7 @@ func createRouter() *mux.Router {
 	router.HandleFunc("/crud/", CrudPage)
 	router.HandleFunc("/deleteBucket/{urn}/", deleteBucket)
 	router.HandleFunc("/deleteNode/{urn}/", deleteNode)
-	router.HandleFunc("/export/{filename}/", ExportCEX)
+	router.HandleFunc("/export/{filename}/", requireAuth(ExportCEX))
 	router.HandleFunc("/edit2/{urn}/", Edit2Page)
 	router.HandleFunc("/compare/{urn}+{urn2}/", comparePage)
 	router.HandleFunc("/consolidate/{urn}+{urn2}/", consolidatePage)
@@ -242,9 +246,39 @@ func createRouter() *mux.Router {
 	router.HandleFunc("/favicon.ico", FaviconHandler)
 
 	// API routes
-	a.HandleFunc("/cex/upload", requireAuth(handleCEXUpload))
-	a.HandleFunc("/passage/{urn}", requireAuth(handlePassage))
-	a.HandleFunc("/user", requireAuth(handleUser))
+	a.HandleFunc("/openapi.json", handleOpenAPI).Methods("GET")
+	a.HandleFunc("/cex/upload", requireAuth(handleCEXUpload)).Methods("POST")
+	a.HandleFunc("/cex/progress", requireAuth(handleCEXProgress)).Methods("GET")
+	a.HandleFunc("/passage/{urn}", requireAuth(handlePassageStructure)).Methods("DELETE")
+	a.HandleFunc("/passage/{urn}", requireAuth(handlePassageWrite)).Methods("PUT", "PATCH")
+	a.HandleFunc("/passage/{urn}/{operation:insert|move|renumber|split|merge}", requireAuth(handlePassageStructure)).Methods("POST")
+	a.HandleFunc("/passage/{urn}/revisions", requireAuth(handleRevisions)).Methods("GET")
+	a.HandleFunc("/passage/{urn}/revisions/{revision}/restore", requireAuth(handleRevisionRestore)).Methods("POST")
+	a.HandleFunc("/passage/{urn}/diff", requireAuth(handleRevisionDiff)).Methods("GET")
+	a.HandleFunc("/passage/{urn}/alignment", requireAuth(handlePassageAlignment)).Methods("GET")
+	a.HandleFunc("/passage/{urn}/apparatus", requireAuth(handleApparatus)).Methods("GET")
+	a.HandleFunc("/passage/{urn}/tei", requireAuth(handleTEIExport)).Methods("GET")
+	a.HandleFunc("/passage/{urn}/latex", requireAuth(handleLaTeXExport)).Methods("GET")
+	a.HandleFunc("/passage/{urn}", requireAuth(handlePassage)).Methods("GET")
+	a.HandleFunc("/works", requireAuth(handleWorks)).Methods("GET", "POST")
+	a.HandleFunc("/works/{urn}", requireAuth(handleWork)).Methods("GET", "PUT", "PATCH", "DELETE")
+	a.HandleFunc("/works/{urn}/passages", requireAuth(handleWorkPassages)).Methods("GET")
+	a.HandleFunc("/works/{urn}/alignment", requireAuth(handleWorkAlignment)).Methods("GET", "PUT", "DELETE")
+	a.HandleFunc("/works/{urn}/tei", requireAuth(handleTEIExport)).Methods("GET")
+	a.HandleFunc("/works/{urn}/latex", requireAuth(handleLaTeXExport)).Methods("GET")
+	a.HandleFunc("/works/{urn}/siglum", requireAuth(handleWorkSiglum)).Methods("GET", "PUT", "DELETE")
+	a.HandleFunc("/sigla", requireAuth(handleSigla)).Methods("GET")
+	a.HandleFunc("/alignment/presets", requireAuth(handleAlignmentPresets)).Methods("GET")
+	a.HandleFunc("/alignment/presets/{name}", requireAuth(handleAlignmentPreset)).Methods("PUT", "DELETE")
+	a.HandleFunc("/collections", requireAuth(handleCollections)).Methods("GET", "POST")
+	a.HandleFunc("/collections/{urn}", requireAuth(handleCollection)).Methods("GET", "PUT", "DELETE")
+	a.HandleFunc("/collections/{urn}/images", requireAuth(handleCollectionImages)).Methods("POST")
+	a.HandleFunc("/collections/{urn}/images/{image}", requireAuth(handleCollectionImages)).Methods("GET", "PUT", "DELETE")
+	a.HandleFunc("/integrity", requireAuth(handleIntegrity)).Methods("GET")
+	a.HandleFunc("/integrity/repair", requireAuth(handleIntegrity)).Methods("POST")
+	a.HandleFunc("/user", requireAuth(handleUser)).Methods("GET")
+	a.HandleFunc("/tokens", requireAuth(handleTokens)).Methods("GET", "POST")
+	a.HandleFunc("/tokens/{id}", requireAuth(handleToken)).Methods("DELETE")
 
 	// legacy redirects
 	router.HandleFunc("/ingest", createPermanentRedirect("/ingest/image"))
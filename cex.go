@@ -2,15 +2,11 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
-	"regexp"
-	"sort"
 	"strings"
 	"time"
 
@@ -21,370 +17,229 @@ import (
 	"github.com/ThomasK81/gocite"
 )
 
-// dataframe is the sort-matrix interface used in ExportCEX to sort integer Indices
-//and their string values using used by sort.Sort in ExportCEX
-type dataframe struct {
-	Indices []int
-	Values1 []string
-	Values2 []string
-}
-
-//Len returns the number of Indices in a dataframe
-func (m dataframe) Len() int { return len(m.Indices) }
-
-//Less returns wether the in value of a dataframe index is smaller than the following index
-func (m dataframe) Less(i, j int) bool { return m.Indices[i] < m.Indices[j] }
-
-//Swap swaps the Indices and corresponding values withtin a dataframe
-func (m dataframe) Swap(i, j int) {
-	m.Indices[i], m.Indices[j] = m.Indices[j], m.Indices[i]
-	m.Values1[i], m.Values1[j] = m.Values1[j], m.Values1[i]
-	m.Values2[i], m.Values2[j] = m.Values2[j], m.Values2[i]
-}
-
 // ExportCEX exports CEX data from the user database to a CEX file
 //Reference on CEX files: https://cite-architecture.github.io/citedx/CEX-spec-3.0.1/
+//The works and image collections to export can be chosen with the comma-separated
+//query values works and collections; everything is exported if they are not given.
+//The query value layers (e.g. layers=txt,normalised) selects the text layers, every
+//layer but txt is exported as a parallel version with its own URN.
 func ExportCEX(res http.ResponseWriter, req *http.Request) {
-
-	//First get the session..
-	session, err := getSession(req)
+	user, err := getSessionUser(req)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	//..and check if user is logged in.
-	user, message, loggedin := testLoginStatus("ExportCEX", session)
-	if loggedin {
-		log.Println(message)
-	} else {
-		log.Println(message)
-		Logout(res, req)
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var texturns, texts, areas, imageurns []string
-	var catalog []BoltCatalog
-	var indexs []int
 	vars := mux.Vars(req)
 	filename := vars["filename"]
-	dbname := user + ".db"
-	buckets := Buckets(dbname)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
-	if err != nil {
-		log.Println(fmt.Errorf("ExportCEX: Error opening userDB for reading: %s", err))
-		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
+	opts := CEXExportOptions{Library: CEXLibrary{Name: "Brucheion export of " + user,
+		URN: "urn:cite2:brucheion:" + user + ".export:", License: "CC-BY 4.0"}}
+	if works := req.URL.Query().Get("works"); works != "" {
+		opts.Works = strings.Split(works, ",")
 	}
-	defer db.Close()
-	for i := range buckets {
-		db.View(func(tx *bolt.Tx) error {
-			// Assume bucket exists and has keys
-			bucket := tx.Bucket([]byte(buckets[i]))
-
-			cursor := bucket.Cursor()
-
-			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
-				retrievedcatalog := BoltCatalog{}
-				json.Unmarshal([]byte(value), &retrievedcatalog)
-				catalog = append(catalog, retrievedcatalog)
-			}
-
-			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
-
-				retrievedjson := gocite.Passage{}
-				json.Unmarshal([]byte(value), &retrievedjson)
-				ctsurn := retrievedjson.PassageID
-				text := retrievedjson.Text.TXT
-				index := retrievedjson.Index
-				//imageref := retrievedjson.ImageRef
-				imageref := []string{}
-				for _, tmp := range retrievedjson.ImageLinks {
-					imageref = append(imageref, tmp.Object)
-				}
-				if len(imageref) > 0 {
-					for i := range imageref {
-						areas = append(areas, imageref[i])
-						imageurns = append(imageurns, ctsurn)
-					}
-				}
-				texturns = append(texturns, ctsurn)
-				texts = append(texts, text)
-				indexs = append(indexs, index)
-			}
-
-			return nil
-		})
+	if collections := req.URL.Query().Get("collections"); collections != "" {
+		opts.Collections = strings.Split(collections, ",")
 	}
-	var correctedIndex []int
-	k := 0
-	for i := range indexs {
-		if indexs[i] == 1 {
-			k = i
-		}
-		result := k + indexs[i]
-		correctedIndex = append(correctedIndex, result)
-	}
-	sort.Sort(dataframe{Indices: correctedIndex, Values1: texturns, Values2: texts})
-	var content string
-
-	content = "#!ctscatalog\nurn#citationScheme#groupName#workTitle#versionLabel#exemplarLabel#online#lang\n"
-	for i := range catalog {
-		str := catalog[i].URN + "#" + catalog[i].Citation + "#" + catalog[i].GroupName + "#" + catalog[i].WorkTitle + "#" + catalog[i].VersionLabel + "#" + catalog[i].ExemplarLabel + "#" + catalog[i].Online + "#" + catalog[i].Language + "\n"
-		if str != "#######\n" {
-			content = content + str
+	if layers := req.URL.Query().Get("layers"); layers != "" {
+		opts.Layers = strings.Split(layers, ",")
+		for _, layer := range opts.Layers {
+			if !contains(cexLayers, layer) {
+				http.Error(res, "unknown text layer "+layer, http.StatusBadRequest)
+				return
+			}
 		}
 	}
-	content = content + "\n\n#!ctsdata\n"
 
-	//content = "#!ctsdata\n"
-	for i := range texturns {
-		str := texturns[i] + "#" + texts[i] + "\n"
-		if str != "#\n" {
-			content = content + str
-		}
-	}
-	content = content + "\n#!relations\n"
-	for i := range imageurns {
-		str := imageurns[i] + "#urn:cite2:dse:verbs.v1:appearsOn:#" + areas[i] + "\n"
-		content = content + str
+	var content bytes.Buffer
+	err = exportCEX(&content, user, opts)
+	if err != nil {
+		log.Println(fmt.Errorf("ExportCEX: Error exporting userDB: %s", err))
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	content = content + "\n"
 	contentdispo := "Attachment; filename=" + filename + ".cex"
 	modtime := time.Now()
 	res.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	res.Header().Add("Content-Disposition", contentdispo)
-	http.ServeContent(res, req, filename, modtime, bytes.NewReader([]byte(content)))
+	http.ServeContent(res, req, filename, modtime, bytes.NewReader(content.Bytes()))
 }
 
-func loadCEX(data string, user string) error {
-	var urns, areas []string
-	var catalog []BoltCatalog
-
-	//read in the relations of the CEX file cutting away all unnecessary signs
-	if strings.Contains(data, "#!relations") {
-		relations := strings.Split(data, "#!relations")[1]
-		relations = strings.Split(relations, "#!")[0]
-		re := regexp.MustCompile("(?m)[\r\n]*^//.*$")
-		relations = re.ReplaceAllString(relations, "")
-
-		reader := csv.NewReader(strings.NewReader(relations))
-		reader.Comma = '#'
-		reader.LazyQuotes = true
-		reader.FieldsPerRecord = 3
-
-		for {
-			line, error := reader.Read()
-			if error == io.EOF {
-				break
-			} else if error != nil {
-				log.Fatal(error)
-			}
-			if strings.Contains(line[1], "appearsOn") {
-				urns = append(urns, line[0])
-				areas = append(areas, line[2])
-			}
-		}
+//exportCEX writes the works and image collections selected by opts
+//from the database of user to w.
+func exportCEX(w io.Writer, user string, opts CEXExportOptions) error {
+	db, err := openUserDB(user)
+	if err != nil {
+		return err
 	}
-
-	//read in the ctscatalog (if exists)
-	if strings.Contains(data, "#!ctscatalog") {
-		ctsCatalog := strings.Split(data, "#!ctscatalog")[1]
-		ctsCatalog = strings.Split(ctsCatalog, "#!")[0]
-		re := regexp.MustCompile("(?m)[\r\n]*^//.*$")
-		ctsCatalog = re.ReplaceAllString(ctsCatalog, "")
-
-		var caturns, catcits, catgrps, catwrks, catvers, catexpls, onlines, languages []string
-		// var languages [][]string
-
-		reader := csv.NewReader(strings.NewReader(ctsCatalog))
-		reader.Comma = '#'
-		reader.LazyQuotes = true
-		reader.FieldsPerRecord = -1
-		reader.TrimLeadingSpace = true
-
-		for {
-			line, error := reader.Read()
-			if error == io.EOF {
-				break
-			} else if error != nil {
-				log.Fatal(error)
-			}
-
-			switch {
-			case len(line) == 8:
-				if line[0] != "urn" {
-					caturns = append(caturns, line[0])
-					catcits = append(catcits, line[1])
-					catgrps = append(catgrps, line[2])
-					catwrks = append(catwrks, line[3])
-					catvers = append(catvers, line[4])
-					catexpls = append(catexpls, line[5])
-					onlines = append(onlines, line[6])
-					languages = append(languages, line[7])
-				}
-			case len(line) != 8:
-				log.Println("Catalogue Data not well formatted")
-			}
-		}
-		for j := range caturns {
-			catalog = append(catalog, BoltCatalog{URN: caturns[j], Citation: catcits[j], GroupName: catgrps[j], WorkTitle: catwrks[j], VersionLabel: catvers[j], ExemplarLabel: catexpls[j], Online: onlines[j], Language: languages[j]})
-		}
+	defer db.Close()
+	cex, err := readCEX(db, opts)
+	if err != nil {
+		return err
 	}
+	return WriteCEX(w, cex)
+}
 
-	//read in the cts data
-	ctsdata := strings.Split(data, "#!ctsdata")[1]
-	ctsdata = strings.Split(ctsdata, "#!")[0]
-	re := regexp.MustCompile("(?m)[\r\n]*^//.*$")
-	ctsdata = re.ReplaceAllString(ctsdata, "")
-
-	reader := csv.NewReader(strings.NewReader(ctsdata))
-	reader.Comma = '#'
-	reader.LazyQuotes = true
-	reader.FieldsPerRecord = -1
-	reader.TrimLeadingSpace = true
-
-	var texturns, text []string
-
-	for {
-		line, error := reader.Read()
-		if error == io.EOF {
-			break
-		} else if error != nil {
-			fmt.Println(line)
-			log.Fatal(error)
-		}
-		switch {
-		case len(line) == 2:
-			texturns = append(texturns, line[0])
-			text = append(text, line[1])
-		case len(line) > 2:
-			texturns = append(texturns, line[0])
-			var textstring string
-			for j := 1; j < len(line); j++ {
-				textstring = textstring + line[j]
-			}
-			text = append(text, textstring)
-		case len(line) < 2:
-			fmt.Println("Wrong line:", line)
-		}
+//loadCEX parses the CEX data read from r and saves the contained works,
+//their catalog entries and image links in the user database.
+func loadCEX(r io.Reader, user string) error {
+	cex, err := ParseCEX(r)
+	if err != nil {
+		return err
 	}
+	return importCEX(cex, user, CEXImportOptions{Strategy: cexOverwrite})
+}
 
-	works := append([]string(nil), texturns...)
-	for i := range texturns {
-		works[i] = strings.Join(strings.Split(texturns[i], ":")[0:4], ":") + ":"
+//importCEX saves parsed CEX data in the user database. Passages that already exist
+//in the database are treated according to opts. The whole file is written in a single
+//transaction, so nothing is saved if any of the works fails. The progress of the import
+//can be followed with importProgress.
+func importCEX(cex *CEXData, user string, opts CEXImportOptions) error {
+	boltdata, err := cexToBoltData(cex)
+	if err != nil {
+		return err
 	}
-	works = removeDuplicatesUnordered(works)
-	var boltworks []gocite.Work
-	var sortedcatalog []BoltCatalog
-	for i := range works {
-		work := works[i]
-		testexist := false
-		for j := range catalog {
-			if catalog[j].URN == work {
-				sortedcatalog = append(sortedcatalog, catalog[j])
-				testexist = true
-			}
-		}
-		if testexist == false {
-			log.Println(works[i], " has no catalog entry")
-			sortedcatalog = append(sortedcatalog, BoltCatalog{})
-		}
 
-		var passages []gocite.Passage
-		for j := range texturns {
-			if strings.Contains(texturns[j], work) {
-				var textareas []gocite.Triple
-				if contains(urns, texturns[j]) {
-					for k := range urns {
-						if urns[k] == texturns[j] {
-							textareas = append(textareas, gocite.Triple{Subject: texturns[j],
-								Verb:   "urn:cite2:dse:verbs.v1:appears_on",
-								Object: areas[k]})
-						}
-					}
-				}
-				linetext := strings.Replace(text[j], "-NEWLINE-", "\r\n", -1)
-				passages = append(passages, gocite.Passage{PassageID: texturns[j],
-					Range: false,
-					Text: gocite.EncText{Brucheion: text[j],
-						TXT: linetext},
-					ImageLinks: textareas})
-			}
-		}
-		//assign Next and Prev fields for all passages
-		for j := range passages {
-			passages[j].Index = j
-			switch {
-			case j+1 == len(passages):
-				passages[j].Next = gocite.PassLoc{Exists: false}
-			default:
-				passages[j].Next = gocite.PassLoc{Exists: true, PassageID: passages[j+1].PassageID, Index: j + 1}
-			}
-			switch {
-			case j == 0:
-				passages[j].Prev = gocite.PassLoc{Exists: false}
-			default:
-				passages[j].Prev = gocite.PassLoc{Exists: true, PassageID: passages[j-1].PassageID, Index: j - 1}
-			}
-		}
-		/*workToBeSaved, _ := gocite.SortPassages(gocite.Work{WorkID: work, Passages: passages, Ordered: true, First: gocite.PassLoc{Exists: true, PassageID: passages[0].PassageID, Index: 0}, Last: gocite.PassLoc{Exists: true, PassageID: passages[len(passages)-1].PassageID, Index: len(passages) - 1}})
-		boltworks = append(boltworks, workToBeSaved)*/
-		boltworks = append(boltworks, gocite.Work{WorkID: work, Passages: passages, Ordered: true, First: gocite.PassLoc{Exists: true, PassageID: passages[0].PassageID, Index: 0}, Last: gocite.PassLoc{Exists: true, PassageID: passages[len(passages)-1].PassageID, Index: len(passages) - 1}})
+	progress := CEXProgress{WorksTotal: len(boltdata.Bucket)}
+	for i := range boltdata.Data {
+		progress.PassagesTotal += len(boltdata.Data[i].Passages)
 	}
-	boltdata := BoltData{Bucket: works, Data: boltworks, Catalog: sortedcatalog}
+	setImportProgress(user, progress)
 
 	// write to database
-	pwd, _ := os.Getwd()
-	dbname := pwd + "/" + user + ".db"
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openUserDB(user)
 	if err != nil {
-		log.Println(fmt.Printf("handleCEXLoad: error opening userDB for writing: %s", err))
+		log.Printf("importCEX: error opening userDB for writing: %s\n", err)
+		progress.finish(user, err)
 		return err
 	}
 	defer db.Close()
-	for i := range boltdata.Bucket {
-		newbucket := boltdata.Bucket[i]
-		/// new stuff
-		//Saving the CTS Catalog data
-		newcatkey := boltdata.Bucket[i]
-		newcatnode, _ := json.Marshal(boltdata.Catalog[i])
-		catkey := []byte(newcatkey)
-		catvalue := []byte(newcatnode)
-		err = db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
+		for i := range boltdata.Bucket {
+			newbucket := boltdata.Bucket[i]
+			progress.Work = newbucket
+			setImportProgress(user, progress)
 			bucket, err := tx.CreateBucketIfNotExists([]byte(newbucket))
 			if err != nil {
-				return err
+				return fmt.Errorf("importing %s failed: %s", newbucket, err)
 			}
-			return bucket.Put(catkey, catvalue)
-		})
 
-		if err != nil {
-			log.Fatal(err)
-		}
-		/// end stuff
-
-		//saving the individual passages
-		for j := range boltdata.Data[i].Passages {
-			newkey := boltdata.Data[i].Passages[j].PassageID
-			newnode, _ := json.Marshal(boltdata.Data[i].Passages[j])
-			key := []byte(newkey)
-			value := []byte(newnode)
-			// store some data
-			err = db.Update(func(tx *bolt.Tx) error {
-				bucket, err := tx.CreateBucketIfNotExists([]byte(newbucket))
+			//Saving the CTS Catalog data, an existing entry is not replaced by a missing one
+			catalog, err := getCatalog(tx, newbucket)
+			if err != nil {
+				return fmt.Errorf("importing %s failed: %s", newbucket, err)
+			}
+			if boltdata.Catalog[i].URN != "" && (catalog.URN == "" || opts.Strategy == cexOverwrite) {
+				err = putCatalog(tx, boltdata.Catalog[i])
 				if err != nil {
-					return err
+					return fmt.Errorf("importing %s failed: %s", newbucket, err)
 				}
-				return bucket.Put(key, value)
-			})
+			}
 
+			//merging and saving the individual passages, with new versions for the changed ones
+			//and the replaced texts recorded in their histories
+			existing := bucketPassages(bucket)
+			stored := make(map[string]gocite.Passage, len(existing))
+			for _, passage := range existing {
+				stored[passage.PassageID] = passage
+			}
+			work, err := mergeWork(newbucket, existing, boltdata.Data[i].Passages, opts)
 			if err != nil {
-				log.Fatal(err)
+				return fmt.Errorf("importing %s failed: %s", newbucket, err)
 			}
+			for _, passage := range work.Passages {
+				value, _ := json.Marshal(passage)
+				err = bucket.Put([]byte(passage.PassageID), value)
+				if err != nil {
+					return fmt.Errorf("saving passage %s failed: %s", passage.PassageID, err)
+				}
+				old, found := stored[passage.PassageID]
+				if found && passageContent(old) == passageContent(passage) {
+					continue
+				}
+				_, err = nextVersion(tx, passage.PassageID)
+				if err == nil && found && old.Text != passage.Text {
+					err = recordTextChange(tx, passage.PassageID, user, old.Text, passage.Text)
+				}
+				if err != nil {
+					return fmt.Errorf("saving passage %s failed: %s", passage.PassageID, err)
+				}
+			}
+			err = updateWorkBounds(tx, newbucket)
+			if err != nil {
+				return fmt.Errorf("importing %s failed: %s", newbucket, err)
+			}
+			progress.WorksDone++
+			progress.PassagesDone += len(boltdata.Data[i].Passages)
+			setImportProgress(user, progress)
+			log.Printf("importCEX: %s: %d/%d works, %d/%d passages\n", user,
+				progress.WorksDone, progress.WorksTotal, progress.PassagesDone, progress.PassagesTotal)
 		}
+		return importImageCollections(tx, cexImageCollections(cex), opts)
+	})
+	if err != nil {
+		err = fmt.Errorf("importCEX: %w, nothing has been imported", err)
+		progress.finish(user, err)
+		return err
 	}
 
+	progress.finish(user, nil)
 	log.Println("CEX data loaded into Brucheion successfully.")
 	return nil
 }
+
+//cexToBoltData groups the passages of parsed CEX data by work and attaches
+//catalog entries and image links (from appearsOn relations) to them.
+//Works keep the order of their first appearance in the CEX data.
+func cexToBoltData(cex *CEXData) (BoltData, error) {
+	var boltdata BoltData
+	images := make(map[string][]string) //passage URN -> image URNs
+	for _, relation := range cex.Relations {
+		if strings.Contains(relation.Verb, "appearsOn") {
+			images[relation.Subject] = append(images[relation.Subject], relation.Object)
+		}
+	}
+
+	passages := make(map[string][]gocite.Passage) //work URN -> passages
+	seen := make(map[string]bool)
+	for _, p := range cex.Passages {
+		if !gocite.IsCTSURN(p.URN) {
+			return boltdata, &CEXError{Line: p.Line, Block: "ctsdata", Msg: fmt.Sprintf("invalid CTS URN %q", p.URN)}
+		}
+		if seen[p.URN] {
+			return boltdata, &CEXError{Line: p.Line, Block: "ctsdata", Msg: fmt.Sprintf("duplicate passage URN %q", p.URN)}
+		}
+		seen[p.URN] = true
+		work := strings.Join(strings.Split(p.URN, ":")[0:4], ":") + ":"
+		if _, ok := passages[work]; !ok {
+			boltdata.Bucket = append(boltdata.Bucket, work)
+		}
+		var textareas []gocite.Triple
+		for _, area := range images[p.URN] {
+			textareas = append(textareas, gocite.Triple{Subject: p.URN,
+				Verb:   "urn:cite2:dse:verbs.v1:appears_on",
+				Object: area})
+		}
+		linetext := strings.Replace(p.Text, "-NEWLINE-", "\r\n", -1)
+		passages[work] = append(passages[work], gocite.Passage{PassageID: p.URN,
+			Range:      false,
+			Text:       gocite.EncText{Brucheion: p.Text, TXT: linetext},
+			ImageLinks: textareas})
+	}
+
+	for _, work := range boltdata.Bucket {
+		catalog := BoltCatalog{}
+		found := false
+		for j := range cex.Catalog {
+			if cex.Catalog[j].URN == work {
+				catalog = cex.Catalog[j]
+				found = true
+			}
+		}
+		if !found {
+			log.Println(work, " has no catalog entry")
+		}
+		boltdata.Catalog = append(boltdata.Catalog, catalog)
+		boltdata.Data = append(boltdata.Data, linkPassages(work, passages[work]))
+	}
+	return boltdata, nil
+}
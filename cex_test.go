@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+)
+
+var golden = flag.Bool("golden", false, "Update the golden files of the CEX round-trip tests.")
+
+func TestCEXRoundTrip(t *testing.T) {
+	fixtures := []struct {
+		name    string //name of the golden file
+		fixture string //name of the CEX file that is imported
+		opts    CEXExportOptions
+		layers  map[string]gocite.EncText //text layers given to passages after the import
+	}{
+		{"catalog", "catalog", CEXExportOptions{}, nil},
+		{"newline", "newline", CEXExportOptions{}, nil},
+		{"relations", "relations", CEXExportOptions{}, nil},
+		{"multiwork", "multiwork", CEXExportOptions{}, nil},
+		{"collections", "collections", CEXExportOptions{}, nil},
+		{"multiwork_selected", "multiwork", CEXExportOptions{Works: []string{"urn:cts:sktlit:skt0001.nyaya002.C3D:"}}, nil},
+		{"catalog_layers", "catalog", CEXExportOptions{Layers: []string{cexLayerTXT, cexLayerNormalised}},
+			map[string]gocite.EncText{"urn:cts:sktlit:skt0001.nyaya002.M3D:1.1.1": {TXT: "pramāṇaprameyasaṃśaya", Normalised: "pramāṇa-prameya-saṃśaya"}}},
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		t.Run(f.name, func(t *testing.T) {
+			input, err := ioutil.ReadFile(filepath.Join(wd, "testdata", "cex", f.fixture+".cex"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			//loadCEX writes to the working directory
+			dir, err := ioutil.TempDir("", "brucheion")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			err = os.Chdir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			err = loadCEX(bytes.NewReader(input), "test")
+			if err != nil {
+				t.Fatalf("loadCEX: %s", err)
+			}
+			if len(f.layers) > 0 {
+				db, err := openUserDB("test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for urn, text := range f.layers {
+					passage, err := db.GetPassage(urn)
+					if err != nil {
+						t.Fatal(err)
+					}
+					passage.Text = text
+					err = db.PutPassage(passage)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				db.Close()
+			}
+			f.opts.Library = CEXLibrary{Name: "Brucheion test", URN: "urn:cite2:brucheion:test.v1:", License: "CC-BY 4.0"}
+			var output bytes.Buffer
+			err = exportCEX(&output, "test", f.opts)
+			if err != nil {
+				t.Fatalf("exportCEX: %s", err)
+			}
+
+			goldenFile := filepath.Join(wd, "testdata", "cex", f.name+".golden")
+			if *golden {
+				err = ioutil.WriteFile(goldenFile, output.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(output.Bytes(), expected) {
+				t.Errorf("Exported CEX does not match %s.\nResult:\n%s\nExpected:\n%s\n", goldenFile, output.String(), expected)
+			}
+
+			//the export has to be read back unchanged
+			err = loadCEX(bytes.NewReader(output.Bytes()), "again")
+			if err != nil {
+				t.Fatalf("loadCEX of the export: %s", err)
+			}
+			var again bytes.Buffer
+			err = exportCEX(&again, "again", CEXExportOptions{Library: f.opts.Library})
+			if err != nil {
+				t.Fatalf("exportCEX: %s", err)
+			}
+			if f.opts.Layers == nil && !bytes.Equal(output.Bytes(), again.Bytes()) {
+				t.Errorf("Exporting the imported export changed it.\nResult:\n%s\nExpected:\n%s\n", again.String(), output.String())
+			}
+		})
+	}
+}
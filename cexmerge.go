@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// Strategies for passages of a CEX file that already exist in the user database
+const (
+	cexOverwrite      = "overwrite"        //the passage from the CEX file replaces the stored one
+	cexKeepExisting   = "keep-existing"    //the stored passage is kept
+	cexFailOnConflict = "fail-on-conflict" //the import fails if the texts differ
+)
+
+// Per-passage resolutions of a conflict
+const (
+	cexUseIncoming = "incoming"
+	cexUseExisting = "existing"
+)
+
+// CEXImportOptions controls how importCEX treats passages that are already stored.
+type CEXImportOptions struct {
+	Strategy    string            //one of cexOverwrite, cexKeepExisting, cexFailOnConflict
+	Resolutions map[string]string //passage URN -> cexUseIncoming or cexUseExisting, overrides Strategy
+}
+
+// CEXConflict is a passage of a CEX file whose text differs from the stored version.
+type CEXConflict struct {
+	Line     int    `json:"line"`
+	URN      string `json:"urn"`
+	Existing string `json:"existing"`
+	Incoming string `json:"incoming"`
+}
+
+// validate checks the strategy and the resolutions of opts. An empty strategy defaults to cexOverwrite.
+func (opts *CEXImportOptions) validate() error {
+	switch opts.Strategy {
+	case "":
+		opts.Strategy = cexOverwrite
+	case cexOverwrite, cexKeepExisting, cexFailOnConflict:
+	default:
+		return fmt.Errorf("unknown import strategy %q", opts.Strategy)
+	}
+	for urn, resolution := range opts.Resolutions {
+		if resolution != cexUseIncoming && resolution != cexUseExisting {
+			return fmt.Errorf("unknown resolution %q for passage %s", resolution, urn)
+		}
+	}
+	return nil
+}
+
+// unresolved returns the conflicts of report that opts does not resolve.
+func (opts CEXImportOptions) unresolved(report CEXReport) []CEXConflict {
+	conflicts := []CEXConflict{}
+	if opts.Strategy != cexFailOnConflict {
+		return conflicts
+	}
+	for _, conflict := range report.Conflicts {
+		if _, ok := opts.Resolutions[conflict.URN]; !ok {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts
+}
+
+// resolve reports whether the incoming version of a passage should replace the stored one.
+func (opts CEXImportOptions) resolve(existing, incoming gocite.Passage) (bool, error) {
+	switch opts.Resolutions[incoming.PassageID] {
+	case cexUseIncoming:
+		return true, nil
+	case cexUseExisting:
+		return false, nil
+	}
+	switch opts.Strategy {
+	case cexKeepExisting:
+		return false, nil
+	case cexFailOnConflict:
+		if existing.Text.TXT != incoming.Text.TXT {
+			return false, fmt.Errorf("passage %s conflicts with the stored version", incoming.PassageID)
+		}
+		return true, nil
+	}
+	return true, nil
+}
+
+// bucketPassages returns the passages stored in a work bucket in their reading order.
+func bucketPassages(bucket *bolt.Bucket) []gocite.Passage {
+	var passages []gocite.Passage
+	cursor := bucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+		passage := gocite.Passage{}
+		if json.Unmarshal(value, &passage) != nil || passage.PassageID == "" {
+			continue
+		}
+		passages = append(passages, passage)
+	}
+	return orderPassages(passages)
+}
+
+// orderPassages sorts passages by following their Prev/Next chain. If the chain
+// is broken the passages are sorted by their Index instead.
+func orderPassages(passages []gocite.Passage) []gocite.Passage {
+	sort.SliceStable(passages, func(i, j int) bool { return passages[i].Index < passages[j].Index })
+	byID := make(map[string]int, len(passages))
+	for i := range passages {
+		byID[passages[i].PassageID] = i
+	}
+	for i := range passages {
+		if passages[i].Prev.Exists {
+			continue
+		}
+		var chain []gocite.Passage
+		visited := make(map[string]bool)
+		for j, ok := i, true; ok && !visited[passages[j].PassageID]; {
+			visited[passages[j].PassageID] = true
+			chain = append(chain, passages[j])
+			if !passages[j].Next.Exists {
+				break
+			}
+			j, ok = byID[passages[j].Next.PassageID]
+		}
+		if len(chain) == len(passages) {
+			return chain
+		}
+		break
+	}
+	return passages
+}
+
+// mergeWork merges the incoming passages of a CEX file into the passages already stored
+// for workID and returns the relinked work. Stored passages keep their position and are
+// replaced according to opts. New passages follow the incoming passage they follow in the
+// CEX file; new passages before the first stored one are placed in front of it, and
+// are appended if none of the incoming passages is stored yet.
+func mergeWork(workID string, existing, incoming []gocite.Passage, opts CEXImportOptions) (gocite.Work, error) {
+	position := make(map[string]int, len(existing))
+	for i := range existing {
+		position[existing[i].PassageID] = i
+	}
+	before := make(map[string][]gocite.Passage) //stored URN -> new passages in front of it
+	after := make(map[string][]gocite.Passage)  //stored URN -> new passages following it
+	var pending []gocite.Passage
+	anchor := ""
+	for _, passage := range incoming {
+		i, ok := position[passage.PassageID]
+		if !ok {
+			if anchor == "" {
+				pending = append(pending, passage)
+			} else {
+				after[anchor] = append(after[anchor], passage)
+			}
+			continue
+		}
+		replace, err := opts.resolve(existing[i], passage)
+		if err != nil {
+			return gocite.Work{}, err
+		}
+		if replace {
+			existing[i].Text = passage.Text
+			existing[i].ImageLinks = passage.ImageLinks
+			existing[i].Range = passage.Range
+		}
+		if anchor == "" {
+			before[passage.PassageID] = pending
+			pending = nil
+		}
+		anchor = passage.PassageID
+	}
+
+	merged := make([]gocite.Passage, 0, len(existing)+len(incoming))
+	for _, passage := range existing {
+		merged = append(merged, before[passage.PassageID]...)
+		merged = append(merged, passage)
+		merged = append(merged, after[passage.PassageID]...)
+	}
+	merged = append(merged, pending...)
+	return linkPassages(workID, merged), nil
+}
+
+// importImageCollections merges image collections into the imgCollection bucket.
+// Images that are already stored are replaced unless opts keeps existing data.
+func importImageCollections(tx *bolt.Tx, collections map[string]imageCollection, opts CEXImportOptions) error {
+	if len(collections) == 0 {
+		return nil
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte("imgCollection"))
+	if err != nil {
+		return err
+	}
+	for name, incoming := range collections {
+		collection := imageCollection{URN: incoming.URN, Name: incoming.Name}
+		if value := bucket.Get([]byte(name)); value != nil {
+			collection, err = decodeImgCol(value)
+			if err != nil {
+				return fmt.Errorf("decoding image collection %s failed: %s", name, err)
+			}
+		}
+		for _, img := range incoming.Collection {
+			found := false
+			for i := range collection.Collection {
+				if collection.Collection[i].URN == img.URN {
+					found = true
+					if opts.Strategy == cexOverwrite {
+						collection.Collection[i] = img
+					}
+				}
+			}
+			if !found {
+				collection.Collection = append(collection.Collection, img)
+			}
+		}
+		value, err := json.Marshal(collection)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(name), value)
+		if err != nil {
+			return fmt.Errorf("saving image collection %s failed: %s", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+)
+
+func TestMergeWork(t *testing.T) {
+	const work = "urn:cts:sktlit:skt0001.nyaya002.M3D:"
+	passages := func(refs ...string) []gocite.Passage {
+		var result []gocite.Passage
+		for i := 0; i+1 < len(refs); i += 2 {
+			result = append(result, gocite.Passage{PassageID: work + refs[i], Text: gocite.EncText{TXT: refs[i+1]}})
+		}
+		return result
+	}
+	existing := []string{"1", "stored one", "2", "two"}
+	incoming := []string{"0", "new zero", "1", "incoming one", "2", "two", "2a", "new two a"}
+	tests := []struct {
+		name        string
+		strategy    string
+		resolutions map[string]string
+		want        []string //reference and text of the merged passages in order, nil for an error
+	}{
+		{"overwrite", cexOverwrite, nil, []string{"0", "new zero", "1", "incoming one", "2", "two", "2a", "new two a"}},
+		{"keep existing", cexKeepExisting, nil, []string{"0", "new zero", "1", "stored one", "2", "two", "2a", "new two a"}},
+		{"fail on conflict", cexFailOnConflict, nil, nil},
+		{"fail on conflict resolved incoming", cexFailOnConflict, map[string]string{work + "1": cexUseIncoming},
+			[]string{"0", "new zero", "1", "incoming one", "2", "two", "2a", "new two a"}},
+		{"fail on conflict resolved existing", cexFailOnConflict, map[string]string{work + "1": cexUseExisting},
+			[]string{"0", "new zero", "1", "stored one", "2", "two", "2a", "new two a"}},
+		{"overwrite resolved existing", cexOverwrite, map[string]string{work + "1": cexUseExisting},
+			[]string{"0", "new zero", "1", "stored one", "2", "two", "2a", "new two a"}},
+		{"keep existing resolved incoming", cexKeepExisting, map[string]string{work + "1": cexUseIncoming},
+			[]string{"0", "new zero", "1", "incoming one", "2", "two", "2a", "new two a"}},
+	}
+	for _, test := range tests {
+		opts := CEXImportOptions{Strategy: test.strategy, Resolutions: test.resolutions}
+		err := opts.validate()
+		if err != nil {
+			t.Fatalf("%s: validate: %s", test.name, err)
+		}
+		merged, err := mergeWork(work, passages(existing...), passages(incoming...), opts)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: mergeWork succeeded, want a conflict", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: mergeWork: %s", test.name, err)
+			continue
+		}
+		var got []string
+		for _, passage := range merged.Passages {
+			got = append(got, passage.PassageID[len(work):], passage.Text.TXT)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mergeWork = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeWorkAppendsUnrelated(t *testing.T) {
+	const work = "urn:cts:sktlit:skt0001.nyaya002.M3D:"
+	existing := []gocite.Passage{{PassageID: work + "1"}}
+	incoming := []gocite.Passage{{PassageID: work + "5"}, {PassageID: work + "6"}}
+	merged, err := mergeWork(work, existing, incoming, CEXImportOptions{Strategy: cexOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, passage := range merged.Passages {
+		order = append(order, passage.PassageID)
+	}
+	if !reflect.DeepEqual(order, []string{work + "1", work + "5", work + "6"}) {
+		t.Errorf("mergeWork order = %q, want the new passages appended", order)
+	}
+}
+
+func TestCEXImportOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts CEXImportOptions
+		ok   bool
+	}{
+		{CEXImportOptions{}, true},
+		{CEXImportOptions{Strategy: cexKeepExisting}, true},
+		{CEXImportOptions{Strategy: "merge"}, false},
+		{CEXImportOptions{Strategy: cexOverwrite, Resolutions: map[string]string{"urn:cts:a:b.c.d:1": "mine"}}, false},
+	}
+	for _, test := range tests {
+		if err := test.opts.validate(); (err == nil) != test.ok {
+			t.Errorf("validate(%+v) = %v, want ok = %t", test.opts, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// CEXProgress describes the state of the latest CEX import of a user.
+type CEXProgress struct {
+	Work          string    `json:"work"` //the work currently being imported
+	WorksDone     int       `json:"worksDone"`
+	WorksTotal    int       `json:"worksTotal"`
+	PassagesDone  int       `json:"passagesDone"`
+	PassagesTotal int       `json:"passagesTotal"`
+	Done          bool      `json:"done"`
+	Error         string    `json:"error,omitempty"`
+	Updated       time.Time `json:"updated"`
+}
+
+// cexImports holds the progress of the CEX imports by user name
+var cexImports = struct {
+	sync.Mutex
+	progress map[string]CEXProgress
+}{progress: make(map[string]CEXProgress)}
+
+// setImportProgress records the import progress of user.
+func setImportProgress(user string, progress CEXProgress) {
+	progress.Updated = time.Now()
+	cexImports.Lock()
+	cexImports.progress[user] = progress
+	cexImports.Unlock()
+}
+
+// importProgress returns the progress of the latest CEX import of user
+// and whether there has been one since the server started.
+func importProgress(user string) (CEXProgress, bool) {
+	cexImports.Lock()
+	defer cexImports.Unlock()
+	progress, ok := cexImports.progress[user]
+	return progress, ok
+}
+
+// finish marks the import of user as done. A failed import is rolled back
+// completely, so no progress is reported for it.
+func (progress *CEXProgress) finish(user string, err error) {
+	progress.Work = ""
+	progress.Done = true
+	if err != nil {
+		progress.Error = err.Error()
+		progress.WorksDone = 0
+		progress.PassagesDone = 0
+	}
+	setImportProgress(user, *progress)
+}
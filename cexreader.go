@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+)
+
+//Reference on CEX files: https://cite-architecture.github.io/citedx/CEX-spec-3.0.1/
+
+// CEXError reports a malformed line in CEX input together with the line number
+// and the block it was found in.
+type CEXError struct {
+	Line  int    //1-based line number within the CEX input
+	Block string //the block label the line belongs to (e.g. "ctsdata"), empty if outside of a block
+	Msg   string //what was wrong with the line
+}
+
+func (e *CEXError) Error() string {
+	if e.Block == "" {
+		return fmt.Sprintf("cex: line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("cex: line %d (#!%s): %s", e.Line, e.Block, e.Msg)
+}
+
+// CEXLibrary holds the key-value pairs of a #!citelibrary block
+type CEXLibrary struct {
+	Name    string `json:"name"`
+	URN     string `json:"urn"`
+	License string `json:"license"`
+}
+
+// CEXPassage is a single line of a #!ctsdata block
+type CEXPassage struct {
+	URN  string `json:"urn"`
+	Text string `json:"text"`
+	Line int    `json:"line"`
+}
+
+// CEXCollection is a single line of a #!citecollections block
+type CEXCollection struct {
+	URN         string `json:"urn"`
+	Description string `json:"description"`
+	Labelling   string `json:"labellingProperty"`
+	Ordering    string `json:"orderingProperty"`
+	License     string `json:"license"`
+}
+
+// CEXProperty is a single line of a #!citeproperties block
+type CEXProperty struct {
+	URN       string `json:"urn"`
+	Label     string `json:"label"`
+	Type      string `json:"type"`
+	Authority string `json:"authorityList"`
+}
+
+// CEXCiteData holds one #!citedata block. Every block carries its own header
+// naming the properties of its records, so blocks are kept apart.
+type CEXCiteData struct {
+	Header []string   `json:"header"`
+	Rows   [][]string `json:"rows"`
+}
+
+// CEXDataModel is a single line of a #!datamodels block
+type CEXDataModel struct {
+	Collection  string `json:"collection"`
+	Model       string `json:"model"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+}
+
+// CEXImageData is a single line of an #!imagedata block
+type CEXImageData struct {
+	Collection string `json:"collection"`
+	Protocol   string `json:"protocol"`
+	URL        string `json:"url"`
+	Rights     string `json:"rights"`
+}
+
+// CEXRelation is a single line of a #!relations block
+type CEXRelation struct {
+	gocite.Triple
+	Line int
+}
+
+// CEXData is the parsed content of a CEX file. Repeated blocks of the same
+// type are merged in the order in which they appear.
+type CEXData struct {
+	Version     string
+	Library     CEXLibrary
+	Catalog     []BoltCatalog
+	Passages    []CEXPassage
+	Collections []CEXCollection
+	Properties  []CEXProperty
+	CiteData    []CEXCiteData
+	DataModels  []CEXDataModel
+	ImageData   []CEXImageData
+	Relations   []CEXRelation
+}
+
+// cexBlocks lists the block labels defined by the CEX 3.0 specification
+var cexBlocks = []string{"cexversion", "citelibrary", "ctscatalog", "ctsdata",
+	"citecollections", "citeproperties", "citedata", "datamodels", "imagedata", "relations"}
+
+// ParseCEX reads CEX data from r and returns its content as CEXData.
+// Malformed lines are reported as *CEXError. Fields are separated by '#';
+// an escaped `\#` is read as part of the field.
+func ParseCEX(r io.Reader) (*CEXData, error) {
+	cex := &CEXData{}
+	reader := bufio.NewReader(r)
+	block := ""
+	headerRead := false //whether the header line of the current block has been consumed
+	lineNumber := 0
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, readErr
+		}
+		if line == "" && readErr == io.EOF {
+			break
+		}
+		lineNumber++
+		line = strings.TrimRight(line, "\r\n")
+		if lineNumber == 1 {
+			line = strings.TrimPrefix(line, "\ufeff") //byte order mark
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "", strings.HasPrefix(trimmed, "//"):
+		case strings.HasPrefix(trimmed, "#!"):
+			block = strings.TrimPrefix(trimmed, "#!")
+			headerRead = false
+			if !contains(cexBlocks, block) {
+				return nil, &CEXError{Line: lineNumber, Msg: fmt.Sprintf("unknown block label %q", trimmed)}
+			}
+			if block == "citedata" {
+				cex.CiteData = append(cex.CiteData, CEXCiteData{})
+			}
+		case block == "":
+			return nil, &CEXError{Line: lineNumber, Msg: "data outside of a block"}
+		default:
+			err := cex.parseLine(block, line, lineNumber, &headerRead)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	return cex, nil
+}
+
+// parseLine parses a single data line of the given block into cex.
+func (cex *CEXData) parseLine(block, line string, lineNumber int, headerRead *bool) error {
+	raw := splitCEX(line)
+	fields := append([]string{}, raw...)
+	lineError := func(format string, a ...interface{}) error {
+		return &CEXError{Line: lineNumber, Block: block, Msg: fmt.Sprintf(format, a...)}
+	}
+	isHeader := !*headerRead && len(fields) > 0 && strings.EqualFold(strings.TrimSpace(fields[0]), cexHeaders[block])
+	*headerRead = true
+	if isHeader {
+		return nil
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	switch block {
+	case "cexversion":
+		if cex.Version != "" {
+			return lineError("more than one version given")
+		}
+		cex.Version = fields[0]
+	case "citelibrary":
+		if len(fields) < 2 {
+			return lineError("expected key#value, got %d field(s)", len(fields))
+		}
+		value := strings.Join(fields[1:], "#")
+		switch strings.ToLower(fields[0]) {
+		case "name":
+			cex.Library.Name = value
+		case "urn":
+			cex.Library.URN = value
+		case "license":
+			cex.Library.License = value
+		default:
+			return lineError("unknown library property %q", fields[0])
+		}
+	case "ctscatalog":
+		if len(fields) != 8 {
+			return lineError("expected 8 fields, got %d", len(fields))
+		}
+		cex.Catalog = append(cex.Catalog, BoltCatalog{URN: fields[0], Citation: fields[1], GroupName: fields[2],
+			WorkTitle: fields[3], VersionLabel: fields[4], ExemplarLabel: fields[5], Online: fields[6], Language: fields[7]})
+	case "ctsdata":
+		if len(fields) < 2 {
+			return lineError("expected urn#text, got %d field(s)", len(fields))
+		}
+		//the text keeps any '#' it contains; only its leading whitespace is trimmed
+		text := strings.TrimLeft(strings.Join(raw[1:], "#"), " \t")
+		cex.Passages = append(cex.Passages, CEXPassage{URN: fields[0], Text: text, Line: lineNumber})
+	case "citecollections":
+		if len(fields) != 5 {
+			return lineError("expected 5 fields, got %d", len(fields))
+		}
+		cex.Collections = append(cex.Collections, CEXCollection{URN: fields[0], Description: fields[1],
+			Labelling: fields[2], Ordering: fields[3], License: fields[4]})
+	case "citeproperties":
+		if len(fields) < 3 || len(fields) > 4 {
+			return lineError("expected 3 or 4 fields, got %d", len(fields))
+		}
+		property := CEXProperty{URN: fields[0], Label: fields[1], Type: fields[2]}
+		if len(fields) == 4 {
+			property.Authority = fields[3]
+		}
+		cex.Properties = append(cex.Properties, property)
+	case "citedata":
+		current := &cex.CiteData[len(cex.CiteData)-1]
+		if current.Header == nil {
+			current.Header = fields
+			return nil
+		}
+		if len(fields) != len(current.Header) {
+			return lineError("expected %d fields as given in the header, got %d", len(current.Header), len(fields))
+		}
+		current.Rows = append(current.Rows, fields)
+	case "datamodels":
+		if len(fields) != 4 {
+			return lineError("expected 4 fields, got %d", len(fields))
+		}
+		cex.DataModels = append(cex.DataModels, CEXDataModel{Collection: fields[0], Model: fields[1],
+			Label: fields[2], Description: fields[3]})
+	case "imagedata":
+		if len(fields) != 4 {
+			return lineError("expected 4 fields, got %d", len(fields))
+		}
+		cex.ImageData = append(cex.ImageData, CEXImageData{Collection: fields[0], Protocol: fields[1],
+			URL: fields[2], Rights: fields[3]})
+	case "relations":
+		if len(fields) != 3 {
+			return lineError("expected 3 fields, got %d", len(fields))
+		}
+		cex.Relations = append(cex.Relations, CEXRelation{Triple: gocite.Triple{Subject: fields[0],
+			Verb: fields[1], Object: fields[2]}, Line: lineNumber})
+	}
+	return nil
+}
+
+// cexHeaders holds the first field of the optional header line of each block type.
+// A header line is only recognised as the first data line of a block.
+var cexHeaders = map[string]string{
+	"ctscatalog":      "urn",
+	"citecollections": "urn",
+	"citeproperties":  "property",
+	"datamodels":      "collection",
+	"imagedata":       "collection",
+	"relations":       "subject",
+}
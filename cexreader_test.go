@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCEXErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  CEXError
+	}{
+		{"unknown label", "#!cexversion\n3.0\n\n#!ctsmeta\nx#y\n", CEXError{Line: 4, Msg: `unknown block label "#!ctsmeta"`}},
+		{"outside of a block", "// comment\nurn:cts:a:b.c.d:1#text\n", CEXError{Line: 2, Msg: "data outside of a block"}},
+		{"two versions", "#!cexversion\n3.0\n3.0\n", CEXError{Line: 3, Block: "cexversion", Msg: "more than one version given"}},
+		{"catalog fields", "#!ctscatalog\nurn#citationScheme#groupName#workTitle#versionLabel#exemplarLabel#online#lang\nurn:cts:a:b.c.d:#line\n",
+			CEXError{Line: 3, Block: "ctscatalog", Msg: "expected 8 fields, got 2"}},
+		{"passage without text", "\ufeff#!ctsdata\r\nurn:cts:a:b.c.d:1#one\r\nurn:cts:a:b.c.d:2\r\n",
+			CEXError{Line: 3, Block: "ctsdata", Msg: "expected urn#text, got 1 field(s)"}},
+		{"citedata header", "#!citedata\nurn#label#rights\nurn:cite2:a:b.v1:1#one\n",
+			CEXError{Line: 3, Block: "citedata", Msg: "expected 3 fields as given in the header, got 2"}},
+		{"escaped separator", "#!relations\nurn:cts:a:b.c.d:1#verb#urn:cite2:a:b.v1:1\\#2#x\n",
+			CEXError{Line: 2, Block: "relations", Msg: "expected 3 fields, got 4"}},
+	}
+	for _, test := range tests {
+		_, err := ParseCEX(strings.NewReader(test.input))
+		var cexErr *CEXError
+		if !errors.As(err, &cexErr) {
+			t.Errorf("%s: ParseCEX error = %v, want a *CEXError", test.name, err)
+			continue
+		}
+		if *cexErr != test.want {
+			t.Errorf("%s: ParseCEX error = %+v, want %+v", test.name, *cexErr, test.want)
+		}
+	}
+}
+
+func TestParseCEX(t *testing.T) {
+	input := "#!cexversion\n3.0\n\n" +
+		"#!citelibrary\nname#Test \\# library\nurn#urn:cite2:test:lib.v1:\n\n" +
+		"#!ctsdata\n" +
+		"// a comment\n" +
+		"urn:cts:a:b.c.d:1#  text with \\# and # in it\n" +
+		"urn:cts:a:b.c.d:2#second-NEWLINE-line\n\n" +
+		"#!relations\nsubject#verb#object\nurn:cts:a:b.c.d:1#urn:cite2:cite:verbs.v1:hasImage#urn:cite2:a:img.v1:x\\#y\n"
+	cex, err := ParseCEX(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseCEX: %s", err)
+	}
+	if cex.Version != "3.0" || cex.Library.Name != "Test # library" || cex.Library.URN != "urn:cite2:test:lib.v1:" {
+		t.Errorf("ParseCEX version and library = %q, %+v", cex.Version, cex.Library)
+	}
+	passages := []CEXPassage{
+		{URN: "urn:cts:a:b.c.d:1", Text: "text with # and # in it", Line: 10},
+		{URN: "urn:cts:a:b.c.d:2", Text: "second-NEWLINE-line", Line: 11},
+	}
+	if !reflect.DeepEqual(cex.Passages, passages) {
+		t.Errorf("ParseCEX passages = %+v, want %+v", cex.Passages, passages)
+	}
+	if len(cex.Relations) != 1 || cex.Relations[0].Object != "urn:cite2:a:img.v1:x#y" || cex.Relations[0].Line != 15 {
+		t.Errorf("ParseCEX relations = %+v, want one relation to urn:cite2:a:img.v1:x#y in line 15", cex.Relations)
+	}
+}
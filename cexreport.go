@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+)
+
+// CEXReport summarises what importing a CEX file would do to a user database.
+// It is returned by the CEX upload endpoint, in dry-run mode without touching the database.
+type CEXReport struct {
+	Works             []CEXWorkReport `json:"works"`
+	MissingCatalog    []string        `json:"missingCatalog"`
+	DuplicatePassages []CEXIssue      `json:"duplicatePassages"`
+	InvalidURNs       []CEXIssue      `json:"invalidURNs"`
+	DanglingRelations []CEXIssue      `json:"danglingRelations"`
+	Conflicts         []CEXConflict   `json:"conflicts"` //passages whose text differs from the stored version
+}
+
+// CEXWorkReport describes a single work found in a CEX file.
+type CEXWorkReport struct {
+	URN        string `json:"urn"`
+	Passages   int    `json:"passages"`
+	HasCatalog bool   `json:"hasCatalog"`
+	Exists     bool   `json:"exists"` //whether the work is already present in the user database
+}
+
+// CEXIssue points at a problematic line of a CEX file.
+type CEXIssue struct {
+	Line    int    `json:"line"`
+	URN     string `json:"urn"`
+	Message string `json:"message"`
+}
+
+// Valid reports whether the CEX data can be imported without errors.
+func (r CEXReport) Valid() bool {
+	return len(r.DuplicatePassages) == 0 && len(r.InvalidURNs) == 0
+}
+
+// reportCEX checks parsed CEX data against itself and against the user database dbName
+// and returns a CEXReport. The database is only read: it is neither created if it does not
+// exist nor migrated if it has an older schema.
+func reportCEX(cex *CEXData, dbName string) (CEXReport, error) {
+	report := CEXReport{
+		Works:             []CEXWorkReport{},
+		MissingCatalog:    []string{},
+		DuplicatePassages: []CEXIssue{},
+		InvalidURNs:       []CEXIssue{},
+		DanglingRelations: []CEXIssue{},
+		Conflicts:         []CEXConflict{},
+	}
+
+	seen := make(map[string]int) //passage URN -> line of first appearance
+	workIndex := make(map[string]int)
+	for _, p := range cex.Passages {
+		if !gocite.IsCTSURN(p.URN) {
+			report.InvalidURNs = append(report.InvalidURNs, CEXIssue{Line: p.Line, URN: p.URN,
+				Message: "invalid CTS URN"})
+			continue
+		}
+		if line, ok := seen[p.URN]; ok {
+			report.DuplicatePassages = append(report.DuplicatePassages, CEXIssue{Line: p.Line, URN: p.URN,
+				Message: fmt.Sprintf("passage already given in line %d", line)})
+			continue
+		}
+		seen[p.URN] = p.Line
+		work := strings.Join(strings.Split(p.URN, ":")[0:4], ":") + ":"
+		i, ok := workIndex[work]
+		if !ok {
+			i = len(report.Works)
+			workIndex[work] = i
+			report.Works = append(report.Works, CEXWorkReport{URN: work})
+		}
+		report.Works[i].Passages++
+	}
+	for i := range report.Works {
+		for _, entry := range cex.Catalog {
+			if entry.URN == report.Works[i].URN {
+				report.Works[i].HasCatalog = true
+			}
+		}
+		if !report.Works[i].HasCatalog {
+			report.MissingCatalog = append(report.MissingCatalog, report.Works[i].URN)
+		}
+	}
+
+	existing := func(bucket, key string) bool { return false }
+	stored := func(bucket, key string) (gocite.Passage, bool) { return gocite.Passage{}, false }
+	if _, err := os.Stat(dbName); err == nil {
+		//the report must not change the database, so it is not migrated but only looked at as if it were
+		db, err := userDBs.OpenUnmigrated(dbName)
+		if err != nil {
+			return report, err
+		}
+		defer db.Close()
+		tx, err := migratedView(db.DB)
+		if err != nil {
+			return report, err
+		}
+		defer tx.Rollback()
+		existing = func(bucket, key string) bool {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return false
+			}
+			return key == "" || b.Get([]byte(key)) != nil
+		}
+		stored = func(bucket, key string) (gocite.Passage, bool) {
+			passage := gocite.Passage{}
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return passage, false
+			}
+			value := b.Get([]byte(key))
+			if value == nil || json.Unmarshal(value, &passage) != nil {
+				return passage, false
+			}
+			return passage, true
+		}
+	}
+
+	for i := range report.Works {
+		report.Works[i].Exists = existing(report.Works[i].URN, "")
+	}
+	for _, p := range cex.Passages {
+		if line, ok := seen[p.URN]; !ok || line != p.Line {
+			continue
+		}
+		passage, ok := stored(strings.Join(strings.Split(p.URN, ":")[0:4], ":")+":", p.URN)
+		incoming := strings.Replace(p.Text, "-NEWLINE-", "\r\n", -1)
+		if ok && passage.Text.TXT != incoming {
+			report.Conflicts = append(report.Conflicts, CEXConflict{Line: p.Line, URN: p.URN,
+				Existing: passage.Text.TXT, Incoming: incoming})
+		}
+	}
+	for _, relation := range cex.Relations {
+		for _, urn := range []string{relation.Subject, relation.Object} {
+			if !gocite.IsCTSURN(urn) {
+				continue
+			}
+			if _, ok := seen[urn]; ok {
+				continue
+			}
+			if existing(strings.Join(strings.Split(urn, ":")[0:4], ":")+":", urn) {
+				continue
+			}
+			report.DanglingRelations = append(report.DanglingRelations, CEXIssue{Line: relation.Line, URN: urn,
+				Message: "relation points at a passage that is neither in the file nor in the database"})
+		}
+	}
+	return report, nil
+}
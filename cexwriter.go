@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// CEXExportOptions selects what is exported from a user database.
+type CEXExportOptions struct {
+	Library     CEXLibrary //written to the #!citelibrary block
+	Works       []string   //work URNs to export, all works if empty
+	Collections []string   //image collections to export, all collections if empty
+	Layers      []string   //text layers to export as parallel versions, cexLayerTXT if empty
+}
+
+// Text layers of a passage that can be exported
+const (
+	cexLayerTXT        = "txt"
+	cexLayerNormalised = "normalised"
+	cexLayerDiplomatic = "diplomatic"
+	cexLayerMarkDown   = "markdown"
+	cexLayerXML        = "xml"
+)
+
+// cexLayers lists the text layers in the order of gocite.EncText
+var cexLayers = []string{cexLayerTXT, cexLayerMarkDown, cexLayerXML, cexLayerDiplomatic, cexLayerNormalised}
+
+// textLayer returns the given layer of text. Unlike the pages, it does not fall back
+// to the TXT layer if the requested layer is empty, so that unnormalised text is not
+// exported as normalised.
+func textLayer(text gocite.EncText, layer string) string {
+	switch layer {
+	case cexLayerNormalised:
+		return text.Normalised
+	case cexLayerDiplomatic:
+		return text.Diplomatic
+	case cexLayerMarkDown:
+		return text.MarkDown
+	case cexLayerXML:
+		return text.XML
+	}
+	return text.TXT
+}
+
+// layerURN returns the URN under which the given text layer of a work or passage is exported.
+// The TXT layer keeps its URN. Other layers of a version get an exemplar named after the layer,
+// and the name of the layer is appended to an exemplar (e.g. urn:cts:ns:tg.w.v.normalised:1
+// and urn:cts:ns:tg.w.v.ex_normalised:1).
+func layerURN(urn, layer string) string {
+	if layer == cexLayerTXT {
+		return urn
+	}
+	parts := strings.Split(urn, ":")
+	if len(parts) < 4 {
+		return urn
+	}
+	segments := strings.Split(parts[3], ".")
+	switch len(segments) {
+	case 3:
+		segments = append(segments, layer)
+	case 4:
+		segments[3] += "_" + layer
+	default:
+		return urn
+	}
+	parts[3] = strings.Join(segments, ".")
+	return strings.Join(parts, ":")
+}
+
+// cexImageHeader names the properties of the images of a collection in #!citedata blocks
+var cexImageHeader = []string{"urn", "name", "protocol", "license", "external", "location"}
+
+// cexVerbAppearsOn is the verb of the relations linking passages to images
+const cexVerbAppearsOn = "urn:cite2:dse:verbs.v1:appearsOn:"
+
+// readCEX collects the works and image collections selected by opts from db.
+// Works and collections are sorted by URN, passages by their reading order.
+// Every text layer in opts is added as a version of its own, without the passages
+// that have no text in that layer.
+func readCEX(db *UserDB, opts CEXExportOptions) (*CEXData, error) {
+	cex := &CEXData{Version: "3.0", Library: opts.Library}
+	layers := opts.Layers
+	if len(layers) == 0 {
+		layers = []string{cexLayerTXT}
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		var works []string
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			work := string(name)
+			if gocite.IsCTSURN(work) && (len(opts.Works) == 0 || contains(opts.Works, work)) {
+				works = append(works, work)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(works)
+		for _, work := range works {
+			bucket := tx.Bucket([]byte(work))
+			catalog, err := getCatalog(tx, work)
+			if err != nil {
+				return fmt.Errorf("reading the catalog entry of %s failed: %s", work, err)
+			}
+			if catalog.URN == "" {
+				catalog.URN = work
+			}
+			passages := bucketPassages(bucket)
+			for _, layer := range layers {
+				var layered []gocite.Passage
+				for _, passage := range passages {
+					if layer == cexLayerTXT || textLayer(passage.Text, layer) != "" {
+						layered = append(layered, passage)
+					}
+				}
+				if len(layered) == 0 && layer != cexLayerTXT {
+					continue //the work has no text in this layer
+				}
+				entry := catalog
+				entry.URN = layerURN(work, layer)
+				if layer != cexLayerTXT {
+					entry.ExemplarLabel = strings.TrimSpace(entry.ExemplarLabel + " " + layer)
+				}
+				cex.Catalog = append(cex.Catalog, entry)
+				for _, passage := range layered {
+					urn := layerURN(passage.PassageID, layer)
+					cex.Passages = append(cex.Passages, CEXPassage{URN: urn,
+						Text: strings.NewReplacer("\r\n", "-NEWLINE-", "\n", "-NEWLINE-").Replace(textLayer(passage.Text, layer))})
+					var images []string
+					for _, link := range passage.ImageLinks {
+						images = append(images, link.Object)
+					}
+					sort.Strings(images)
+					for _, image := range images {
+						cex.Relations = append(cex.Relations, CEXRelation{Triple: gocite.Triple{Subject: urn,
+							Verb: cexVerbAppearsOn, Object: image}})
+					}
+				}
+			}
+		}
+
+		bucket := tx.Bucket([]byte("imgCollection"))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			name := string(key)
+			if len(opts.Collections) > 0 && !contains(opts.Collections, name) {
+				continue
+			}
+			collection, err := decodeImgCol(value)
+			if err != nil {
+				return fmt.Errorf("decoding image collection %s failed: %s", name, err)
+			}
+			cex.addImageCollection(name, collection)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cex, nil
+}
+
+// addImageCollection adds an image collection stored under name to cex as a
+// #!citecollections entry, its #!citeproperties, and one #!citedata block.
+func (cex *CEXData) addImageCollection(name string, collection imageCollection) {
+	label := collection.Name
+	if label == "" {
+		label = name
+	}
+	property := func(p string) string { return strings.TrimSuffix(name, ":") + "." + p + ":" }
+	cex.Collections = append(cex.Collections, CEXCollection{URN: name, Description: label,
+		Labelling: property("name"), Ordering: "", License: ""})
+	types := []string{"Cite2Urn", "String", "String", "String", "Boolean", "String"}
+	for i, p := range cexImageHeader {
+		cex.Properties = append(cex.Properties, CEXProperty{URN: property(p), Label: p, Type: types[i]})
+	}
+	images := append([]image{}, collection.Collection...)
+	sort.SliceStable(images, func(i, j int) bool { return images[i].URN < images[j].URN })
+	data := CEXCiteData{Header: cexImageHeader}
+	for _, img := range images {
+		data.Rows = append(data.Rows, []string{img.URN, img.Name, img.Protocol, img.License,
+			strconv.FormatBool(img.External), img.Location})
+	}
+	cex.CiteData = append(cex.CiteData, data)
+}
+
+// cexImageCollections returns the image collections contained in the #!citedata blocks
+// of cex, keyed by the collection name they are stored under in the user database.
+// Blocks with other headers than cexImageHeader are ignored. Like WriteCEX writes them, there
+// is a block per #!citecollections entry in the same order, so that a collection may hold
+// images of other collections or namespaces. If the numbers differ, an image belongs to the
+// #!citecollections entry its URN starts with, or to the collection named in its URN.
+func cexImageCollections(cex *CEXData) map[string]imageCollection {
+	var blocks []CEXCiteData
+	var columns []map[string]int
+	for _, data := range cex.CiteData {
+		column := make(map[string]int)
+		for i, field := range data.Header {
+			column[strings.ToLower(field)] = i
+		}
+		if len(column) != len(cexImageHeader) {
+			continue
+		}
+		isImageData := true
+		for _, p := range cexImageHeader {
+			if _, ok := column[p]; !ok {
+				isImageData = false
+			}
+		}
+		if isImageData {
+			blocks = append(blocks, data)
+			columns = append(columns, column)
+		}
+	}
+
+	collections := make(map[string]imageCollection)
+	for b, data := range blocks {
+		column := columns[b]
+		for _, row := range data.Rows {
+			urn := row[column["urn"]]
+			name := urn[:strings.LastIndex(urn, ":")+1]
+			if len(blocks) == len(cex.Collections) {
+				name = cex.Collections[b].URN
+			} else {
+				for _, c := range cex.Collections {
+					if strings.HasPrefix(urn, c.URN) {
+						name = c.URN
+					}
+				}
+			}
+			collection := collections[name]
+			collection.URN = name
+			for _, c := range cex.Collections {
+				if c.URN == name {
+					collection.Name = c.Description
+				}
+			}
+			external, _ := strconv.ParseBool(row[column["external"]])
+			collection.Collection = append(collection.Collection, image{URN: urn, Name: row[column["name"]],
+				Protocol: row[column["protocol"]], License: row[column["license"]],
+				External: external, Location: row[column["location"]]})
+			collections[name] = collection
+		}
+	}
+	return collections
+}
+
+// WriteCEX writes cex to w as CEX 3.0. '#' within fields is escaped as `\#`.
+// Empty blocks are left out, except #!cexversion and #!citelibrary.
+func WriteCEX(w io.Writer, cex *CEXData) error {
+	bw := bufio.NewWriter(w)
+	var err error
+	line := func(fields ...string) {
+		if err != nil {
+			return
+		}
+		for i := range fields {
+			fields[i] = escapeCEX(fields[i])
+		}
+		_, err = bw.WriteString(strings.Join(fields, "#") + "\n")
+	}
+	block := func(label string) {
+		if err == nil {
+			_, err = bw.WriteString("\n#!" + label + "\n")
+		}
+	}
+
+	version := cex.Version
+	if version == "" {
+		version = "3.0"
+	}
+	_, err = bw.WriteString("#!cexversion\n")
+	line(version)
+
+	block("citelibrary")
+	line("name", cex.Library.Name)
+	line("urn", cex.Library.URN)
+	line("license", cex.Library.License)
+
+	if len(cex.Catalog) > 0 {
+		block("ctscatalog")
+		line("urn", "citationScheme", "groupName", "workTitle", "versionLabel", "exemplarLabel", "online", "lang")
+		for _, c := range cex.Catalog {
+			line(c.URN, c.Citation, c.GroupName, c.WorkTitle, c.VersionLabel, c.ExemplarLabel, c.Online, c.Language)
+		}
+	}
+	if len(cex.Passages) > 0 {
+		block("ctsdata")
+		for _, p := range cex.Passages {
+			line(p.URN, p.Text)
+		}
+	}
+	if len(cex.Collections) > 0 {
+		block("citecollections")
+		line("URN", "Description", "Labelling property", "Ordering property", "License")
+		for _, c := range cex.Collections {
+			line(c.URN, c.Description, c.Labelling, c.Ordering, c.License)
+		}
+	}
+	if len(cex.Properties) > 0 {
+		block("citeproperties")
+		line("Property", "Label", "Type", "Authority list")
+		for _, p := range cex.Properties {
+			line(p.URN, p.Label, p.Type, p.Authority)
+		}
+	}
+	for _, data := range cex.CiteData {
+		block("citedata")
+		line(append([]string{}, data.Header...)...)
+		for _, row := range data.Rows {
+			line(append([]string{}, row...)...)
+		}
+	}
+	if len(cex.DataModels) > 0 {
+		block("datamodels")
+		line("Collection", "Model", "Label", "Description")
+		for _, m := range cex.DataModels {
+			line(m.Collection, m.Model, m.Label, m.Description)
+		}
+	}
+	if len(cex.ImageData) > 0 {
+		block("imagedata")
+		line("collection", "protocol", "url", "rights")
+		for _, d := range cex.ImageData {
+			line(d.Collection, d.Protocol, d.URL, d.Rights)
+		}
+	}
+	if len(cex.Relations) > 0 {
+		block("relations")
+		line("subject", "verb", "object")
+		for _, r := range cex.Relations {
+			line(r.Subject, r.Verb, r.Object)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// escapeCEX escapes the CEX delimiter '#' within a field.
+func escapeCEX(field string) string {
+	return strings.Replace(field, "#", `\#`, -1)
+}
+
+// splitCEX splits a CEX line at every '#' that is not escaped as `\#`
+// and unescapes the fields.
+func splitCEX(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '#':
+			field.WriteByte('#')
+			i++
+		case line[i] == '#':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/ThomasK81/gocite"
@@ -56,6 +55,7 @@ func newCollection(res http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				log.Println(fmt.Errorf("newCollection: Error saving Image collection %s in %s.db: %s", name, user, err))
 				io.WriteString(res, "Import of image collection "+name+" failed: extracting links failed.")
+				return
 			}
 			for i := range links {
 				collection.Collection = append(collection.Collection, image{URN: links[i],
@@ -82,6 +82,7 @@ func newCollection(res http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		log.Println(fmt.Errorf("newCollectionToDB: Error saving Image collection %s in %s.db: %s", name, user, err))
 		io.WriteString(res, "Import of image collection "+name+" failed")
+		return
 	}
 	log.Println("newCollection: Image collection " + name + "saved in " + user + ".db successfully.")
 	io.WriteString(res, "Image collection "+name+" imported successfully.")
@@ -89,15 +90,14 @@ func newCollection(res http.ResponseWriter, req *http.Request) {
 
 //newCollectiontoDB saves a new collection in a user database. Called by endpoint newCollection.
 func newCollectionToDB(dbName, collectionName string, collection imageCollection) error {
-	pwd, _ := os.Getwd()
-	dbname := pwd + "/" + dbName + ".db"
+	dbname := userDBPath(dbName)
 	dbkey := []byte(collectionName)
-	dbvalue, err := gobEncode(&collection)
+	dbvalue, err := json.Marshal(collection)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("newCollectionToDB: error opening userDB: %s", err))
 		return err
@@ -111,7 +111,7 @@ func newCollectionToDB(dbName, collectionName string, collection imageCollection
 		}
 		val := bucket.Get(dbkey)
 		if val != nil {
-			return errors.New("collection already exists")
+			return fmt.Errorf("%s: %w", collectionName, errCollectionExists)
 		}
 		err = bucket.Put(dbkey, dbvalue)
 		if err != nil {
@@ -128,19 +128,19 @@ func newCollectionToDB(dbName, collectionName string, collection imageCollection
 //AlignmentsToDB saves alignments in a user database. Called by endpoint multipage.
 func AlignmentsToDB(dbName string, alignments Alignments) error {
 	dbkey := []byte(alignments.AlignmentID)
-	dbvalue, err := gobEncode(&alignments)
+	dbvalue, err := json.Marshal(alignments)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-	db, err := openBoltDB(dbName) //open bolt DB using helper function
+	db, err := userDBs.Open(dbName) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("AlignmentToDB: error opening userDB: %s", err))
 		return err
 	}
 	defer db.Close()
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("alignmentsCollection"))
+		bucket, err := tx.CreateBucketIfNotExists([]byte(alignmentsBucket))
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -186,8 +186,8 @@ func deleteCollection(res http.ResponseWriter, req *http.Request) {
 	log.Println(newkey)
 	newkey = strings.Replace(newkey, "\"", "", -1)
 	log.Println(newkey)
-	dbname := user + ".db"
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	dbname := userDBPath(user)
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("deleteCollection: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// imgCollectionBucket holds the image collections (imageCollection) by collection URN
+const imgCollectionBucket = "imgCollection"
+
+// imageProtocols are the protocols images can be served with
+var imageProtocols = []string{"iiif", "static", "localDZ"}
+
+// Errors of the image collection operations
+var (
+	errCollectionNotFound = errors.New("image collection not found")
+	errCollectionExists   = errors.New("image collection exists already")
+	errImageNotFound      = errors.New("image not found")
+	errImageExists        = errors.New("image exists already")
+	errBadImage           = errors.New("bad image")
+)
+
+// CollectionSummary is an image collection as listed by /api/v1/collections.
+type CollectionSummary struct {
+	URN    string `json:"urn"`
+	Name   string `json:"name"`
+	Images int    `json:"images"` //the number of images
+}
+
+// checkCollectionURN returns an error wrapping errBadImage unless urn is the CITE2 URN
+// of a collection, i.e. one with an empty object part (urn:cite2:nyaya:Awimg.positive:).
+func checkCollectionURN(urn string) error {
+	if cite := gocite.SplitCITE(urn); cite.InValid || cite.Object != "" {
+		return fmt.Errorf("%q is no CITE2 collection URN: %w", urn, errBadImage)
+	}
+	return nil
+}
+
+// checkImage returns an error wrapping errBadImage unless img has the CITE2 URN of
+// an object, a known protocol, and a location.
+func checkImage(img image) error {
+	if cite := gocite.SplitCITE(img.URN); cite.InValid || cite.Object == "" {
+		return fmt.Errorf("%q is no CITE2 object URN: %w", img.URN, errBadImage)
+	}
+	if !contains(imageProtocols, img.Protocol) {
+		return fmt.Errorf("unknown protocol %q of %s, expected one of %v: %w", img.Protocol, img.URN, imageProtocols, errBadImage)
+	}
+	if img.Location == "" {
+		return fmt.Errorf("%s has no location: %w", img.URN, errBadImage)
+	}
+	return nil
+}
+
+// checkCollection checks the images of collection and returns an error wrapping errBadImage
+// if one of them is invalid or an image URN occurs twice.
+func checkCollection(collection imageCollection) error {
+	seen := make(map[string]bool)
+	for _, img := range collection.Collection {
+		err := checkImage(img)
+		if err != nil {
+			return err
+		}
+		if seen[img.URN] {
+			return fmt.Errorf("%s occurs twice: %w", img.URN, errBadImage)
+		}
+		seen[img.URN] = true
+	}
+	return nil
+}
+
+// getCollection returns the image collection stored under urn within tx.
+func getCollection(tx *bolt.Tx, urn string) (imageCollection, error) {
+	bucket := tx.Bucket([]byte(imgCollectionBucket))
+	if bucket == nil || bucket.Get([]byte(urn)) == nil {
+		return imageCollection{}, fmt.Errorf("%s: %w", urn, errCollectionNotFound)
+	}
+	collection, err := decodeImgCol(bucket.Get([]byte(urn)))
+	if collection.URN == "" {
+		collection.URN = urn
+	}
+	if collection.Collection == nil {
+		collection.Collection = []image{}
+	}
+	return collection, err
+}
+
+// putCollection saves collection under its URN within tx.
+func putCollection(tx *bolt.Tx, collection imageCollection) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(imgCollectionBucket))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(collection.URN), value)
+}
+
+// listCollections returns the image collections of a user database in the order of their URNs.
+func listCollections(db *UserDB) ([]CollectionSummary, error) {
+	result := []CollectionSummary{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(imgCollectionBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, _ []byte) error {
+			collection, err := getCollection(tx, string(key))
+			if err != nil {
+				return fmt.Errorf("decoding image collection %s failed: %s", key, err)
+			}
+			result = append(result, CollectionSummary{URN: string(key), Name: collection.Name, Images: len(collection.Collection)})
+			return nil
+		})
+	})
+	return result, err
+}
+
+// editCollection applies edit to the image collection urn and saves the result.
+func editCollection(db *UserDB, urn string, edit func(collection *imageCollection) error) (imageCollection, error) {
+	var collection imageCollection
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		collection, err = getCollection(tx, urn)
+		if err != nil {
+			return err
+		}
+		err = edit(&collection)
+		if err != nil {
+			return err
+		}
+		return putCollection(tx, collection)
+	})
+	return collection, err
+}
+
+// imageIndex returns the index of the image urn in collection, or -1.
+func imageIndex(collection imageCollection, urn string) int {
+	for i, img := range collection.Collection {
+		if img.URN == urn {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleCollections lists the image collections of the user (GET) or creates a new one (POST)
+// from an imageCollection in the request body, which may already contain images.
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	if r.Method == http.MethodGet {
+		collections, err := listCollections(db)
+		if err != nil {
+			respondWithCollectionError(w, err)
+			return
+		}
+		respondWithData(w, collections, 200)
+		return
+	}
+
+	var collection imageCollection
+	err = json.NewDecoder(r.Body).Decode(&collection)
+	if err != nil {
+		respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+		return
+	}
+	if collection.Collection == nil {
+		collection.Collection = []image{}
+	}
+	err = checkCollectionURN(collection.URN)
+	if err == nil {
+		err = checkCollection(collection)
+	}
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			if _, err := getCollection(tx, collection.URN); err == nil {
+				return fmt.Errorf("%s: %w", collection.URN, errCollectionExists)
+			}
+			return putCollection(tx, collection)
+		})
+	}
+	if err != nil {
+		respondWithCollectionError(w, err)
+		return
+	}
+	respondWithData(w, collection, 201)
+}
+
+// handleCollection returns (GET), replaces (PUT), or deletes (DELETE) the image collection {urn}.
+// PUT takes an imageCollection; its name and images replace those of the stored collection.
+func handleCollection(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	urn := mux.Vars(r)["urn"]
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	var collection imageCollection
+	switch r.Method {
+	case http.MethodGet:
+		err = db.View(func(tx *bolt.Tx) error {
+			collection, err = getCollection(tx, urn)
+			return err
+		})
+	case http.MethodPut:
+		var input imageCollection
+		err = json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+			return
+		}
+		if input.URN != "" && input.URN != urn {
+			respondWithJSON(w, "error", "bad_request", "the URN of a collection cannot be changed", 400)
+			return
+		}
+		collection, err = editCollection(db, urn, func(collection *imageCollection) error {
+			collection.Name = input.Name
+			collection.Collection = input.Collection
+			if collection.Collection == nil {
+				collection.Collection = []image{}
+			}
+			return checkCollection(*collection)
+		})
+	case http.MethodDelete:
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := getCollection(tx, urn)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket([]byte(imgCollectionBucket)).Delete([]byte(urn))
+		})
+		if err == nil {
+			respondWithJSON(w, "success", "collection_deleted", nil, 200)
+			return
+		}
+	}
+	if err != nil {
+		respondWithCollectionError(w, err)
+		return
+	}
+	respondWithData(w, collection, 200)
+}
+
+// handleCollectionImages adds an image to the image collection {urn} (POST), or returns (GET),
+// replaces (PUT), or removes (DELETE) its image {image}. The image records of POST and PUT
+// are taken from the request body; PUT cannot change the URN of an image.
+func handleCollectionImages(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	vars := mux.Vars(r)
+	urn, imageURN := vars["urn"], vars["image"]
+
+	var input image
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		err = json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+			return
+		}
+		if r.Method == http.MethodPut {
+			if input.URN != "" && input.URN != imageURN {
+				respondWithJSON(w, "error", "bad_request", "the URN of an image cannot be changed", 400)
+				return
+			}
+			input.URN = imageURN
+		}
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	var result image
+	code := 200
+	switch r.Method {
+	case http.MethodGet:
+		err = db.View(func(tx *bolt.Tx) error {
+			collection, err := getCollection(tx, urn)
+			if err != nil {
+				return err
+			}
+			index := imageIndex(collection, imageURN)
+			if index < 0 {
+				return fmt.Errorf("%s: %w", imageURN, errImageNotFound)
+			}
+			result = collection.Collection[index]
+			return nil
+		})
+	case http.MethodPost:
+		code, result = 201, input
+		_, err = editCollection(db, urn, func(collection *imageCollection) error {
+			err := checkImage(input)
+			if err != nil {
+				return err
+			}
+			if imageIndex(*collection, input.URN) >= 0 {
+				return fmt.Errorf("%s: %w", input.URN, errImageExists)
+			}
+			collection.Collection = append(collection.Collection, input)
+			return nil
+		})
+	case http.MethodPut:
+		result = input
+		_, err = editCollection(db, urn, func(collection *imageCollection) error {
+			err := checkImage(input)
+			if err != nil {
+				return err
+			}
+			index := imageIndex(*collection, imageURN)
+			if index < 0 {
+				return fmt.Errorf("%s: %w", imageURN, errImageNotFound)
+			}
+			collection.Collection[index] = input
+			return nil
+		})
+	case http.MethodDelete:
+		_, err = editCollection(db, urn, func(collection *imageCollection) error {
+			index := imageIndex(*collection, imageURN)
+			if index < 0 {
+				return fmt.Errorf("%s: %w", imageURN, errImageNotFound)
+			}
+			collection.Collection = append(collection.Collection[:index], collection.Collection[index+1:]...)
+			return nil
+		})
+		if err == nil {
+			respondWithJSON(w, "success", "image_deleted", nil, 200)
+			return
+		}
+	}
+	if err != nil {
+		respondWithCollectionError(w, err)
+		return
+	}
+	respondWithData(w, result, code)
+}
+
+// respondWithCollectionError answers with the status code matching an error of an image collection operation.
+func respondWithCollectionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errCollectionNotFound):
+		respondWithError(w, "collection_not_found", 404)
+	case errors.Is(err, errImageNotFound):
+		respondWithError(w, "image_not_found", 404)
+	case errors.Is(err, errCollectionExists):
+		respondWithError(w, "collection_exists", 409)
+	case errors.Is(err, errImageExists):
+		respondWithError(w, "image_exists", 409)
+	case errors.Is(err, errBadImage):
+		respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+	default:
+		log.Printf("image collection operation: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	}
+}
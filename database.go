@@ -4,12 +4,10 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/ThomasK81/gocite"
@@ -19,18 +17,7 @@ import (
 	"github.com/gorilla/mux"
 )
 
-//gobEncode encodes an interface to a byte slice, to be saved in the database
-func gobEncode(p interface{}) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(p)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-//gobDecodeImgCol decodes a byte slice from the database to an imageCollection
+//gobDecodeImgCol decodes a gob-encoded imageCollection, as stored before schema version 2
 func gobDecodeImgCol(data []byte) (imageCollection, error) {
 	var p *imageCollection
 	buf := bytes.NewBuffer(data)
@@ -42,7 +29,7 @@ func gobDecodeImgCol(data []byte) (imageCollection, error) {
 	return *p, nil
 }
 
-//gobDecodeAlignments decodes a byte slice from the database to an imageCollection
+//gobDecodeAlignments decodes gob-encoded Alignments, as stored before schema version 2
 func gobDecodeAlignments(data []byte) (Alignments, error) {
 	var p *Alignments
 	buf := bytes.NewBuffer(data)
@@ -54,6 +41,20 @@ func gobDecodeAlignments(data []byte) (Alignments, error) {
 	return *p, nil
 }
 
+//decodeImgCol decodes a JSON value from the database to an imageCollection
+func decodeImgCol(data []byte) (imageCollection, error) {
+	var collection imageCollection
+	err := json.Unmarshal(data, &collection)
+	return collection, err
+}
+
+//decodeAlignments decodes a JSON value from the database to Alignments
+func decodeAlignments(data []byte) (Alignments, error) {
+	var alignments Alignments
+	err := json.Unmarshal(data, &alignments)
+	return alignments, err
+}
+
 //gobDecodePassage decodes a byte slice from the database to a gocite.Passage
 func gobDecodePassage(data []byte) (gocite.Passage, error) {
 	var p *gocite.Passage
@@ -82,18 +83,13 @@ func Buckets(dbname string) []string {
 		log.Println(err)
 		return result
 	}
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openDB(dbname)
 	if err != nil {
 		log.Println(fmt.Printf("Buckets: error opening userDB: %s", err))
 		return result
 	}
 	defer db.Close()
-	err = db.View(func(tx *bolt.Tx) error {
-		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
-			result = append(result, string(name))
-			return nil
-		})
-	})
+	result, err = db.Buckets()
 	if err != nil {
 		log.Println(err)
 		return result
@@ -104,16 +100,15 @@ func Buckets(dbname string) []string {
 // newCITECollectionToDB saves a new CITE collection with a specified name in the user database.
 //Called by newCITECollection
 func newCITECollectionToDB(dbName, collectionName string) error {
-	pwd, _ := os.Getwd()
-	dbname := pwd + "/" + dbName + ".db"
+	dbname := userDBPath(dbName)
 	dbkey := []byte(collectionName)
 	collection := imageCollection{}
-	dbvalue, err := gobEncode(&collection)
+	dbvalue, err := json.Marshal(collection)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("Error opening userDB: %s", err))
 		return err
@@ -127,8 +122,7 @@ func newCITECollectionToDB(dbName, collectionName string) error {
 		}
 		val := bucket.Get(dbkey)
 		if val != nil {
-			fmt.Println("collection exists already")
-			return errors.New("collection exists already")
+			return fmt.Errorf("%s: %w", collectionName, errCollectionExists)
 		}
 		err = bucket.Put(dbkey, dbvalue)
 		if err != nil {
@@ -146,10 +140,9 @@ func newCITECollectionToDB(dbName, collectionName string) error {
 //in the bucket imgCollection in a user database. Called by addCITE
 func addImageToCITECollection(dbName, collectionName string, newImage image) error {
 	collection := imageCollection{}
-	pwd, _ := os.Getwd()
-	dbname := pwd + "/" + dbName + ".db"
+	dbname := userDBPath(dbName)
 	dbkey := []byte(collectionName)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("addImageToCITECollection: error opening userDB: %s", err))
 		return err
@@ -165,7 +158,7 @@ func addImageToCITECollection(dbName, collectionName string, newImage image) err
 		// fmt.Println("got", string(dbkey))
 
 		if val != nil {
-			collection, _ = gobDecodeImgCol(val)
+			collection, _ = decodeImgCol(val)
 		}
 		found := false
 		for coli, colv := range collection.Collection {
@@ -178,10 +171,10 @@ func addImageToCITECollection(dbName, collectionName string, newImage image) err
 			collection.Collection = append(collection.Collection, newImage)
 			//found = false //ineffectual assignment to found: found is false already
 		}
-		dbvalue, err2 := gobEncode(&collection)
+		dbvalue, err2 := json.Marshal(collection)
 		if err2 != nil {
-			fmt.Println(err)
-			return err
+			fmt.Println(err2)
+			return err2
 		}
 		err = bucket.Put(dbkey, dbvalue)
 		if err != nil {
@@ -195,74 +188,35 @@ func addImageToCITECollection(dbName, collectionName string, newImage image) err
 	return nil
 }
 
-//newWorkToDB saves cexMeta data to the meta bucket in the user database
-//called by newWork
+//cexMetaToCatalog converts cexMeta data to the catalog entry it is saved as
+func cexMetaToCatalog(meta cexMeta) BoltCatalog {
+	return BoltCatalog{URN: meta.URN, Citation: meta.CitationScheme, GroupName: meta.GroupName,
+		WorkTitle: meta.WorkTitle, VersionLabel: meta.VersionLabel, ExemplarLabel: meta.ExemplarLabel,
+		Online: meta.Online, Language: meta.Language}
+}
+
+//newWorkToDB saves cexMeta data as the catalog entry of a new, empty work
+//in the user database. called by newWork
 func newWorkToDB(dbName string, meta cexMeta) error {
-	pwd, _ := os.Getwd()
-	dbname := pwd + "/" + dbName + ".db"
-	dbkey := []byte(meta.URN)
-	//dbvalue, err := gobEncode(&meta) //ineffectual assignment to err: nothing is done with err before it is overwritten
-	dbvalue, _ := gobEncode(&meta)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openUserDB(dbName)
 	if err != nil {
 		log.Println(fmt.Printf("newWorkToDB: error opening userDB: %s", err))
 		return err
 	}
 	defer db.Close()
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("meta"))
-		if err != nil {
-			return err
-		}
-		val := bucket.Get(dbkey)
-		if val != nil {
-			return errors.New("work already exists ")
-		}
-		err = bucket.Put(dbkey, dbvalue)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	return nil
+	return createWork(db, cexMetaToCatalog(meta))
 }
 
-//updateWorkMeta saves cexMeta data for an already existing key in the meta bucket
-//in the user database. Seems not to be called yet. (not in use) (deprecated?)
+//updateWorkMeta saves cexMeta data as the catalog entry of an already existing work
+//in the user database. called by EditCatPage
 func updateWorkMeta(dbName string, meta cexMeta) error {
-	pwd, _ := os.Getwd()
-	dbname := pwd + "/" + dbName + ".db"
-	dbkey := []byte(meta.URN)
-	//dbvalue, err := gobEncode(&meta) //ineffectual assignment to err: nothing is done with err before it is overwritten
-	dbvalue, _ := gobEncode(&meta)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openUserDB(dbName)
 	if err != nil {
 		log.Println(fmt.Printf("updateWorkMeta: error opening userDB: %s", err))
 		return err
 	}
 	defer db.Close()
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("meta"))
-		if err != nil {
-			return err
-		}
-		val := bucket.Get(dbkey)
-		if val == nil {
-			return errors.New("work does not exist yet")
-		}
-		err = bucket.Put(dbkey, dbvalue)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	return nil
+	return updateCatalog(db, cexMetaToCatalog(meta))
 }
 
 //BoltRetrieveFirstKey returns the first key in a specified bucket of
@@ -273,7 +227,7 @@ func BoltRetrieveFirstKey(dbname, bucketName string) (string, error) {
 		log.Println(err)
 		return result, err
 	}
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openDB(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("BoltRetrieveFirstKey: error opening userDB: %s", err))
 		return result, err
@@ -300,26 +254,13 @@ func BoltRetrievePassage(dbName, workName, passageIdentifier string) (gocite.Pas
 		log.Println(err)
 		return result, err
 	}
-	db, err := openBoltDB(dbName)
+	db, err := openDB(dbName)
 	if err != nil {
 		log.Println(fmt.Printf("BoltRetrieve: error opening userDB: %s", err))
 		return result, err
 	}
 	defer db.Close()
-	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(workName))
-		if bucket == nil {
-			return fmt.Errorf("bucket %q not found", workName)
-		}
-		buffer := bucket.Get([]byte(workName + passageIdentifier))
-		err := json.Unmarshal(buffer, &result) //unmarshal the buffer and save the gocite.Passage
-		if err != nil {
-			log.Println(fmt.Printf("Error unmarshalling work: %s", err))
-			return (err)
-		}
-		return nil
-	})
-	return result, err
+	return db.GetPassage(workName + passageIdentifier)
 }
 
 //BoltRetrieveWork retrieves an entire work from the users database as an (ordered) gocite.Work object
@@ -329,41 +270,28 @@ func BoltRetrieveWork(dbName, workID string) (gocite.Work, error) {
 		log.Println(err)
 		return result, err
 	}
-	db, err := openBoltDB(dbName)
+	db, err := openDB(dbName)
 	if err != nil {
 		log.Printf("BoltRetrieve: error opening userDB: %s\n", err)
 		return result, err
 	}
 	defer db.Close()
-	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(workID))
-		if bucket == nil {
-			return fmt.Errorf("BoltRetrieveWork: bucket %q not found", workID)
-		}
-		result.WorkID = workID
-		cursor := bucket.Cursor()
+	return db.GetWork(workID)
+}
 
-		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
-			var passage gocite.Passage
-			err := json.Unmarshal(value, &passage) //unmarshal the buffer and save the gocite.Passage
-			if err != nil {
-				log.Println(fmt.Printf("BoltRetrieveWork: Error unmarshalling Passage: %s", err))
-				return fmt.Errorf("BoltRetrieveWork: Error unmarshalling Passage: %s", err)
-			}
-			//log.Println("Adding " + passage.PassageID + " to work")
-			if passage.PassageID != "" {
-				result.Passages = append(result.Passages, passage)
-			}
-		}
-		return nil
-	})
-	/*for i := range result.Passages {
-		log.Println(fmt.Printf("result: received: %s \nIndex: %d\nFirst: %d\nLast: %d\nPrev: %d\nNext: %d\n",
-			result.Passages[i].PassageID, result.Passages[i].Index, result.Passages[i].First.Index,
-			result.Passages[i].Last.Index, result.Passages[i].Prev.Index, result.Passages[i].Next.Index))
-	}*/
-	result, err = gocite.SortPassages(result)
-	return result, err
+//BoltRetrieveVersion retrieves the version of a passage from the users database, 0 if it has none
+func BoltRetrieveVersion(dbName, urn string) (int, error) {
+	if _, err := os.Stat(dbName); os.IsNotExist(err) {
+		log.Println(err)
+		return 0, err
+	}
+	db, err := openDB(dbName)
+	if err != nil {
+		log.Printf("BoltRetrieveVersion: error opening userDB: %s\n", err)
+		return 0, err
+	}
+	defer db.Close()
+	return db.PassageVersion(urn)
 }
 
 // BoltRetrieve retrieves the string data (as BoltJSON) for the specified key
@@ -374,22 +302,15 @@ func BoltRetrieve(dbname, bucketName, key string) (BoltJSON, error) {
 		log.Println(err)
 		return result, err
 	}
-	db, err := openBoltDB(dbname)
+	db, err := openDB(dbname)
 	if err != nil {
 		log.Println(fmt.Printf("BoltRetrieve: error opening userDB: %s", err))
 		return result, err
 	}
 	defer db.Close()
 	// retrieve the data
-	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketName))
-		if bucket == nil {
-			return fmt.Errorf("bucket %q not found", bucketName)
-		}
-		val := bucket.Get([]byte(key))
-		result.JSON = string(val)
-		return nil
-	})
+	val, err := db.Get(bucketName, key)
+	result.JSON = string(val)
 	return result, err
 }
 
@@ -416,8 +337,8 @@ func deleteBucket(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	newbucket := vars["urn"]
-	dbname := user + ".db"
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	dbname := userDBPath(user)
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("deleteBucket: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -457,22 +378,16 @@ func deleteNode(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	newkey := vars["urn"]
-	newbucket := strings.Join(strings.Split(newkey, ":")[0:4], ":") + ":"
-	dbname := user + ".db"
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openUserDB(user)
 	if err != nil {
 		fmt.Printf("Error opening userDB: %s", err)
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
-	db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(newbucket)).Delete([]byte(newkey))
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		return nil
-	})
-	// Still to do: correct index, previous, next...
+	_, err = deletePassage(db, newkey)
+	if err != nil {
+		log.Println(err)
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// EditionWitness is a witness cited in an edition: a version of the work with its catalog entry.
+type EditionWitness struct {
+	Work    string
+	Siglum  string
+	Catalog BoltCatalog
+}
+
+// EditionPassage is a passage of the base text of an edition with its apparatus.
+// Passages that have not been collated have lemmata without readings.
+type EditionPassage struct {
+	URN       string
+	Text      string //the base text the apparatus was made from
+	Apparatus Apparatus
+	Folios    map[int][]string //the folio markers of the text by the number of its words before them
+}
+
+// Edition is the material of a critical edition of a work or part of it: the base text
+// passage by passage with the apparatus from the stored alignments, and the witnesses cited.
+type Edition struct {
+	Work      string
+	Catalog   BoltCatalog
+	Witnesses []EditionWitness //the base text first
+	Passages  []EditionPassage
+}
+
+// passageRef returns the passage reference of a passage URN, e.g. 3.1 of urn:cts:...:3.1.
+func passageRef(urn string) string {
+	return strings.TrimPrefix(urn, workBucket(urn))
+}
+
+// folioPositions returns the folio markers of text by the number of words before them once text is
+// prepared for alignment with settings, i.e. by the base word of the apparatus they come before.
+// A marker within a word comes before that word.
+func folioPositions(text string, settings AlignmentSettings) map[int][]string {
+	positions := map[int][]string{}
+	words := strings.Fields(prepareText(text, settings))
+	for _, match := range folioMarker.FindAllStringSubmatchIndex(text, -1) {
+		before := strings.Fields(prepareText(text[:match[0]], settings))
+		n := len(before)
+		if n > 0 && n <= len(words) && before[n-1] != words[n-1] {
+			n--
+		}
+		positions[n] = append(positions[n], text[match[2]:match[3]])
+	}
+	return positions
+}
+
+// loadEdition returns the edition of the passages of the work with the given URN from the passage
+// from to the passage to in reading order; an empty from or to stands for the first or last passage.
+// Witnesses are cited by the sigla returned by siglum for their passage URNs.
+func loadEdition(db *UserDB, workID, from, to string, siglum func(urn string) string) (Edition, error) {
+	settings, err := requestAlignmentSettings(db, workID, nil)
+	if err != nil {
+		return Edition{}, err
+	}
+	edition := Edition{Work: workID}
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workID))
+		if bucket == nil {
+			return fmt.Errorf("%s: %w", workID, errWorkNotFound)
+		}
+		var err error
+		edition.Catalog, err = getCatalog(tx, workID)
+		if err != nil {
+			return err
+		}
+		witnesses := map[string]bool{}
+		addWitness := func(urn string) error {
+			work := workBucket(urn)
+			if witnesses[work] {
+				return nil
+			}
+			witnesses[work] = true
+			catalog, err := getCatalog(tx, work)
+			edition.Witnesses = append(edition.Witnesses, EditionWitness{Work: work, Siglum: siglum(urn), Catalog: catalog})
+			return err
+		}
+		err = addWitness(workID)
+		if err != nil {
+			return err
+		}
+
+		alignments := tx.Bucket([]byte(alignmentsBucket))
+		inRange := from == ""
+		for _, passage := range linkPassages(workID, bucketPassages(bucket)).Passages {
+			if passage.PassageID == from {
+				inRange = true
+			}
+			if !inRange {
+				continue
+			}
+			text := alignmentText(passage, settings)
+			var apparatus Apparatus
+			var stored []byte
+			if alignments != nil {
+				stored = alignments.Get([]byte(passage.PassageID))
+			}
+			if stored != nil {
+				collation, err := decodeAlignments(stored)
+				if err != nil {
+					return fmt.Errorf("alignment of %s: %s", passage.PassageID, err)
+				}
+				err = checkCollation(collation)
+				if err != nil {
+					return err
+				}
+				apparatus = buildApparatus(collation, siglum)
+			}
+			if len(apparatus.Lemmata) == 0 {
+				apparatus = buildApparatus(Alignments{AlignmentID: passage.PassageID}, siglum)
+				for column, word := range alignWitnesses([]string{text}, settings)[0] {
+					apparatus.Lemmata = append(apparatus.Lemmata, ApparatusEntry{Column: column, Text: word,
+						Agreeing: []string{apparatus.Base.Siglum}, Readings: []Reading{}})
+				}
+			}
+			for _, witness := range apparatus.Witnesses {
+				err := addWitness(witness.URN)
+				if err != nil {
+					return err
+				}
+			}
+			edition.Passages = append(edition.Passages, EditionPassage{URN: passage.PassageID, Text: text, Apparatus: apparatus,
+				Folios: folioPositions(text, settings)})
+			if passage.PassageID == to {
+				break
+			}
+		}
+		if from != "" && !inRange {
+			return fmt.Errorf("%s: %w", from, errPassageNotFound)
+		}
+		if to != "" && (len(edition.Passages) == 0 || edition.Passages[len(edition.Passages)-1].URN != to) {
+			return fmt.Errorf("%s: %w", to, errPassageNotFound)
+		}
+		return nil
+	})
+	return edition, err
+}
@@ -9,6 +9,9 @@ var configLocation *string
 var localAssets *bool
 var checkForUpdates *bool
 var heroku *bool
+var checkDB *string
+var repairDB *string
+var repairOrdering *string
 
 func initializeFlags() {
 	noAuth = flag.Bool("noauth", false, "Start Brucheion without authenticating with a provider. (default: false)")
@@ -16,6 +19,9 @@ func initializeFlags() {
 	localAssets = flag.Bool("localAssets", false, "Obtain static assets from the local filesystem during development. (default: false)")
 	checkForUpdates = flag.Bool("update", false, "Check for updates and install them at startup. (default: false)")
 	heroku = flag.Bool("heroku", false, "Deploying on heroku. (default: false)")
+	checkDB = flag.String("check", "", "Check the integrity of the given user database (e.g. user.db) and exit.")
+	repairDB = flag.String("repair", "", "Repair the passage links of the given user database (e.g. user.db) and exit.")
+	repairOrdering = flag.String("ordering", "chain", "Ordering the links are rebuilt from with -repair: index, chain, urn, or key.")
 
 	flag.Parse()
 }
@@ -134,20 +134,6 @@ func maxfloat(floatslice []float64) int {
 	return maxindex
 }
 
-//testAllTheSame tests if all strings in a two-dimensional string-slice are the same (?)
-func testAllTheSame(testset [][]string) bool {
-	teststr := strings.Join(testset[0], "")
-	for i := range testset {
-		if i == 0 {
-			continue
-		}
-		if teststr != strings.Join(testset[i], "") {
-			return false
-		}
-	}
-	return true
-}
-
 //findSpace returns a rune-slice exluding leading and trailing whitespaces
 //(Works like strings.TrimSpace but for rune-slices)
 //Additionally returns the count of trimmed leading and trailing whitespaces
@@ -173,91 +159,6 @@ func findSpace(runeSl []rune) (spBefore, spAfter int, newSl []rune) {
 	return spBefore, spAfter, runeSl[spBefore : len(runeSl)-spAfter]
 }
 
-//testString does not seem to be in use anymore (?)
-func testString(str string, strsl1 []string, cursorIn int) (cursorOut int, sl []int, ok bool) {
-	calcStr1 := ""
-	if len([]rune(str)) > len([]rune(strings.Join(strsl1[cursorIn:], ""))) {
-		return 0, []int{}, false
-	}
-	base := cursorIn
-	for i, v := range strsl1[cursorIn:] {
-		calcStr1 = calcStr1 + v
-		if calcStr1 != str {
-			if i+1 == len(sl) {
-				return 0, []int{}, false
-			}
-			sl = append(sl, i+base)
-			continue
-		}
-		if calcStr1 == str {
-			sl = append(sl, i+base)
-			cursorOut = i + base + 1
-			ok = true
-			return cursorOut, sl, ok
-		}
-	}
-	return 0, []int{}, false
-}
-
-//testStringSL is used for multipage alignment (?)
-func testStringSl(slsl [][]string) (slsl2 [][][]int, ok bool) {
-	if len(slsl) == 0 {
-		// fmt.Println("zero length")
-		slsl2 = [][][]int{}
-		return slsl2, ok
-	}
-	ok = testAllTheSame(slsl)
-	if !ok {
-		// fmt.Println("slices not same length")
-		slsl2 = [][][]int{}
-		return slsl2, ok
-	}
-	// fmt.Println("passed testAllTheSame")
-
-	length := len(slsl)
-
-	base := make([]int, length)
-	cursor := make([]int, length)
-	indeces := make([][]int, length)
-	testr := ""
-	slsl2 = make([][][]int, length)
-
-	for i := 0; i < len(slsl[0]); i++ {
-		match := false
-		indeces[0] = append(indeces[0], i)
-		testr = testr + slsl[0][i]
-		// fmt.Println("test", testr)
-		// fmt.Scanln()
-
-		for k := range slsl {
-			if k == 0 {
-				continue
-			}
-			cursor[k], indeces[k], match = testString(testr, slsl[k], base[k])
-			if !match {
-				// fmt.Println(testr, "and", slsl[k][base[k]:], "do not match")
-				// fmt.Scanln()
-				break
-			}
-		}
-		if match {
-			// fmt.Println("write to slice!!")
-			// fmt.Scanln()
-			for k := range slsl {
-				slsl2[k] = append(slsl2[k], indeces[k])
-				if k == 0 {
-					continue
-				}
-				base[k] = cursor[k]
-			}
-			indeces[0] = []int{}
-			testr = ""
-		}
-	}
-	ok = true
-	return slsl2, ok
-}
-
 //addSansHyphens adds Hyphens after certain sanscrit runes but not before
 //used for nwa and multipage alignment
 func addSansHyphens(s string) string {
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// historyBucket holds a bucket of revisions per passage URN, keyed by revision number
+const historyBucket = "history"
+
+// errRevisionNotFound is returned for revision numbers not in the history of a passage
+var errRevisionNotFound = errors.New("revision not found")
+
+// Revision is a saved state of the text of a passage.
+type Revision struct {
+	Number int            `json:"number"`
+	Author string         `json:"author"` //empty for the text a passage had before its first recorded change
+	Time   time.Time      `json:"time"`
+	Text   gocite.EncText `json:"text"`
+}
+
+// DiffOp is a run of words that is equal in, inserted into, or deleted from a text.
+type DiffOp struct {
+	Op   string `json:"op"` //equal, insert, or delete
+	Text string `json:"text"`
+}
+
+// revisionKey returns the key of revision number in the history of a passage.
+func revisionKey(number int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(number))
+	return key
+}
+
+// revisions returns the revisions of the passage urn within tx, oldest first.
+func revisions(tx *bolt.Tx, urn string) ([]Revision, error) {
+	result := []Revision{}
+	history := tx.Bucket([]byte(historyBucket))
+	if history == nil || history.Bucket([]byte(urn)) == nil {
+		return result, nil
+	}
+	err := history.Bucket([]byte(urn)).ForEach(func(_, value []byte) error {
+		var revision Revision
+		err := json.Unmarshal(value, &revision)
+		result = append(result, revision)
+		return err
+	})
+	return result, err
+}
+
+// recordRevision appends text as a new revision to the history of the passage urn.
+func recordRevision(tx *bolt.Tx, urn, author string, text gocite.EncText) (Revision, error) {
+	history, err := tx.CreateBucketIfNotExists([]byte(historyBucket))
+	if err != nil {
+		return Revision{}, err
+	}
+	bucket, err := history.CreateBucketIfNotExists([]byte(urn))
+	if err != nil {
+		return Revision{}, err
+	}
+	number, err := bucket.NextSequence()
+	if err != nil {
+		return Revision{}, err
+	}
+	revision := Revision{Number: int(number), Author: author, Time: time.Now().UTC(), Text: text}
+	value, err := json.Marshal(revision)
+	if err != nil {
+		return Revision{}, err
+	}
+	return revision, bucket.Put(revisionKey(revision.Number), value)
+}
+
+// moveHistory gives the revision history of the passage from to the passage to within tx,
+// replacing any history of to.
+func moveHistory(tx *bolt.Tx, from, to string) error {
+	history := tx.Bucket([]byte(historyBucket))
+	if history == nil || history.Bucket([]byte(from)) == nil {
+		return nil
+	}
+	if history.Bucket([]byte(to)) != nil {
+		err := history.DeleteBucket([]byte(to))
+		if err != nil {
+			return err
+		}
+	}
+	source := history.Bucket([]byte(from))
+	target, err := history.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	err = source.ForEach(func(key, value []byte) error {
+		return target.Put(append([]byte{}, key...), append([]byte{}, value...))
+	})
+	if err != nil {
+		return err
+	}
+	err = target.SetSequence(source.Sequence())
+	if err != nil {
+		return err
+	}
+	return history.DeleteBucket([]byte(from))
+}
+
+// updatePassage applies update to the stored passage urn within tx, saves it,
+// and increments its version. If update changes the text, the new text is recorded in the history of the passage,
+// preceded by the old text if the history is empty yet.
+func updatePassage(tx *bolt.Tx, urn, author string, update func(passage *gocite.Passage) error) (gocite.Passage, error) {
+	var passage gocite.Passage
+	bucket := tx.Bucket([]byte(workBucket(urn)))
+	if bucket == nil || bucket.Get([]byte(urn)) == nil {
+		return passage, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+	}
+	err := json.Unmarshal(bucket.Get([]byte(urn)), &passage)
+	if err != nil {
+		return passage, err
+	}
+	old := passage.Text
+	err = update(&passage)
+	if err != nil {
+		return passage, err
+	}
+	value, err := json.Marshal(passage)
+	if err != nil {
+		return passage, err
+	}
+	err = bucket.Put([]byte(urn), value)
+	if err != nil {
+		return passage, err
+	}
+	_, err = nextVersion(tx, urn)
+	if err != nil || passage.Text == old {
+		return passage, err
+	}
+	return passage, recordTextChange(tx, urn, author, old, passage.Text)
+}
+
+// recordTextChange records text as a new revision of the passage urn whose text was old,
+// preceded by old if the history of the passage is empty yet.
+func recordTextChange(tx *bolt.Tx, urn, author string, old, text gocite.EncText) error {
+	history, err := revisions(tx, urn)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 {
+		_, err = recordRevision(tx, urn, "", old)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = recordRevision(tx, urn, author, text)
+	return err
+}
+
+// diffWords returns the word by word difference between the texts a and b,
+// based on their longest common subsequence of words.
+func diffWords(a, b string) []DiffOp {
+	x, y := strings.Fields(a), strings.Fields(b)
+	//lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			switch {
+			case x[i] == y[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := []DiffOp{}
+	add := func(op, word string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += " " + word
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: word})
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			add("equal", x[i])
+			i, j = i+1, j+1
+		case j < len(y) && (i == len(x) || lcs[i][j+1] > lcs[i+1][j]):
+			add("insert", y[j])
+			j++
+		default:
+			add("delete", x[i])
+			i++
+		}
+	}
+	return ops
+}
+
+// handleRevisions lists the revisions of the passage {urn}.
+func handleRevisions(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	var result []Revision
+	err = db.View(func(tx *bolt.Tx) error {
+		result, err = revisions(tx, mux.Vars(r)["urn"])
+		return err
+	})
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	respondWithData(w, result, 200)
+}
+
+// handleRevisionDiff compares the TXT layer of the revisions from and to of the passage {urn}
+// word by word. to defaults to the latest revision and from to the one before to.
+func handleRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	var history []Revision
+	err = db.View(func(tx *bolt.Tx) error {
+		history, err = revisions(tx, mux.Vars(r)["urn"])
+		return err
+	})
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+
+	to, err := strconv.Atoi(r.FormValue("to"))
+	if r.FormValue("to") == "" {
+		to, err = len(history), nil
+	}
+	from, ferr := strconv.Atoi(r.FormValue("from"))
+	if r.FormValue("from") == "" {
+		from, ferr = to-1, nil
+	}
+	if err != nil || ferr != nil || from < 1 || to < 1 || from > len(history) || to > len(history) {
+		respondWithError(w, "revision_not_found", 404)
+		return
+	}
+	respondWithData(w, diffWords(history[from-1].Text.TXT, history[to-1].Text.TXT), 200)
+}
+
+// handleRevisionRestore makes the revision {revision} the current text of the passage {urn}.
+// The restored text is recorded as a new revision, which is returned.
+func handleRevisionRestore(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	vars := mux.Vars(r)
+	urn := vars["urn"]
+	number, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		respondWithError(w, "revision_not_found", 404)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	var restored Revision
+	err = db.Update(func(tx *bolt.Tx) error {
+		history, err := revisions(tx, urn)
+		if err != nil {
+			return err
+		}
+		if number < 1 || number > len(history) {
+			return errRevisionNotFound
+		}
+		_, err = updatePassage(tx, urn, user, func(passage *gocite.Passage) error {
+			passage.Text = history[number-1].Text
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		history, err = revisions(tx, urn)
+		restored = history[len(history)-1]
+		return err
+	})
+	switch {
+	case errors.Is(err, errRevisionNotFound):
+		respondWithError(w, "revision_not_found", 404)
+	case errors.Is(err, errPassageNotFound):
+		respondWithError(w, "passage_not_found", 404)
+	case err != nil:
+		log.Printf("handleRevisionRestore: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	default:
+		respondWithData(w, restored, 200)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// serveAsUser calls handler with a request of the logged in user test and the given route
+// variables, and returns the response and its decoded data.
+func serveAsUser(t *testing.T, handler http.HandlerFunc, method string, vars map[string]string, body string, data interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	session := sessions.NewSession(nil, SessionName)
+	session.Values["BrucheionUserName"] = "test"
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	r = mux.SetURLVars(r.WithContext(context.WithValue(r.Context(), "session", session)), vars)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if data != nil {
+		err := json.Unmarshal(w.Body.Bytes(), &JSONResponse{Data: data})
+		if err != nil {
+			t.Fatalf("decoding the response %q: %s", w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []DiffOp
+	}{
+		{"", "", []DiffOp{}},
+		{"a b c", "a b c", []DiffOp{{"equal", "a b c"}}},
+		{"", "a b", []DiffOp{{"insert", "a b"}}},
+		{"a b", "", []DiffOp{{"delete", "a b"}}},
+		{"a b c", "a x c", []DiffOp{{"equal", "a"}, {"delete", "b"}, {"insert", "x"}, {"equal", "c"}}},
+		{"a b c d", "a c d e", []DiffOp{{"equal", "a"}, {"delete", "b"}, {"equal", "c d"}, {"insert", "e"}}},
+		{"a  b\r\nc", "a b c", []DiffOp{{"equal", "a b c"}}},
+		{"ṛṣir muniḥ", "ṛṣiḥ muniḥ", []DiffOp{{"delete", "ṛṣir"}, {"insert", "ṛṣiḥ"}, {"equal", "muniḥ"}}},
+	}
+	for _, test := range tests {
+		if got := diffWords(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("diffWords(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestRevisionRestore(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	urn := testWork + "1.1"
+	for _, text := range []string{"prathamaḥ", "prathamaḥ pādaḥ"} {
+		err := db.Update(func(tx *bolt.Tx) error {
+			_, err := updatePassage(tx, urn, "alice", func(passage *gocite.Passage) error {
+				passage.Text = gocite.EncText{TXT: text, Brucheion: text}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var history []Revision
+	w := serveAsUser(t, handleRevisions, "GET", map[string]string{"urn": urn}, "", &history)
+	if w.Code != 200 || len(history) != 3 {
+		t.Fatalf("revisions: %d %+v", w.Code, history)
+	}
+	for i, want := range []struct{ author, text string }{{"", "prathamam"}, {"alice", "prathamaḥ"}, {"alice", "prathamaḥ pādaḥ"}} {
+		if history[i].Number != i+1 || history[i].Author != want.author || history[i].Text.TXT != want.text {
+			t.Errorf("revision %d = %+v, want %+v", i+1, history[i], want)
+		}
+	}
+
+	var restored Revision
+	w = serveAsUser(t, handleRevisionRestore, "POST", map[string]string{"urn": urn, "revision": "1"}, "", &restored)
+	if w.Code != 200 || restored.Number != 4 || restored.Author != "test" || restored.Text.TXT != "prathamam" {
+		t.Errorf("restore: %d %+v", w.Code, restored)
+	}
+	passage, _ := getPassage(t, db, testWork, urn)
+	if passage.Text.TXT != "prathamam" {
+		t.Errorf("text after the restore: %q", passage.Text.TXT)
+	}
+
+	var diff []DiffOp
+	w = serveAsUser(t, handleRevisionDiff, "GET", map[string]string{"urn": urn}, "", &diff)
+	if want := []DiffOp{{"delete", "prathamaḥ pādaḥ"}, {"insert", "prathamam"}}; w.Code != 200 || !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff of the restore: %d %v, want %v", w.Code, diff, want)
+	}
+
+	for _, vars := range []map[string]string{
+		{"urn": urn, "revision": "5"},
+		{"urn": urn, "revision": "0"},
+		{"urn": urn, "revision": "first"},
+		{"urn": testWork + "1.2", "revision": "1"},
+	} {
+		if w := serveAsUser(t, handleRevisionRestore, "POST", vars, "", nil); w.Code != 404 {
+			t.Errorf("restore of %v: %d, want 404", vars, w.Code)
+		}
+	}
+}
@@ -52,8 +52,8 @@ func requestImgCollection(res http.ResponseWriter, req *http.Request) {
 	}
 
 	response := JSONlist{}
-	dbname := user + ".db"
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	dbname := userDBPath(user)
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("requestImgCollection: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -106,8 +106,8 @@ func getImageInfo(res http.ResponseWriter, req *http.Request) {
 	collectionName := vars["name"]
 	imageurn := vars["imageurn"]
 	dbkey := []byte(collectionName)
-	dbname := user + ".db"
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	dbname := userDBPath(user)
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("getImageInfo: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -121,7 +121,7 @@ func getImageInfo(res http.ResponseWriter, req *http.Request) {
 		}
 		val := b.Get(dbkey)
 		// fmt.Println("got", string(dbkey))
-		retImage, _ = gobDecodeImgCol(val)
+		retImage, _ = decodeImgCol(val)
 		for _, v := range retImage.Collection {
 			if v.URN == imageurn {
 				newImage = v
@@ -163,9 +163,9 @@ func requestImgID(res http.ResponseWriter, req *http.Request) {
 	collection := imageCollection{}
 	vars := mux.Vars(req)
 	name := vars["name"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	dbkey := []byte(name)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("requestImgID: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -181,7 +181,7 @@ func requestImgID(res http.ResponseWriter, req *http.Request) {
 		if val == nil {
 			return errors.New("failed to retrieve value")
 		}
-		collection, err = gobDecodeImgCol(val)
+		collection, err = decodeImgCol(val)
 		if err != nil {
 			return err
 		}
@@ -237,47 +237,49 @@ func SaveImageRef(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	newkey := vars["key"]
 	imagerefstr := vars["updated"]
-	newbucket := strings.Join(strings.Split(newkey, ":")[0:4], ":") + ":"
 	// imagerefstr := r.FormValue("text")
 	imageref := strings.Split(imagerefstr, "+")
-	dbname := user + ".db"
-	retrieveddata, _ := BoltRetrieve(dbname, newbucket, newkey)
-	retrievedjson := gocite.Passage{}
-	json.Unmarshal([]byte(retrieveddata.JSON), &retrievedjson)
 	var textareas []gocite.Triple
 	for i := range imageref {
 		textareas = append(textareas, gocite.Triple{Subject: newkey,
 			Verb:   "urn:cite2:dse:verbs.v1:appears_on",
 			Object: imageref[i]})
 	}
-	retrievedjson.ImageLinks = textareas
-	newnode, _ := json.Marshal(retrievedjson)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openUserDB(user)
 	if err != nil {
 		log.Println(fmt.Printf("SaveImageRef: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
-	key := []byte(newkey)    //
-	value := []byte(newnode) //
-	// store some data
+	// store the image references unless the passage was changed in the meantime
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(newbucket))
+		err := checkVersion(tx, newkey, req.FormValue("version"))
 		if err != nil {
 			return err
 		}
-
-		err = bucket.Put(key, value)
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		return nil
+		_, err = updatePassage(tx, newkey, user, func(passage *gocite.Passage) error {
+			passage.ImageLinks = textareas
+			return nil
+		})
+		return err
 	})
 
-	if err != nil {
-		log.Fatal(err)
+	var stale *StaleVersionError
+	switch {
+	case errors.As(err, &stale):
+		http.Error(res, stale.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errPassageNotFound):
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errBadPassage):
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("SaveImageRef: %s\n", err)
+		http.Error(res, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 	reDir := "/view/" + newkey
 	http.Redirect(res, req, reDir, http.StatusFound)
@@ -89,7 +89,7 @@ func getCookieStore(maxAge int) sessions.Store {
 //initializeUserDB should be called once during login attempt to make sure that all buckets are in place.
 func initializeUsersDB() error {
 	log.Println("Initializing UserDB")
-	db, err := openBoltDB(config.UserDB)
+	db, err := sharedDBs.Open(config.UserDB)
 	if err != nil {
 		return err
 	}
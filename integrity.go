@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// Kinds of problems found by checkIntegrity
+const (
+	issueBrokenChain      = "broken_chain"      //Prev/Next links that do not form a single chain over the work
+	issueDuplicateIndex   = "duplicate_index"   //several passages of a work share an Index
+	issueForeignPassage   = "foreign_passage"   //a passage stored outside of its work bucket or under another key
+	issueDuplicatePassage = "duplicate_passage" //several passages of a work with the same URN
+	issueCatalogNoPassage = "catalog_without_passages"
+	issueUnknownImage     = "unknown_image" //an image link to an object not found in the image collections
+)
+
+// Orderings from which repairIntegrity rebuilds the links of a work
+const (
+	orderingIndex = "index" //by the Index field of the passages
+	orderingChain = "chain" //by following the Prev/Next links, by Index where they are broken
+	orderingURN   = "urn"   //by the passage references, comparing numbers numerically
+	orderingKey   = "key"   //by the order of the keys in the database
+)
+
+// integrityOrderings lists the orderings accepted by repairIntegrity
+var integrityOrderings = []string{orderingIndex, orderingChain, orderingURN, orderingKey}
+
+// IntegrityIssue is a single problem found in a user database.
+type IntegrityIssue struct {
+	Kind    string `json:"kind"`
+	Work    string `json:"work"`
+	URN     string `json:"urn"`
+	Message string `json:"message"`
+}
+
+// IntegrityReport lists the problems found in a user database.
+type IntegrityReport struct {
+	Works    int              `json:"works"`
+	Passages int              `json:"passages"`
+	Issues   []IntegrityIssue `json:"issues"`
+}
+
+// storedPassage is a passage together with the key it is stored under.
+type storedPassage struct {
+	key     string
+	passage gocite.Passage
+}
+
+// workPassages returns the passages of a work bucket in key order.
+func workPassages(bucket *bolt.Bucket) []storedPassage {
+	var passages []storedPassage
+	bucket.ForEach(func(key, value []byte) error {
+		passage := gocite.Passage{}
+		if json.Unmarshal(value, &passage) == nil && passage.PassageID != "" {
+			passages = append(passages, storedPassage{key: string(key), passage: passage})
+		}
+		return nil
+	})
+	return passages
+}
+
+// checkIntegrity checks all works of a user database.
+func checkIntegrity(db *UserDB) (IntegrityReport, error) {
+	report := IntegrityReport{Issues: []IntegrityIssue{}}
+	err := db.View(func(tx *bolt.Tx) error {
+		images, err := knownImages(tx)
+		if err != nil {
+			return err
+		}
+		works := workBuckets(tx)
+		report.Works = len(works)
+		for _, work := range works {
+			passages := workPassages(tx.Bucket([]byte(work)))
+			report.Passages += len(passages)
+			report.Issues = append(report.Issues, checkWork(work, passages, images)...)
+		}
+
+		catalog := tx.Bucket([]byte(catalogBucket))
+		if catalog == nil {
+			return nil
+		}
+		return catalog.ForEach(func(key, _ []byte) error {
+			bucket := tx.Bucket(key)
+			if bucket == nil {
+				report.Issues = append(report.Issues, IntegrityIssue{Kind: issueCatalogNoPassage, Work: string(key),
+					Message: "the catalog entry has no work bucket"})
+			}
+			return nil
+		})
+	})
+	return report, err
+}
+
+// knownImages returns the URNs of all images in the image collections of a user database.
+// The collections are keyed by the collection part of the URN.
+func knownImages(tx *bolt.Tx) (map[string]map[string]bool, error) {
+	images := make(map[string]map[string]bool)
+	bucket := tx.Bucket([]byte("imgCollection"))
+	if bucket == nil {
+		return images, nil
+	}
+	err := bucket.ForEach(func(key, value []byte) error {
+		collection, err := decodeImgCol(value)
+		if err != nil {
+			return fmt.Errorf("decoding image collection %s failed: %s", key, err)
+		}
+		for _, img := range collection.Collection {
+			urn := imageObject(img.URN)
+			name := urn[:strings.LastIndex(urn, ":")+1]
+			if images[name] == nil {
+				images[name] = make(map[string]bool)
+			}
+			images[name][urn] = true
+		}
+		return nil
+	})
+	return images, err
+}
+
+// imageObject strips a region of interest (@x,y,w,h) from an image URN.
+func imageObject(urn string) string {
+	if i := strings.Index(urn, "@"); i >= 0 {
+		return urn[:i]
+	}
+	return urn
+}
+
+// containsObject reports whether one of links points to object.
+func containsObject(links []gocite.Triple, object string) bool {
+	for _, link := range links {
+		if link.Object == object {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWork checks the passages of a single work.
+func checkWork(work string, passages []storedPassage, images map[string]map[string]bool) []IntegrityIssue {
+	var issues []IntegrityIssue
+	issue := func(kind, urn, format string, a ...interface{}) {
+		issues = append(issues, IntegrityIssue{Kind: kind, Work: work, URN: urn, Message: fmt.Sprintf(format, a...)})
+	}
+
+	//of several passages with the same URN, the chain is checked with the one stored under its URN
+	chained := make(map[string]int, len(passages))
+	for i, p := range passages {
+		id := p.passage.PassageID
+		if _, seen := chained[id]; !seen || p.key == id {
+			chained[id] = i
+		}
+	}
+
+	byID := make(map[string]gocite.Passage, len(passages))
+	indices := make(map[int][]string)
+	for i, p := range passages {
+		id := p.passage.PassageID
+		switch {
+		case workBucket(id) != work:
+			issue(issueForeignPassage, id, "the passage is stored in the bucket of %s", work)
+		case p.key != id:
+			issue(issueForeignPassage, id, "the passage is stored under the key %s", p.key)
+		}
+		if chained[id] != i {
+			issue(issueDuplicatePassage, id, "several passages of the work have this URN")
+			continue
+		}
+		byID[id] = p.passage
+		indices[p.passage.Index] = append(indices[p.passage.Index], id)
+		for _, link := range p.passage.ImageLinks {
+			object := imageObject(link.Object)
+			collection := object[:strings.LastIndex(object, ":")+1]
+			if !images[collection][object] {
+				issue(issueUnknownImage, id, "the linked image %s is not part of any image collection", link.Object)
+			}
+		}
+	}
+
+	var sorted []int
+	for index, ids := range indices {
+		if len(ids) > 1 {
+			sorted = append(sorted, index)
+		}
+	}
+	sort.Ints(sorted)
+	for _, index := range sorted {
+		issue(issueDuplicateIndex, indices[index][0], "index %d is shared by %s", index, strings.Join(indices[index], ", "))
+	}
+
+	var starts []string
+	for i, p := range passages {
+		passage := p.passage
+		if chained[passage.PassageID] != i {
+			continue
+		}
+		if !passage.Prev.Exists {
+			starts = append(starts, passage.PassageID)
+		}
+		for _, link := range []struct {
+			name string
+			loc  gocite.PassLoc
+			back func(gocite.Passage) gocite.PassLoc
+		}{
+			{"next", passage.Next, func(p gocite.Passage) gocite.PassLoc { return p.Prev }},
+			{"previous", passage.Prev, func(p gocite.Passage) gocite.PassLoc { return p.Next }},
+		} {
+			if !link.loc.Exists {
+				continue
+			}
+			target, ok := byID[link.loc.PassageID]
+			switch {
+			case !ok:
+				issue(issueBrokenChain, passage.PassageID, "the %s passage %s does not exist", link.name, link.loc.PassageID)
+			case link.back(target).PassageID != passage.PassageID:
+				issue(issueBrokenChain, passage.PassageID, "the %s passage %s does not link back", link.name, link.loc.PassageID)
+			}
+		}
+	}
+	if len(passages) > 0 && len(starts) != 1 {
+		issue(issueBrokenChain, "", "the work has %d passages without a previous passage instead of one", len(starts))
+	} else if len(passages) > 0 {
+		visited := make(map[string]bool)
+		for id, ok := starts[0], true; ok && !visited[id]; {
+			visited[id] = true
+			passage := byID[id]
+			if !passage.Next.Exists {
+				break
+			}
+			id = passage.Next.PassageID
+			_, ok = byID[id]
+		}
+		if len(visited) != len(byID) {
+			issue(issueBrokenChain, starts[0], "the chain starting here covers %d of %d passages", len(visited), len(byID))
+		}
+	}
+	return issues
+}
+
+// repairIntegrity rebuilds Index, Prev, and Next of the passages of the given works,
+// or of all works if works is empty, from the given ordering. Passages stored outside of
+// their work bucket or under another key are moved to their place first. If a passage
+// with the same URN is stored there already, a copy with the same text is merged into it,
+// adding its image links; a differing copy is left where it is, out of the rebuilt links,
+// and reported as a duplicate_passage by checkIntegrity.
+func repairIntegrity(db *UserDB, works []string, ordering string) error {
+	if !contains(integrityOrderings, ordering) {
+		return fmt.Errorf("unknown ordering %q", ordering)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		all := workBuckets(tx)
+		if len(works) == 0 {
+			works = all
+		}
+		for _, work := range all {
+			bucket := tx.Bucket([]byte(work))
+			for _, p := range workPassages(bucket) {
+				id := p.passage.PassageID
+				if workBucket(id) == work && p.key == id {
+					continue
+				}
+				target, err := tx.CreateBucketIfNotExists([]byte(workBucket(id)))
+				if err != nil {
+					return err
+				}
+				passage := p.passage
+				if stored := target.Get([]byte(id)); stored != nil {
+					var kept gocite.Passage
+					if json.Unmarshal(stored, &kept) != nil || kept.Text != passage.Text {
+						continue
+					}
+					for _, link := range passage.ImageLinks {
+						if !containsObject(kept.ImageLinks, link.Object) {
+							kept.ImageLinks = append(kept.ImageLinks, link)
+						}
+					}
+					passage = kept
+				}
+				value, _ := json.Marshal(passage)
+				err = target.Put([]byte(id), value)
+				if err != nil {
+					return err
+				}
+				err = bucket.Delete([]byte(p.key))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, work := range works {
+			bucket := tx.Bucket([]byte(work))
+			if bucket == nil {
+				return fmt.Errorf("work %q not found", work)
+			}
+			var passages []gocite.Passage
+			for _, p := range workPassages(bucket) {
+				if p.key == p.passage.PassageID && workBucket(p.key) == work {
+					passages = append(passages, p.passage) //without the duplicates left in place
+				}
+			}
+			for _, passage := range linkPassages(work, orderBy(passages, ordering)).Passages {
+				value, _ := json.Marshal(passage)
+				err := bucket.Put([]byte(passage.PassageID), value)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, work := range all {
+			err := updateWorkBounds(tx, work)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// orderBy sorts passages, given in key order, by one of the integrityOrderings.
+func orderBy(passages []gocite.Passage, ordering string) []gocite.Passage {
+	switch ordering {
+	case orderingIndex:
+		sort.SliceStable(passages, func(i, j int) bool { return passages[i].Index < passages[j].Index })
+	case orderingChain:
+		passages = orderPassages(passages)
+	case orderingURN:
+		sort.SliceStable(passages, func(i, j int) bool {
+			return lessReference(passageReference(passages[i].PassageID), passageReference(passages[j].PassageID))
+		})
+	}
+	return passages
+}
+
+// passageReference returns the passage component of a CTS URN.
+func passageReference(urn string) string {
+	parts := strings.Split(urn, ":")
+	return parts[len(parts)-1]
+}
+
+// lessReference compares two passage references segment by segment,
+// numbers numerically and everything else lexically (1.2 < 1.10 < 1.10a).
+func lessReference(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aerr := strconv.Atoi(strings.TrimRight(as[i], "abcdefghijklmnopqrstuvwxyz"))
+		bn, berr := strconv.Atoi(strings.TrimRight(bs[i], "abcdefghijklmnopqrstuvwxyz"))
+		if aerr == nil && berr == nil && an != bn {
+			return an < bn
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
+
+// writeIntegrityReport writes a human readable report to w.
+func writeIntegrityReport(w io.Writer, report IntegrityReport) {
+	fmt.Fprintf(w, "%d works, %d passages, %d issues\n", report.Works, report.Passages, len(report.Issues))
+	for _, issue := range report.Issues {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", issue.Kind, issue.Work, issue.URN, issue.Message)
+	}
+}
+
+// handleIntegrity checks the user database and responds with an IntegrityReport.
+// A POST request repairs the works given in the comma-separated form value works (all
+// if empty) from the form value ordering (index, chain, urn, or key) before checking.
+func handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	if r.Method == http.MethodPost {
+		ordering := r.FormValue("ordering")
+		if ordering == "" {
+			ordering = orderingChain
+		}
+		if !contains(integrityOrderings, ordering) {
+			respondWithError(w, "bad_ordering", 400)
+			return
+		}
+		var works []string
+		if value := r.FormValue("works"); value != "" {
+			works = strings.Split(value, ",")
+		}
+		err = repairIntegrity(db, works, ordering)
+		if err != nil {
+			respondWithJSON(w, "error", "repair_failed", err.Error(), 400)
+			return
+		}
+	}
+
+	report, err := checkIntegrity(db)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	respondWithData(w, report, 200)
+}
+
+// runIntegrity checks the database at checkPath and repairs the database at repairPath
+// from the given ordering for the command line flags -check, -repair, and -ordering.
+// It returns the exit status: 1 if an error or, when checking only, an issue was found.
+func runIntegrity(checkPath, repairPath, ordering string) int {
+	path := checkPath
+	if repairPath != "" {
+		path = repairPath
+	}
+	if _, err := os.Stat(path); err != nil {
+		log.Println(err)
+		return 1
+	}
+	db, err := userDBs.Open(path)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer userDBs.CloseAll()
+	defer db.Close()
+
+	if repairPath != "" {
+		err = repairIntegrity(db, nil, ordering)
+		if err != nil {
+			log.Printf("Repairing %s failed: %s\n", path, err)
+			return 1
+		}
+		log.Printf("Rebuilt the passage links of %s from the %s ordering.\n", path, ordering)
+	}
+	report, err := checkIntegrity(db)
+	if err != nil {
+		log.Printf("Checking %s failed: %s\n", path, err)
+		return 1
+	}
+	writeIntegrityReport(os.Stdout, report)
+	if repairPath == "" && len(report.Issues) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+const testWork = "urn:cts:sktlit:skt0001.nyaya002.M3D:"
+
+// testCEX holds a work of four passages whose references sort differently as keys and as numbers.
+const testCEX = `#!cexversion
+3.0
+
+#!ctscatalog
+urn#citationScheme#groupName#workTitle#versionLabel#exemplarLabel#online#lang
+urn:cts:sktlit:skt0001.nyaya002.M3D:#adhyāya.sūtra#Nyāya#Nyāyasūtra#Manuscript M3##true#san
+
+#!ctsdata
+urn:cts:sktlit:skt0001.nyaya002.M3D:1.1#prathamam
+urn:cts:sktlit:skt0001.nyaya002.M3D:1.2#dvitīyam
+urn:cts:sktlit:skt0001.nyaya002.M3D:1.9#navamam
+urn:cts:sktlit:skt0001.nyaya002.M3D:1.10#daśamam
+`
+
+// putPassages stores passages under the given keys of the bucket of work, bypassing all checks.
+func putPassages(t *testing.T, db *UserDB, work string, passages map[string]gocite.Passage) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(work))
+		if err != nil {
+			return err
+		}
+		for key, passage := range passages {
+			value, _ := json.Marshal(passage)
+			err = bucket.Put([]byte(key), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getPassage returns the passage stored under key in the bucket of work.
+func getPassage(t *testing.T, db *UserDB, work, key string) (gocite.Passage, bool) {
+	t.Helper()
+	var passage gocite.Passage
+	var found bool
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(work))
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get([]byte(key))
+		found = value != nil
+		if !found {
+			return nil
+		}
+		return json.Unmarshal(value, &passage)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return passage, found
+}
+
+// readingOrder returns the references of the passages of work in their reading order
+// and fails the test if their Index does not match it.
+func readingOrder(t *testing.T, db *UserDB, work string) []string {
+	t.Helper()
+	var references []string
+	db.View(func(tx *bolt.Tx) error {
+		for i, passage := range bucketPassages(tx.Bucket([]byte(work))) {
+			if passage.Index != i {
+				t.Errorf("%s has index %d at position %d", passage.PassageID, passage.Index, i)
+			}
+			references = append(references, passageReference(passage.PassageID))
+		}
+		return nil
+	})
+	return references
+}
+
+// scrambleWork gives the passages of testWork an Index order (1.2, 1.9, 1.1, 1.10) and
+// a chain (1.9, 1.1, 1.10, 1.2) that differ from each other and from the orders of
+// their references and keys.
+func scrambleWork(t *testing.T, db *UserDB) {
+	t.Helper()
+	link := func(reference string) gocite.PassLoc {
+		if reference == "" {
+			return gocite.PassLoc{}
+		}
+		return gocite.PassLoc{Exists: true, PassageID: testWork + reference}
+	}
+	passages := make(map[string]gocite.Passage)
+	for _, p := range []struct {
+		reference, prev, next string
+		index                 int
+	}{
+		{"1.1", "1.9", "1.10", 2},
+		{"1.2", "1.10", "", 0},
+		{"1.9", "", "1.1", 1},
+		{"1.10", "1.1", "1.2", 3},
+	} {
+		passage, _ := getPassage(t, db, testWork, testWork+p.reference)
+		passage.Index, passage.Prev, passage.Next = p.index, link(p.prev), link(p.next)
+		passages[passage.PassageID] = passage
+	}
+	putPassages(t, db, testWork, passages)
+}
+
+func TestRepairIntegrityOrderings(t *testing.T) {
+	tests := []struct {
+		ordering string
+		want     []string
+	}{
+		{orderingIndex, []string{"1.2", "1.9", "1.1", "1.10"}},
+		{orderingChain, []string{"1.9", "1.1", "1.10", "1.2"}},
+		{orderingURN, []string{"1.1", "1.2", "1.9", "1.10"}},
+		{orderingKey, []string{"1.1", "1.10", "1.2", "1.9"}},
+	}
+	if len(tests) != len(integrityOrderings) {
+		t.Fatalf("%d orderings tested, %d exist", len(tests), len(integrityOrderings))
+	}
+	for _, test := range tests {
+		t.Run(test.ordering, func(t *testing.T) {
+			db := loadTestCEX(t, testCEX)
+			scrambleWork(t, db)
+			err := repairIntegrity(db, nil, test.ordering)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readingOrder(t, db, testWork); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("order %v, want %v", got, test.want)
+			}
+			report, err := checkIntegrity(db)
+			if err != nil || len(report.Issues) != 0 {
+				t.Errorf("issues after the repair: %+v, %v", report.Issues, err)
+			}
+		})
+	}
+
+	db := loadTestCEX(t, testCEX)
+	if err := repairIntegrity(db, nil, "date"); err == nil {
+		t.Error("repairIntegrity accepted an unknown ordering")
+	}
+	if err := repairIntegrity(db, []string{"urn:cts:sktlit:skt0001.nyaya002.J1D:"}, orderingURN); err == nil {
+		t.Error("repairIntegrity accepted an unknown work")
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	report, err := checkIntegrity(db)
+	if err != nil || report.Works != 1 || report.Passages != 4 || len(report.Issues) != 0 {
+		t.Fatalf("report of the imported work: %+v, %v", report, err)
+	}
+
+	scrambleWork(t, db)
+	report, err = checkIntegrity(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Index 1.2 < 1.9 < 1.1 < 1.10 is unique, the chain 1.9 -> 1.1 -> 1.10 -> 1.2 complete
+	if len(report.Issues) != 0 {
+		t.Errorf("issues of a consistently scrambled work: %+v", report.Issues)
+	}
+
+	first, _ := getPassage(t, db, testWork, testWork+"1.1")
+	first.Index = 0
+	putPassages(t, db, testWork, map[string]gocite.Passage{testWork + "1.1": first})
+	report, _ = checkIntegrity(db)
+	if len(report.Issues) != 1 || report.Issues[0].Kind != issueDuplicateIndex {
+		t.Errorf("issues with a shared index: %+v", report.Issues)
+	}
+}
+
+func TestRepairIntegrityDuplicates(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	const collection = "urn:cite2:test:img.v1:"
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("imgCollection"))
+		if err != nil {
+			return err
+		}
+		value, _ := json.Marshal(imageCollection{URN: collection, Collection: []image{{URN: collection + "f1"}}})
+		return bucket.Put([]byte(collection), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := getPassage(t, db, testWork, testWork+"1.1")
+	copied := first
+	copied.ImageLinks = []gocite.Triple{{Subject: first.PassageID, Verb: "urn:cite2:dse:verbs.v1:appears_on",
+		Object: collection + "f1@0.1,0.1,0.2,0.2"}}
+	differing := first
+	differing.Text = gocite.EncText{Brucheion: "anyat", TXT: "anyat"}
+	putPassages(t, db, testWork, map[string]gocite.Passage{"copy": copied, "differing": differing})
+
+	report, _ := checkIntegrity(db)
+	kinds := make(map[string]int)
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	if kinds[issueForeignPassage] != 2 || kinds[issueDuplicatePassage] != 2 {
+		t.Errorf("issues before the repair: %+v", report.Issues)
+	}
+
+	err = repairIntegrity(db, nil, orderingChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := getPassage(t, db, testWork, "copy"); found {
+		t.Error("the copy with the same text was not merged")
+	}
+	merged, _ := getPassage(t, db, testWork, testWork+"1.1")
+	if !reflect.DeepEqual(merged.ImageLinks, copied.ImageLinks) || merged.Text != first.Text {
+		t.Errorf("merged passage %+v", merged)
+	}
+	if _, found := getPassage(t, db, testWork, "differing"); !found {
+		t.Error("the copy with another text was not left in place")
+	}
+	report, _ = checkIntegrity(db)
+	for _, issue := range report.Issues {
+		if issue.Kind != issueDuplicatePassage && issue.Kind != issueForeignPassage {
+			t.Errorf("unexpected issue after the repair: %+v", issue)
+		}
+	}
+	if len(report.Issues) != 2 {
+		t.Errorf("issues after the repair: %+v, want the differing copy reported", report.Issues)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error { return tx.Bucket([]byte(testWork)).Delete([]byte("differing")) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readingOrder(t, db, testWork), []string{"1.1", "1.2", "1.9", "1.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+}
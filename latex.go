@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// latexEscaper escapes the characters that have a meaning in LaTeX
+var latexEscaper = strings.NewReplacer(`\`, `\textbackslash{}`, `{`, `\{`, `}`, `\}`, `$`, `\$`, `&`, `\&`,
+	`%`, `\%`, `#`, `\#`, `_`, `\_`, `^`, `\textasciicircum{}`, `~`, `\textasciitilde{}`)
+
+// latexText returns s escaped as LaTeX text.
+func latexText(s string) string {
+	return latexEscaper.Replace(s)
+}
+
+// latexReading returns a variant reading as it is printed in the footnotes of the apparatus,
+// followed by the sigla of its witnesses.
+func latexReading(reading Reading) string {
+	text := latexText(reading.Text)
+	switch reading.Type {
+	case variantOmission:
+		text = `\textit{om.}`
+	case variantAddition:
+		text = `\textit{add.} ` + text
+	case variantTransposition:
+		text += ` \textit{transp.}`
+	}
+	return text + " " + latexText(strings.Join(reading.Witnesses, " "))
+}
+
+// writeLaTeX writes edition to w as a LaTeX document for reledmac: the base text of every passage
+// is a numbered paragraph in which the lemmata with variants are \edtext with the readings in an
+// \Afootnote, and the folio markers of the base text are \ledsidenote. It is typeset with XeLaTeX
+// or LuaLaTeX for the Unicode text.
+func writeLaTeX(w io.Writer, edition Edition) error {
+	out := bufio.NewWriter(w)
+	title := edition.Catalog.WorkTitle
+	if title == "" {
+		title = edition.Work
+	}
+	out.WriteString("% " + edition.Work + " exported from Brucheion\n")
+	out.WriteString("% Typeset with XeLaTeX or LuaLaTeX.\n")
+	out.WriteString("\\documentclass{article}\n\\usepackage{fontspec}\n\\usepackage{reledmac}\n\n")
+	out.WriteString("\\title{" + latexText(title) + "}\n")
+	if edition.Catalog.GroupName != "" {
+		out.WriteString("\\author{" + latexText(edition.Catalog.GroupName) + "}\n")
+	}
+	out.WriteString("\\date{}\n\n\\begin{document}\n\\maketitle\n\n")
+	out.WriteString("\\section*{Sigla}\n\\begin{description}\n")
+	for _, witness := range edition.Witnesses {
+		out.WriteString("  \\item[" + latexText(witness.Siglum) + "] " + latexText(witnessLabel(witness)) + "\n")
+	}
+	out.WriteString("\\end{description}\n\n\\beginnumbering\n")
+
+	for _, passage := range edition.Passages {
+		out.WriteString("% " + passage.URN + "\n\\pstart\n")
+		words := 0
+		folios := func(upTo int) {
+			for ; words <= upTo; words++ {
+				for _, folio := range passage.Folios[words] {
+					out.WriteString("\\ledsidenote{" + latexText(folio) + "}")
+				}
+			}
+		}
+		for i, lemma := range passage.Apparatus.Lemmata {
+			if i > 0 {
+				out.WriteString(" ")
+			}
+			if lemma.Text != "" {
+				folios(words)
+			}
+			text := latexText(lemma.Text)
+			if len(lemma.Readings) > 0 {
+				var readings []string
+				for _, reading := range lemma.Readings {
+					readings = append(readings, latexReading(reading))
+				}
+				note := "\\Afootnote{" + strings.Join(readings, "; ") + "}"
+				if lemma.Text == "" {
+					note = "\\lemma{$\\wedge$}" + note //the witnesses add words here
+				}
+				text = "\\edtext{" + text + "}{" + note + "}"
+			}
+			out.WriteString(text)
+		}
+		last := 0
+		for n := range passage.Folios {
+			last = maxInt(last, n)
+		}
+		folios(last) //the markers after the last word
+		out.WriteString("\n\\pend\n\n")
+	}
+	out.WriteString("\\endnumbering\n\\end{document}\n")
+	return out.Flush()
+}
+
+// handleLaTeXExport returns the collation of the passage or work {urn} as a LaTeX document
+// for typesetting the critical edition with reledmac.
+func handleLaTeXExport(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	siglum, err := loadSigla(db)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	edition, ok := loadRequestedEdition(w, r, db, siglum)
+	if !ok {
+		return
+	}
+	var content bytes.Buffer
+	err = writeLaTeX(&content, edition)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tex; charset=utf-8")
+	w.Header().Set("Content-Disposition", "Attachment; filename="+exportFilename(mux.Vars(r)["urn"], ".tex"))
+	w.Write(content.Bytes())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLaTeXText(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"saṃśaya", "saṃśaya"},
+		{`50% & $5_a #1`, `50\% \& \$5\_a \#1`},
+		{`{x} \ ^ ~`, `\{x\} \textbackslash{} \textasciicircum{} \textasciitilde{}`},
+	}
+	for _, test := range tests {
+		if got := latexText(test.text); got != test.want {
+			t.Errorf("latexText(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestFolioPositions(t *testing.T) {
+	settings := defaultAlignmentSettings()
+	tests := []struct {
+		text string
+		want map[int][]string
+	}{
+		{"tathā api", map[int][]string{}},
+		{"{1v}tathā api", map[int][]string{0: {"1v"}}},
+		{"tathā {2r}api", map[int][]string{1: {"2r"}}},
+		{"tathā api{2r}", map[int][]string{2: {"2r"}}},
+		{"ta{2r}thā api", map[int][]string{0: {"2r"}}}, //within a word: before that word
+		{"tathā {2r}{2v}api", map[int][]string{1: {"2r", "2v"}}},
+	}
+	for _, test := range tests {
+		if got := folioPositions(test.text, settings); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("folioPositions(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestWriteLaTeX(t *testing.T) {
+	edition := testEdition()
+	edition.Witnesses[1].Siglum = "C_1"
+	edition.Passages[0].Apparatus.Lemmata[0].Readings[0].Witnesses = []string{"C_1"}
+	var out bytes.Buffer
+	err := writeLaTeX(&out, edition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`\title{Nyāya \& <sūtra>}`,
+		`\item[C\_1] urn:cts:sktlit:skt0001.nyaya002.C3D:`,
+		`\edtext{a<b}{\Afootnote{a>b C\_1}} \ledsidenote{2r}c\&d`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("writeLaTeX output lacks %s:\n%s", want, out.String())
+		}
+	}
+}
@@ -142,7 +142,7 @@ func loginPOST(res http.ResponseWriter, req *http.Request) {
 					BUserName: lp.BUserName,
 					Provider:  "noAuth"}
 				if !validation.BUserInUse { // create new noAuth user if the username was not in use
-					db, err := openBoltDB(config.UserDB) //open bolt DB using helper function
+					db, err := sharedDBs.Open(config.UserDB) //open bolt DB using helper function
 					if err != nil {
 						log.Println(fmt.Printf("loginPOST: error opening userDB: %s", err))
 						http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -309,7 +309,7 @@ func authCallback(res http.ResponseWriter, req *http.Request) {
 		log.Println(validation.Message) //Display validation.Message if all went well.
 	} else if !validation.BUserInUse && !validation.SameProvider && !validation.PUserInUse { //Login scenario (5)
 		//create new entry for new BUser
-		db, err := openBoltDB(config.UserDB) //open bolt DB using helper function
+		db, err := sharedDBs.Open(config.UserDB) //open bolt DB using helper function
 		if err != nil {
 			log.Println(fmt.Printf("authCallback: error opening userDB: %s", err))
 			http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -446,10 +446,14 @@ func testLoginStatus(function string, session *sessions.Session) (user, message
 }
 
 // getSessionUser retrieves the Brucheion user name from a HTTP request. If it
-// was properly validated with requireAuth, the request session should
-// be available in the request context. If not, the function will throw an
-// error.
+// was properly validated with requireAuth, the user of the API token or the request
+// session should be available in the request context. If not, the function will
+// throw an error.
 func getSessionUser(r *http.Request) (user string, err error) {
+	if user, ok := r.Context().Value(tokenUserKey).(string); ok {
+		return user, nil
+	}
+
 	session, ok := r.Context().Value("session").(*sessions.Session)
 	if !ok {
 		return "", errors.New("could not retrieve request session")
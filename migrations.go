@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// Buckets of a user database that do not hold works
+const (
+	metadataBucket = "metadata" //schema version of the database
+	catalogBucket  = "catalog"  //catalog entries (BoltCatalog) by work URN
+)
+
+// schemaVersionKey is the key of the schema version in the metadata bucket
+const schemaVersionKey = "schemaVersion"
+
+// migration converts a user database from schema version-1 to version.
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// userDBMigrations lists the migrations of user databases in the order they are applied.
+// New migrations are appended with the next version number; existing ones must not change.
+var userDBMigrations = []migration{
+	{1, "move the catalog entries into the catalog bucket", migrateCatalog},
+	{2, "store image collections and alignments as JSON", migrateGobToJSON},
+	{3, "convert BoltURN passages to gocite.Passage", migrateBoltURNs},
+	{4, "record the first and last passage of every work", migrateWorkBounds},
+}
+
+// schemaVersion returns the schema version of a user database, 0 if it has none.
+func schemaVersion(tx *bolt.Tx) int {
+	bucket := tx.Bucket([]byte(metadataBucket))
+	if bucket == nil {
+		return 0
+	}
+	version := 0
+	json.Unmarshal(bucket.Get([]byte(schemaVersionKey)), &version)
+	return version
+}
+
+// setSchemaVersion saves the schema version of a user database.
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+	if err != nil {
+		return err
+	}
+	value, _ := json.Marshal(version)
+	return bucket.Put([]byte(schemaVersionKey), value)
+}
+
+// migrateUserDB applies the pending migrations to db. Every migration runs in a transaction
+// of its own together with the update of the schema version, so a failed migration leaves
+// the database at the last successful version.
+func migrateUserDB(db *bolt.DB) error {
+	for _, m := range userDBMigrations {
+		err := db.Update(func(tx *bolt.Tx) error {
+			if schemaVersion(tx) >= m.version {
+				return nil
+			}
+			log.Printf("migrateUserDB: %s: migration %d: %s\n", db.Path(), m.version, m.description)
+			err := m.migrate(tx)
+			if err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return fmt.Errorf("migrateUserDB: migration %d of %s failed: %s", m.version, db.Path(), err)
+		}
+	}
+	return nil
+}
+
+// migratedView begins a transaction of db showing it with all migrations applied. Pending
+// migrations are applied within a writable transaction, which must be rolled back like a
+// read-only one, so that db itself is left unchanged.
+func migratedView(db *bolt.DB) (*bolt.Tx, error) {
+	tx, err := db.Begin(false)
+	if err != nil || schemaVersion(tx) >= userDBMigrations[len(userDBMigrations)-1].version {
+		return tx, err
+	}
+	tx.Rollback()
+	tx, err = db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range userDBMigrations {
+		if schemaVersion(tx) >= m.version {
+			continue
+		}
+		err = m.migrate(tx)
+		if err == nil {
+			err = setSchemaVersion(tx, m.version)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("migration %d of %s failed: %s", m.version, db.Path(), err)
+		}
+	}
+	return tx, nil
+}
+
+// workBuckets returns the names of the buckets holding works.
+func workBuckets(tx *bolt.Tx) []string {
+	var works []string
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if gocite.IsCTSURN(string(name)) {
+			works = append(works, string(name))
+		}
+		return nil
+	})
+	return works
+}
+
+// migrateCatalog moves the catalog entries stored under the work URN in the bucket of the work,
+// and the gob-encoded cexMeta entries of the meta bucket, into the catalog bucket.
+// Entries in the work buckets take precedence.
+func migrateCatalog(tx *bolt.Tx) error {
+	catalog, err := tx.CreateBucketIfNotExists([]byte(catalogBucket))
+	if err != nil {
+		return err
+	}
+	for _, work := range workBuckets(tx) {
+		bucket := tx.Bucket([]byte(work))
+		value := bucket.Get([]byte(work))
+		if value == nil {
+			continue
+		}
+		err = catalog.Put([]byte(work), append([]byte{}, value...))
+		if err != nil {
+			return err
+		}
+		err = bucket.Delete([]byte(work))
+		if err != nil {
+			return err
+		}
+	}
+
+	meta := tx.Bucket([]byte("meta"))
+	if meta == nil {
+		return nil
+	}
+	err = meta.ForEach(func(key, value []byte) error {
+		if catalog.Get(key) != nil {
+			return nil
+		}
+		var m cexMeta
+		err := gob.NewDecoder(bytes.NewReader(value)).Decode(&m)
+		if err != nil {
+			return fmt.Errorf("decoding work metadata %s failed: %s", key, err)
+		}
+		entry, _ := json.Marshal(cexMetaToCatalog(m))
+		return catalog.Put(append([]byte{}, key...), entry)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBucket([]byte("meta"))
+}
+
+// migrateGobToJSON re-encodes the gob values of the imgCollection and alignmentsCollection buckets as JSON.
+func migrateGobToJSON(tx *bolt.Tx) error {
+	decoders := map[string]func([]byte) (interface{}, error){
+		"imgCollection":  func(data []byte) (interface{}, error) { return gobDecodeImgCol(data) },
+		alignmentsBucket: func(data []byte) (interface{}, error) { return gobDecodeAlignments(data) },
+	}
+	for name, decode := range decoders {
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			continue
+		}
+		converted := make(map[string][]byte)
+		err := bucket.ForEach(func(key, value []byte) error {
+			if json.Valid(value) {
+				return nil
+			}
+			decoded, err := decode(value)
+			if err != nil {
+				return fmt.Errorf("decoding %s in %s failed: %s", key, name, err)
+			}
+			converted[string(key)], err = json.Marshal(decoded)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for key, value := range converted {
+			err = bucket.Put([]byte(key), value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateBoltURNs converts passages still stored as BoltURN into gocite.Passage
+// and relinks the works they belong to.
+func migrateBoltURNs(tx *bolt.Tx) error {
+	for _, work := range workBuckets(tx) {
+		bucket := tx.Bucket([]byte(work))
+		converted := make(map[string]gocite.Passage)
+		err := bucket.ForEach(func(key, value []byte) error {
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(value, &fields) != nil {
+				return nil
+			}
+			if _, ok := fields["PassageID"]; ok {
+				return nil
+			}
+			if _, ok := fields["urn"]; !ok {
+				return nil
+			}
+			var legacy BoltURN
+			err := json.Unmarshal(value, &legacy)
+			if err != nil {
+				return fmt.Errorf("decoding passage %s failed: %s", key, err)
+			}
+			converted[string(key)] = boltURNToPassage(legacy)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(converted) == 0 {
+			continue
+		}
+		for key, passage := range converted {
+			value, _ := json.Marshal(passage)
+			err = bucket.Put([]byte(key), value)
+			if err != nil {
+				return err
+			}
+		}
+		for _, passage := range linkPassages(work, bucketPassages(bucket)).Passages {
+			value, _ := json.Marshal(passage)
+			err = bucket.Put([]byte(passage.PassageID), value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// boltURNToPassage converts a legacy BoltURN into a gocite.Passage.
+func boltURNToPassage(legacy BoltURN) gocite.Passage {
+	text := legacy.Text
+	if len(legacy.LineText) > 0 {
+		text = strings.Join(legacy.LineText, "\r\n")
+	}
+	passage := gocite.Passage{PassageID: legacy.URN,
+		Text:  gocite.EncText{Brucheion: strings.Replace(text, "\r\n", "", -1), TXT: text},
+		Index: legacy.Index,
+		Prev:  gocite.PassLoc{Exists: legacy.Previous != "", PassageID: legacy.Previous},
+		Next:  gocite.PassLoc{Exists: legacy.Next != "", PassageID: legacy.Next}}
+	for _, image := range legacy.ImageRef {
+		passage.ImageLinks = append(passage.ImageLinks, gocite.Triple{Subject: legacy.URN,
+			Verb:   "urn:cite2:dse:verbs.v1:appears_on",
+			Object: image})
+	}
+	return passage
+}
+
+// migrateWorkBounds records the WorkBounds of every work.
+func migrateWorkBounds(tx *bolt.Tx) error {
+	for _, work := range workBuckets(tx) {
+		err := updateWorkBounds(tx, work)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	legacyWork  = "urn:cts:sktlit:skt0001.nyaya002.M3D5:"
+	legacyOther = "urn:cts:sktlit:skt0001.nyaya002.J1D:"
+)
+
+// writeLegacyDB creates a user database at path the way Brucheion stored it before schema
+// versions existed: the catalog entry of a work under the work URN in its bucket, work metadata
+// as gob-encoded cexMeta in the meta bucket, gob-encoded image collections and alignments,
+// and passages as BoltURN.
+func writeLegacyDB(t *testing.T, path string) {
+	t.Helper()
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	gobEncode := func(v interface{}) []byte {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	jsonEncode := func(v interface{}) []byte {
+		value, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	puts := []struct {
+		bucket, key string
+		value       []byte
+	}{
+		{legacyWork, legacyWork, jsonEncode(BoltCatalog{URN: legacyWork, WorkTitle: "Nyāyabhāṣya"})},
+		{legacyWork, legacyWork + "1.1", jsonEncode(BoltURN{URN: legacyWork + "1.1", Text: "prathamam",
+			Next: legacyWork + "1.2", Index: 1, ImageRef: []string{"urn:cite2:test:img.v1:f1"}})},
+		{legacyWork, legacyWork + "1.2", jsonEncode(BoltURN{URN: legacyWork + "1.2",
+			LineText: []string{"dvitīyam", "tṛtīyam"}, Previous: legacyWork + "1.1", Index: 2})},
+		{legacyOther, legacyOther + "1.1", jsonEncode(gocite.Passage{PassageID: legacyOther + "1.1",
+			Text: gocite.EncText{Brucheion: "anyat", TXT: "anyat"}})},
+		{"meta", legacyWork, gobEncode(cexMeta{URN: legacyWork, WorkTitle: "overridden"})},
+		{"meta", legacyOther, gobEncode(cexMeta{URN: legacyOther, WorkTitle: "Nyāyasūtra", Language: "san"})},
+		{"imgCollection", "urn:cite2:test:img.v1:", gobEncode(imageCollection{URN: "urn:cite2:test:img.v1:",
+			Collection: []image{{URN: "urn:cite2:test:img.v1:f1", Protocol: "static"}}})},
+		{alignmentsBucket, legacyWork + "1.1", gobEncode(Alignments{AlignmentID: legacyWork + "1.1",
+			Name: []string{legacyWork + "1.1", legacyOther + "1.1"}})},
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, put := range puts {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(put.bucket))
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(put.key), put.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateUserDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	writeLegacyDB(t, path)
+	repo := newRepository(1, migrateUserDB)
+	defer repo.CloseAll()
+	db, err := repo.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		if got, want := schemaVersion(tx), userDBMigrations[len(userDBMigrations)-1].version; got != want {
+			t.Errorf("schema version %d, want %d", got, want)
+		}
+
+		//migration 1: the catalog
+		if tx.Bucket([]byte("meta")) != nil {
+			t.Error("meta bucket not deleted")
+		}
+		if tx.Bucket([]byte(legacyWork)).Get([]byte(legacyWork)) != nil {
+			t.Error("catalog entry left in the work bucket")
+		}
+		catalog := tx.Bucket([]byte(catalogBucket))
+		for _, want := range []BoltCatalog{
+			{URN: legacyWork, WorkTitle: "Nyāyabhāṣya"},
+			{URN: legacyOther, WorkTitle: "Nyāyasūtra", Language: "san"},
+		} {
+			var got BoltCatalog
+			err := json.Unmarshal(catalog.Get([]byte(want.URN)), &got)
+			if err != nil || got != want {
+				t.Errorf("catalog entry of %s = %+v, %v, want %+v", want.URN, got, err, want)
+			}
+		}
+
+		//migration 2: gob to JSON
+		collection, err := decodeImgCol(tx.Bucket([]byte("imgCollection")).Get([]byte("urn:cite2:test:img.v1:")))
+		if err != nil || len(collection.Collection) != 1 || collection.Collection[0].Protocol != "static" {
+			t.Errorf("image collection = %+v, %v", collection, err)
+		}
+		alignments, err := decodeAlignments(tx.Bucket([]byte(alignmentsBucket)).Get([]byte(legacyWork + "1.1")))
+		if err != nil || alignments.AlignmentID != legacyWork+"1.1" || len(alignments.Name) != 2 {
+			t.Errorf("alignments = %+v, %v", alignments, err)
+		}
+
+		//migration 3: BoltURN to gocite.Passage
+		passages := bucketPassages(tx.Bucket([]byte(legacyWork)))
+		want := []gocite.Passage{
+			{PassageID: legacyWork + "1.1", Text: gocite.EncText{Brucheion: "prathamam", TXT: "prathamam"},
+				Index: 0, Next: gocite.PassLoc{Exists: true, PassageID: legacyWork + "1.2", Index: 1},
+				ImageLinks: []gocite.Triple{{Subject: legacyWork + "1.1", Verb: "urn:cite2:dse:verbs.v1:appears_on",
+					Object: "urn:cite2:test:img.v1:f1"}}},
+			{PassageID: legacyWork + "1.2", Text: gocite.EncText{Brucheion: "dvitīyamtṛtīyam", TXT: "dvitīyam\r\ntṛtīyam"},
+				Index: 1, Prev: gocite.PassLoc{Exists: true, PassageID: legacyWork + "1.1", Index: 0}},
+		}
+		if !reflect.DeepEqual(passages, want) {
+			t.Errorf("passages = %+v, want %+v", passages, want)
+		}
+		if other := bucketPassages(tx.Bucket([]byte(legacyOther))); len(other) != 1 || other[0].Text.TXT != "anyat" {
+			t.Errorf("passages of %s = %+v", legacyOther, other)
+		}
+
+		//migration 4: work bounds
+		for _, want := range []WorkBounds{
+			{Work: legacyWork, First: legacyWork + "1.1", Last: legacyWork + "1.2", Count: 2},
+			{Work: legacyOther, First: legacyOther + "1.1", Last: legacyOther + "1.1", Count: 1},
+		} {
+			if got, ok := recordedBounds(tx, want.Work); !ok || got != want {
+				t.Errorf("bounds of %s = %+v, %v, want %+v", want.Work, got, ok, want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateUserDBUpToDate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	writeLegacyDB(t, path)
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = migrateUserDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before []byte
+	db.View(func(tx *bolt.Tx) error {
+		before = append(before, tx.Bucket([]byte(legacyWork)).Get([]byte(legacyWork+"1.2"))...)
+		return nil
+	})
+	err = migrateUserDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if after := tx.Bucket([]byte(legacyWork)).Get([]byte(legacyWork + "1.2")); !bytes.Equal(before, after) {
+			t.Errorf("passage changed by a second migration: %s, was %s", after, before)
+		}
+		return nil
+	})
+}
+
+func TestReportCEXDoesNotMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	writeLegacyDB(t, path)
+	defer userDBs.CloseAll()
+	cex := &CEXData{Passages: []CEXPassage{
+		{URN: legacyWork + "1.2", Text: "dvitīyam-NEWLINE-tṛtīyam", Line: 3},
+		{URN: legacyWork + "1.1", Text: "navam", Line: 4},
+	}}
+	report, err := reportCEX(cex, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CEXConflict{{Line: 4, URN: legacyWork + "1.1", Existing: "prathamam", Incoming: "navam"}}
+	if !reflect.DeepEqual(report.Conflicts, want) {
+		t.Errorf("conflicts = %+v, want %+v", report.Conflicts, want)
+	}
+	if len(report.Works) != 1 || !report.Works[0].Exists {
+		t.Errorf("works = %+v", report.Works)
+	}
+
+	userDBs.CloseAll()
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		if version := schemaVersion(tx); version != 0 {
+			t.Errorf("schema version %d after reportCEX, want 0", version)
+		}
+		if tx.Bucket([]byte("meta")) == nil || tx.Bucket([]byte(catalogBucket)) != nil {
+			t.Error("catalog migrated by reportCEX")
+		}
+		return nil
+	})
+}
@@ -47,6 +47,7 @@ type Transcription struct {
 	ImageRef      []string
 	TextRef       []string
 	ImageJS       string
+	Version       int //version of the passage the transcription is based on
 	CatID         string
 	CatCit        string
 	CatGroup      string
@@ -111,6 +112,7 @@ type Page struct {
 	Last         string
 	Host         string
 	ImageRef     string
+	Version      int
 	CatID        string
 	CatCit       string
 	CatGroup     string
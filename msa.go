@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// minWitnessLength is the number of characters (without spaces) a passage needs to be collated as a witness
+const minWitnessLength = 6
+
+// AlignmentTable is the multiple alignment of the witnesses of a passage: every row holds the words
+// of one witness, the words in the same column are aligned with each other, and gaps are empty strings.
+type AlignmentTable struct {
+	Witnesses []string          `json:"witnesses"` //passage URNs, the base text first
+	Rows      [][]string        `json:"rows"`
+	Settings  AlignmentSettings `json:"settings"`
+}
+
+// profile is a multiple alignment of some of the texts during the progressive alignment.
+type profile struct {
+	members []int      //indices of the aligned texts
+	columns [][]string //a word (or "" for a gap) per member
+}
+
+// wordScorer scores aligned words with the settings of a collation, remembering the scores
+// of the word pairs already seen.
+type wordScorer struct {
+	settings AlignmentSettings
+	scores   map[[2]string]float64
+}
+
+func newWordScorer(settings AlignmentSettings) *wordScorer {
+	return &wordScorer{settings: settings, scores: make(map[[2]string]float64)}
+}
+
+// score returns the score of aligning the words a and b: Match for equal words, Gap plus GapOpen against a gap,
+// and between Mismatch and Match by how much similar words differ.
+func (ws *wordScorer) score(a, b string) float64 {
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "" || b == "":
+		return float64(ws.settings.Gap + ws.settings.GapOpen)
+	case a == b:
+		return float64(ws.settings.Match)
+	}
+	key := [2]string{a, b}
+	if b < a {
+		key = [2]string{b, a}
+	}
+	score, ok := ws.scores[key]
+	if !ok {
+		similarity := 1 - float64(alignmentDistance(a, b, ws.settings))
+		score = float64(ws.settings.Mismatch) + float64(ws.settings.Match-ws.settings.Mismatch)*similarity
+		ws.scores[key] = score
+	}
+	return score
+}
+
+// columnScore returns the sum-of-pairs score of aligning the profile columns a and b,
+// averaged over the word pairs.
+func (ws *wordScorer) columnScore(a, b []string) float64 {
+	var sum float64
+	for _, x := range a {
+		for _, y := range b {
+			sum += ws.score(x, y)
+		}
+	}
+	return sum / float64(len(a)*len(b))
+}
+
+// alignProfiles aligns the profiles p and q with the Needleman-Wunsch algorithm over their
+// columns and returns the profile of all their members.
+func (ws *wordScorer) alignProfiles(p, q profile) profile {
+	gapP, gapQ := make([]string, len(p.members)), make([]string, len(q.members))
+	n, m := len(p.columns), len(q.columns)
+	score := make([][]float64, n+1)
+	for i := range score {
+		score[i] = make([]float64, m+1)
+		if i > 0 {
+			score[i][0] = score[i-1][0] + ws.columnScore(p.columns[i-1], gapQ)
+		}
+	}
+	for j := 1; j <= m; j++ {
+		score[0][j] = score[0][j-1] + ws.columnScore(gapP, q.columns[j-1])
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			score[i][j] = score[i-1][j-1] + ws.columnScore(p.columns[i-1], q.columns[j-1])
+			if up := score[i-1][j] + ws.columnScore(p.columns[i-1], gapQ); up > score[i][j] {
+				score[i][j] = up
+			}
+			if left := score[i][j-1] + ws.columnScore(gapP, q.columns[j-1]); left > score[i][j] {
+				score[i][j] = left
+			}
+		}
+	}
+
+	result := profile{members: append(append([]int{}, p.members...), q.members...)}
+	const epsilon = 1e-9
+	i, j := n, m
+	for i > 0 || j > 0 {
+		var column []string
+		switch {
+		case i > 0 && j > 0 && score[i][j] <= score[i-1][j-1]+ws.columnScore(p.columns[i-1], q.columns[j-1])+epsilon:
+			column = append(append(column, p.columns[i-1]...), q.columns[j-1]...)
+			i, j = i-1, j-1
+		case i > 0 && (j == 0 || score[i][j] <= score[i-1][j]+ws.columnScore(p.columns[i-1], gapQ)+epsilon):
+			column = append(append(column, p.columns[i-1]...), gapQ...)
+			i--
+		default:
+			column = append(append(column, gapP...), q.columns[j-1]...)
+			j--
+		}
+		result.columns = append(result.columns, column)
+	}
+	for a, b := 0, len(result.columns)-1; a < b; a, b = a+1, b-1 {
+		result.columns[a], result.columns[b] = result.columns[b], result.columns[a]
+	}
+	return result
+}
+
+// distance returns the share of columns in which the words of the single texts p and q
+// differ after aligning them, from 0 (equal) to 1.
+func (ws *wordScorer) distance(p, q profile) float64 {
+	aligned := ws.alignProfiles(p, q)
+	if len(aligned.columns) == 0 {
+		return 0
+	}
+	differing := 0
+	for _, column := range aligned.columns {
+		if column[0] != column[1] {
+			differing++
+		}
+	}
+	return float64(differing) / float64(len(aligned.columns))
+}
+
+// alignWitnesses aligns the words of texts with each other following settings and returns
+// a row of words per text, in the order of texts, all of the same length. Gaps are empty strings.
+// The words are split at white space (and daṇḍas unless the tokenizer is whitespace) whatever
+// the tokenizer; it only decides how similar two words score.
+// The texts are aligned progressively: the two closest texts or groups of already aligned
+// texts are aligned first, and the distances to the new group are averaged (UPGMA).
+func alignWitnesses(texts []string, settings AlignmentSettings) [][]string {
+	ws := newWordScorer(settings)
+	var clusters []profile
+	for i, text := range texts {
+		cluster := profile{members: []int{i}}
+		for _, word := range strings.Fields(prepareText(text, settings)) {
+			cluster.columns = append(cluster.columns, []string{word})
+		}
+		clusters = append(clusters, cluster)
+	}
+	if len(clusters) == 0 {
+		return [][]string{}
+	}
+
+	distances := make([][]float64, len(clusters))
+	for i := range clusters {
+		distances[i] = make([]float64, len(clusters))
+		for j := 0; j < i; j++ {
+			distances[i][j] = ws.distance(clusters[i], clusters[j])
+			distances[j][i] = distances[i][j]
+		}
+	}
+	active := make([]bool, len(clusters))
+	for i := range active {
+		active[i] = true
+	}
+	last := 0
+	for joined := 1; joined < len(clusters); joined++ {
+		closestI, closestJ := -1, -1
+		for i := range clusters {
+			for j := i + 1; j < len(clusters); j++ {
+				if active[i] && active[j] && (closestI < 0 || distances[i][j] < distances[closestI][closestJ]) {
+					closestI, closestJ = i, j
+				}
+			}
+		}
+		sizeI, sizeJ := float64(len(clusters[closestI].members)), float64(len(clusters[closestJ].members))
+		clusters[closestI] = ws.alignProfiles(clusters[closestI], clusters[closestJ])
+		active[closestJ] = false
+		for k := range clusters {
+			if active[k] && k != closestI {
+				distances[closestI][k] = (distances[closestI][k]*sizeI + distances[closestJ][k]*sizeJ) / (sizeI + sizeJ)
+				distances[k][closestI] = distances[closestI][k]
+			}
+		}
+		last = closestI
+	}
+
+	rows := make([][]string, len(texts))
+	for position, member := range clusters[last].members {
+		rows[member] = make([]string, len(clusters[last].columns))
+		for c, column := range clusters[last].columns {
+			rows[member][c] = column[position]
+		}
+	}
+	return rows
+}
+
+// witnessSiglum returns the short name of the witness with the given passage or work URN,
+// the exemplar part of its work identifier (e.g. M3D of skt0001.nyaya002.M3D).
+func witnessSiglum(urn string) string {
+	parts := strings.Split(urn, ":")
+	if len(parts) < 4 {
+		return urn
+	}
+	work := strings.Split(parts[3], ".")
+	return work[len(work)-1]
+}
+
+// passageWitnesses returns the URNs and texts of the passages with the reference of urn in the
+// other versions of its text group within tx. Passages with (almost) no text are left out.
+func passageWitnesses(tx *bolt.Tx, urn string, settings AlignmentSettings) (ids, texts []string) {
+	parts := strings.Split(urn, ":")
+	if len(parts) < 5 {
+		return nil, nil
+	}
+	textGroup := strings.Split(parts[3], ".")[0]
+	for _, work := range workBuckets(tx) {
+		if work == workBucket(urn) || strings.Split(strings.Split(work, ":")[3], ".")[0] != textGroup {
+			continue
+		}
+		passage, found := bucketPassage(tx.Bucket([]byte(work)), work+parts[4])
+		if !found {
+			continue
+		}
+		text := alignmentText(passage, settings)
+		if len(strings.Replace(text, " ", "", -1)) >= minWitnessLength {
+			ids = append(ids, passage.PassageID)
+			texts = append(texts, text)
+		}
+	}
+	return ids, texts
+}
+
+// bucketPassage returns the passage with the given URN from a work bucket.
+func bucketPassage(bucket *bolt.Bucket, urn string) (gocite.Passage, bool) {
+	var passage gocite.Passage
+	if bucket == nil {
+		return passage, false
+	}
+	value := bucket.Get([]byte(urn))
+	if value == nil || json.Unmarshal(value, &passage) != nil || passage.PassageID == "" {
+		return passage, false
+	}
+	return passage, true
+}
+
+// collatePassage aligns the passage with the given URN with the passages of the same reference
+// in the other versions of its text group.
+func collatePassage(db *UserDB, urn string, settings AlignmentSettings) (AlignmentTable, error) {
+	table := AlignmentTable{Settings: settings}
+	err := db.View(func(tx *bolt.Tx) error {
+		base, found := bucketPassage(tx.Bucket([]byte(workBucket(urn))), urn)
+		if !found {
+			return fmt.Errorf("%s: %w", urn, errPassageNotFound)
+		}
+		ids, texts := passageWitnesses(tx, urn, settings)
+		table.Witnesses = append([]string{urn}, ids...)
+		table.Rows = alignWitnesses(append([]string{alignmentText(base, settings)}, texts...), settings)
+		return nil
+	})
+	return table, err
+}
+
+// handlePassageAlignment returns the AlignmentTable of the passage {urn} with the witnesses of
+// its text group. The alignment settings are chosen like those of the multicompare page.
+func handlePassageAlignment(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	if !gocite.IsCTSURN(urn) || workBucket(urn) == urn {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	settings, err := requestAlignmentSettings(db, workBucket(urn), r.URL.Query())
+	if err != nil {
+		respondWithAlignmentError(w, err)
+		return
+	}
+	table, err := collatePassage(db, urn, settings)
+	switch {
+	case errors.Is(err, errPassageNotFound):
+		respondWithError(w, "passage_not_found", 404)
+	case err != nil:
+		log.Printf("handlePassageAlignment: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	default:
+		respondWithData(w, table, 200)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAlignWitnesses(t *testing.T) {
+	settings := defaultAlignmentSettings()
+	danda := settings
+	danda.Tokenizer = tokenizeDanda
+	tests := []struct {
+		name     string
+		texts    []string
+		settings AlignmentSettings
+		want     [][]string
+	}{
+		{"none", nil, settings, [][]string{}},
+		{"one", []string{"tathā api ca"}, settings, [][]string{{"tathā", "api", "ca"}}},
+		{"empty", []string{"", "ca"}, settings, [][]string{{""}, {"ca"}}},
+		{"equal", []string{"tathā api", "tathā api"}, settings, [][]string{{"tathā", "api"}, {"tathā", "api"}}},
+		{"omission", []string{"tathā api ca", "tathā ca", "tathā api ca"}, settings,
+			[][]string{{"tathā", "api", "ca"}, {"tathā", "", "ca"}, {"tathā", "api", "ca"}}},
+		{"folio markers", []string{"tathā {2r}api", "tathā api"}, settings, [][]string{{"tathā", "api"}, {"tathā", "api"}}},
+		{"dandas", []string{"iti ।", "iti"}, danda, [][]string{{"iti", "।"}, {"iti", ""}}},
+	}
+	for _, test := range tests {
+		if got := alignWitnesses(test.texts, test.settings); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: alignWitnesses(%q) = %q, want %q", test.name, test.texts, got, test.want)
+		}
+	}
+}
@@ -1,337 +1,356 @@
 package main
 
-/* *** This file is completely under construction *** */
-
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/ThomasK81/gocite"
-	/*
-		"encoding/json"
-		"strconv"
-		"strings"
-
-		"github.com/boltdb/bolt"
-
-		"github.com/gorilla/mux"
-
-		"gociteDev/gocite"*/)
-
-//AddFirstNode adds a new passage at the beginning of the work
-func AddFirstNode(res http.ResponseWriter, req *http.Request) {
-	//First get the session..
-	session, err := getSession(req)
-	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Errors of the passage structure operations
+var (
+	errPassageNotFound = errors.New("passage not found")
+	errPassageExists   = errors.New("passage exists already")
+	errBadPassage      = errors.New("bad passage")
+)
+
+// Positions of a passage relative to an anchor passage
+const (
+	positionBefore = "before"
+	positionAfter  = "after"
+)
+
+// WorkOrder lists the passages of a work in reading order.
+type WorkOrder struct {
+	Work     string   `json:"work"`
+	Passages []string `json:"passages"`
+}
 
-	//..and check if user is logged in.
-	user, message, loggedin := testLoginStatus("AddFirstNode", session)
-	if loggedin {
-		log.Println(message)
-	} else {
-		log.Println(message)
-		Logout(res, req)
-		return
+// workOrder returns the reading order of work.
+func workOrder(work gocite.Work) WorkOrder {
+	order := WorkOrder{Work: work.WorkID, Passages: []string{}}
+	for _, passage := range work.Passages {
+		order.Passages = append(order.Passages, passage.PassageID)
 	}
+	return order
+}
 
-	dbName := user + ".db"
-	passage, err := BoltRetrievePassage(dbName, "urn:cts:sktlit:skt0001.nyaya002.msC3D:", "3.1.44")
-
-	log.Printf("Passage received: %s \nIndex: %d\nPrev: %d\nNext: %d\n",
-		passage.PassageID, passage.Index, passage.Prev.Index, passage.Next.Index)
-
-	work, err := BoltRetrieveWork(dbName, "urn:cts:sktlit:skt0001.nyaya002.msC3D:")
-	if err == nil {
-		log.Printf(" Work received: WorkID: %s\nFirst.Index: %d\nFirst.PassageID: %s\nLast.Index: %d\nLast.PassageID: %s\n\n",
-			work.WorkID,
-			work.First.Index, work.First.PassageID,
-			work.Last.Index, work.Last.PassageID)
-		for i := range work.Passages {
-			log.Println(fmt.Printf(" Work received: PassageID: %s\n Index: %d\nPrev.Index: %d\nPrev.PassageID: %s\nNext.Index: %d\nNext.PassageID: %s\n\n",
-				work.Passages[i].PassageID, work.Passages[i].Index,
-				work.Passages[i].Prev.Index, work.Passages[i].Prev.PassageID,
-				work.Passages[i].Next.Index, work.Passages[i].Next.PassageID))
-		}
-	} else {
-		log.Println(err)
+// chainPassages returns the passages of work in the order of their Prev and Next links,
+// starting with work.First. Passages blanked by gocite.DelPassage are left out.
+func chainPassages(work gocite.Work) []gocite.Passage {
+	var passages []gocite.Passage
+	if !work.First.Exists {
+		return passages
 	}
-
-	work, err = gocite.SortPassages(work)
-	if err == nil {
-		log.Printf(" SORTED AGAIN: WorkID: %s\nFirst.Index: %d\nFirst.PassageID: %s\nLast.Index: %d\nLast.PassageID: %s\n\n",
-			work.WorkID,
-			work.First.Index, work.First.PassageID,
-			work.Last.Index, work.Last.PassageID)
-		for i := range work.Passages {
-			log.Println(fmt.Printf(" Work received: PassageID: %s\n Index: %d\nPrev.Index: %d\nPrev.PassageID: %s\nNext.Index: %d\nNext.PassageID: %s\n\n",
-				work.Passages[i].PassageID, work.Passages[i].Index,
-				work.Passages[i].Prev.Index, work.Passages[i].Prev.PassageID,
-				work.Passages[i].Next.Index, work.Passages[i].Next.PassageID))
+	for i := work.First.Index; i >= 0 && i < len(work.Passages) && len(passages) < len(work.Passages); {
+		passage := work.Passages[i]
+		passages = append(passages, passage)
+		if !passage.Next.Exists {
+			break
 		}
-	} else {
-		log.Println(err)
+		i = passage.Next.Index
 	}
-	/*result2, err := gocite.SortPassages(work)
-	log.Printf(" SORTED result: WorkID: %s\nFirst.Index: %d\nFirst.PassageID: %s\nLast.Index: %d\nLast.PassageID: %s\n\n",
-		result2.WorkID,
-		result2.First.Index, result2.First.PassageID,
-		result2.Last.Index, result2.Last.PassageID)
-	for i := range result2.Passages {
-		log.Println(fmt.Printf(" SORTED result: PassageID: %s\n Index: %d\nPrev.Index: %d\nPrev.PassageID: %s\nNext.Index: %d\nNext.PassageID: %s\n\n",
-			result2.Passages[i].PassageID, result2.Passages[i].Index,
-			result2.Passages[i].Prev.Index, result2.Passages[i].Prev.PassageID,
-			result2.Passages[i].Next.Index, result2.Passages[i].Next.PassageID))*/
+	return passages
 }
 
-/*
-		var first, last, prev, next string
-
-		vars := mux.Vars(req)
-
-		/*
-		    	var texturns, texts, previouss, nexts, firsts, lasts []string
-		    	var imagerefs, linetexts [][]string
-		    	var indexs []int
-		    	vars := mux.Vars(req)
-		    	newkey := vars["key"]
-		    	newbucket := strings.Join(strings.Split(newkey, ":")[0:4], ":") + ":"
-		    	dbname := user + ".db"
-		    	retrieveddata := BoltRetrieve(dbname, newbucket, newkey)
-		    	retrievednodejson := BoltURN{}
-		    	json.Unmarshal([]byte(retrieveddata.JSON), &retrievednodejson)
-		   	marker := retrievednodejson.First
-		    	retrieveddata = BoltRetrieve(dbname, newbucket, marker)
-		   	retrievednodejson = BoltURN{}
-		    	json.Unmarshal([]byte(retrieveddata.JSON), &retrievednodejson)
-		    	bookmark := retrievednodejson.Index
-		    	lastnode := false
-		    	if retrievednodejson.Last == retrievednodejson.URN {
-		    		lastnode = true
-		    	}
-		    	db, err := openBoltDB(dbname) //open bolt DB using helper function
-		    	if err != nil {
-		    		fmt.Printf("Error opening userDB: %s", err)
-		    		http.Error(res, err.Error(), http.StatusInternalServerError)
-		    		return
-		    	}
-		    	defer db.Close()
-
+// editWork loads the work with the given URN in a single transaction, applies edit to it,
+// and saves the passages in the order of the links edit left them in. Index, Prev, and
+// Next of all passages are renumbered; passages no longer part of the work are deleted.
+// A deleted passage whose place in the reading order is taken by a new passage, i.e. one
+// that was renumbered, split, or merged, hands its version and history on to it; the other
+// deleted passages keep theirs, so that their history stays readable and a passage saved
+// under the same URN later continues their versions. The versions of passages whose text or
+// image links changed are incremented.
+func editWork(db *UserDB, workID string, edit func(work gocite.Work) (gocite.Work, error)) (gocite.Work, error) {
+	var result gocite.Work
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workID))
+		if bucket == nil {
+			return fmt.Errorf("work %s: %w", workID, errPassageNotFound)
+		}
+		passages := bucketPassages(bucket)
+		stored := make(map[string]string)
+		for _, passage := range passages {
+			stored[passage.PassageID] = passageContent(passage)
+		}
+		work := linkPassages(workID, passages)
+		var order []string //the passage URNs in reading order before the edit
+		for _, passage := range work.Passages {
+			order = append(order, passage.PassageID)
+		}
+		work, err := edit(work)
+		if err != nil {
+			return err
+		}
+		result = linkPassages(workID, chainPassages(work))
 
-}*/
+		kept := make(map[string]bool)
+		for _, passage := range result.Passages {
+			kept[passage.PassageID] = true
+		}
+		for i, passage := range result.Passages {
+			if _, ok := stored[passage.PassageID]; ok || i >= len(order) || kept[order[i]] {
+				continue
+			}
+			renamed := order[i]
+			err = moveVersion(tx, renamed, passage.PassageID)
+			if err != nil {
+				return err
+			}
+			err = moveHistory(tx, renamed, passage.PassageID)
+			if err != nil {
+				return err
+			}
+		}
+		for _, passage := range result.Passages {
+			value, err := json.Marshal(passage)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(passage.PassageID), value)
+			if err != nil {
+				return err
+			}
+			if content, ok := stored[passage.PassageID]; !ok || content != passageContent(passage) {
+				_, err = nextVersion(tx, passage.PassageID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for id := range stored {
+			if kept[id] {
+				continue
+			}
+			err = bucket.Delete([]byte(id))
+			if err != nil {
+				return err
+			}
+		}
+		return putWorkBounds(tx, result)
+	})
+	return result, err
+}
 
-/*
- func AddFirstNodeOLD(res http.ResponseWriter, req *http.Request) {
+// passageContent returns the text and image links of passage, for comparison.
+func passageContent(passage gocite.Passage) string {
+	content, _ := json.Marshal([]interface{}{passage.Text, passage.ImageLinks})
+	return string(content)
+}
 
- 	//First get the session..
- 	session, err := getSession(req)
- 	if err != nil {
- 		http.Error(res, err.Error(), http.StatusInternalServerError)
- 		return
- 	}
+// relink renumbers a work changed by gocite.InsertPassage or gocite.DelPassage,
+// so that the slice indices of its passages match their reading order again.
+func relink(work gocite.Work) gocite.Work {
+	return linkPassages(work.WorkID, chainPassages(work))
+}
 
- 	//..and check if user is logged in.
- 	user, message, loggedin := testLoginStatus("AddFirstNode", session)
- 	if loggedin {
- 		log.Println(message)
- 	} else {
- 		log.Println(message)
- 		Logout(res, req)
- 		return
- 	}
+// placePassage inserts passage into work before or after the passage anchor.
+// Without an anchor, passage is appended to the work.
+func placePassage(work gocite.Work, passage gocite.Passage, anchor, position string) (gocite.Work, error) {
+	passage.Prev, passage.Next = gocite.PassLoc{}, gocite.PassLoc{}
+	if anchor == "" {
+		if work.Last.Exists {
+			passage.Prev = gocite.PassLoc{Exists: true, PassageID: work.Last.PassageID}
+		}
+		return gocite.InsertPassage(passage, work)
+	}
+	index, found := gocite.GetIndexByID(anchor, work)
+	if !found {
+		return work, fmt.Errorf("%s: %w", anchor, errPassageNotFound)
+	}
+	switch position {
+	case positionBefore:
+		passage.Prev = work.Passages[index].Prev
+		passage.Next = gocite.PassLoc{Exists: true, PassageID: anchor}
+	case positionAfter:
+		passage.Prev = gocite.PassLoc{Exists: true, PassageID: anchor}
+		passage.Next = work.Passages[index].Next
+	default:
+		return work, fmt.Errorf("unknown position %q: %w", position, errBadPassage)
+	}
+	return gocite.InsertPassage(passage, work)
+}
 
+// checkNewPassage returns an error unless urn is a passage URN of work that is not taken yet.
+func checkNewPassage(work gocite.Work, urn string) error {
+	if !gocite.IsCTSURN(urn) || workBucket(urn) != work.WorkID || passageReference(urn) == "" {
+		return fmt.Errorf("%s is no passage of %s: %w", urn, work.WorkID, errBadPassage)
+	}
+	if _, found := gocite.GetIndexByID(urn, work); found {
+		return fmt.Errorf("%s: %w", urn, errPassageExists)
+	}
+	return nil
+}
 
- 	var texturns, texts, previouss, nexts, firsts, lasts []string
- 	var imagerefs, linetexts [][]string
- 	var indexs []int
- 	vars := mux.Vars(req)
- 	newkey := vars["key"]
- 	newbucket := strings.Join(strings.Split(newkey, ":")[0:4], ":") + ":"
- 	dbname := user + ".db"
- 	retrieveddata := BoltRetrieve(dbname, newbucket, newkey)
- 	retrievednodejson := BoltURN{}
- 	json.Unmarshal([]byte(retrieveddata.JSON), &retrievednodejson)
-	marker := retrievednodejson.First
- 	retrieveddata = BoltRetrieve(dbname, newbucket, marker)
-	retrievednodejson = BoltURN{}
- 	json.Unmarshal([]byte(retrieveddata.JSON), &retrievednodejson)
- 	bookmark := retrievednodejson.Index
- 	lastnode := false
- 	if retrievednodejson.Last == retrievednodejson.URN {
- 		lastnode = true
- 	}
- 	db, err := openBoltDB(dbname) //open bolt DB using helper function
- 	if err != nil {
- 		fmt.Printf("Error opening userDB: %s", err)
- 		http.Error(res, err.Error(), http.StatusInternalServerError)
- 		return
- 	}
- 	defer db.Close()
+// insertPassage inserts passage into its work before or after the passage anchor,
+// or at the end of the work if anchor is empty. The work is created if necessary.
+func insertPassage(db *UserDB, passage gocite.Passage, anchor, position string) (gocite.Work, error) {
+	workID := workBucket(passage.PassageID)
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(workID))
+		return err
+	})
+	if err != nil {
+		return gocite.Work{}, err
+	}
+	return editWork(db, workID, func(work gocite.Work) (gocite.Work, error) {
+		err := checkNewPassage(work, passage.PassageID)
+		if err != nil {
+			return work, err
+		}
+		return placePassage(work, passage, anchor, position)
+	})
+}
 
- 	db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
- 		b := tx.Bucket([]byte(newbucket))
-		c := b.Cursor()
+// deletePassage deletes the passage with the given URN and links its neighbours.
+func deletePassage(db *UserDB, urn string) (gocite.Work, error) {
+	return editWork(db, workBucket(urn), func(work gocite.Work) (gocite.Work, error) {
+		if _, found := gocite.GetIndexByID(urn, work); !found {
+			return work, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+		}
+		return gocite.DelPassage(urn, work)
+	})
+}
 
- 		for k, v := c.First(); k != nil; k, v = c.Next() {
- 			retrievedjson := BoltURN{}
- 			json.Unmarshal([]byte(v), &retrievedjson)
- 			ctsurn := retrievedjson.URN
- 			text := retrievedjson.Text
- 			linetext := retrievedjson.LineText
- 			previous := retrievedjson.Previous
- 			next := retrievedjson.Next
- 			imageref := retrievedjson.ImageRef
- 			last := retrievedjson.Last
- 			index := retrievedjson.Index
- 			newfirst := newbucket + "newNode" + strconv.Itoa(bookmark)
+// movePassage moves the passage with the given URN before or after the passage anchor
+// of the same work.
+func movePassage(db *UserDB, urn, anchor, position string) (gocite.Work, error) {
+	return editWork(db, workBucket(urn), func(work gocite.Work) (gocite.Work, error) {
+		passage, err := gocite.GetPassageByID(urn, work)
+		if err != nil {
+			return work, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+		}
+		if anchor == urn || workBucket(anchor) != work.WorkID {
+			return work, fmt.Errorf("cannot move %s next to %s: %w", urn, anchor, errBadPassage)
+		}
+		work, err = gocite.DelPassage(urn, work)
+		if err != nil {
+			return work, err
+		}
+		return placePassage(relink(work), passage, anchor, position)
+	})
+}
 
- 			switch {
- 			case index < bookmark:
- 				texturns = append(texturns, ctsurn)
- 				texts = append(texts, text)
- 				linetexts = append(linetexts, linetext)
- 				previouss = append(previouss, previous)
- 				nexts = append(nexts, next)
- 				firsts = append(firsts, newfirst)
- 				switch lastnode {
- 				case false:
- 					lasts = append(lasts, last)
- 				case true:
- 					newlast := newbucket + "newNode" + strconv.Itoa(bookmark)
- 					lasts = append(lasts, newlast)
- 				}
-				indexs = append(indexs, index)
-				imagerefs = append(imagerefs, imageref)
- 			case index > bookmark+1:
- 				newindex := index + 1
- 				texturns = append(texturns, ctsurn)
- 				texts = append(texts, text)
- 				linetexts = append(linetexts, linetext)
- 				previouss = append(previouss, previous)
-				nexts = append(nexts, next)
- 				firsts = append(firsts, newfirst)
- 				switch lastnode {
- 				case false:
-					lasts = append(lasts, last)
- 				case true:
- 					newlast := newbucket + "newNode" + strconv.Itoa(bookmark)
- 					lasts = append(lasts, newlast)
- 				}
- 				indexs = append(indexs, newindex)
- 				imagerefs = append(imagerefs, imageref)
- 			case index == bookmark:
- 				newnode := newbucket + "newNode" + strconv.Itoa(index)
- 				newindex := index + 1
+// renumberPassage changes the URN of a passage to newURN within the same work,
+// keeping its position.
+func renumberPassage(db *UserDB, urn, newURN string) (gocite.Work, error) {
+	return editWork(db, workBucket(urn), func(work gocite.Work) (gocite.Work, error) {
+		index, found := gocite.GetIndexByID(urn, work)
+		if !found {
+			return work, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+		}
+		err := checkNewPassage(work, newURN)
+		if err != nil {
+			return work, err
+		}
+		work.Passages[index].PassageID = newURN
+		for i := range work.Passages[index].ImageLinks {
+			work.Passages[index].ImageLinks[i].Subject = newURN
+		}
+		return relink(work), nil
+	})
+}
 
- 				texturns = append(texturns, newnode)
- 				texts = append(texts, "")
- 				linetexts = append(linetexts, []string{})
-				previouss = append(previouss, newfirst)
- 				nexts = append(nexts, ctsurn)
- 				firsts = append(firsts, newfirst)
-				switch lastnode {
- 				case false:
- 					lasts = append(lasts, last)
- 				case true:
- 					newlast := newbucket + "newNode" + strconv.Itoa(bookmark)
- 					lasts = append(lasts, newlast)
- 				}
- 				indexs = append(indexs, index)
- 				imagerefs = append(imagerefs, []string{})
+// passageEdit is the body of the requests of the passage structure endpoints.
+type passageEdit struct {
+	URN      string   `json:"urn"`      //the new URN of an inserted, renumbered, or split off passage
+	Anchor   string   `json:"anchor"`   //the passage an inserted or moved passage is placed next to, or merged with
+	Position string   `json:"position"` //before or after the anchor
+	Lines    []string `json:"lines"`    //the text of an inserted passage
+	Offset   int      `json:"offset"`   //the character offset a passage is split at
+	Preview  bool     `json:"preview"`  //return the result of a split or merge without saving it
+}
 
- 				texturns = append(texturns, ctsurn)
- 				texts = append(texts, text)
- 				linetexts = append(linetexts, linetext)
- 				previouss = append(previouss, newfirst)
- 				nexts = append(nexts, next)
- 				firsts = append(firsts, newfirst)
-				switch lastnode {
- 				case false:
-					lasts = append(lasts, last)
- 				case true:
- 					newlast := newbucket + "newNode" + strconv.Itoa(bookmark)
- 					lasts = append(lasts, newlast)
- 				}
-				indexs = append(indexs, newindex)
- 				imagerefs = append(imagerefs, imageref)
- 			case index == bookmark+1:
- 				newnode := newbucket + "newNode" + strconv.Itoa(bookmark)
-				newindex := index + 1
- 				texturns = append(texturns, ctsurn)
- 				texts = append(texts, text)
- 				linetexts = append(linetexts, linetext)
-				previouss = append(previouss, newnode)
- 				nexts = append(nexts, next)
- 				firsts = append(firsts, newfirst)
- 				switch lastnode {
- 				case false:
- 					lasts = append(lasts, last)
- 				case true:
- 					newlast := newbucket + "newNode" + strconv.Itoa(bookmark)
- 					lasts = append(lasts, newlast)
-				}
-				indexs = append(indexs, newindex)
- 				imagerefs = append(imagerefs, imageref)
- 			}
- 		}
- 		return nil
- 	})
+// handlePassageStructure handles the passage structure endpoints for the passage {urn}:
+// POST .../insert adds the passage {urn} before or after anchor, or at the end of the work,
+// POST .../move moves it before or after anchor, POST .../renumber changes its URN to urn,
+// and DELETE deletes it. The new reading order of the work is returned. POST .../split splits
+// it at offset and POST .../merge merges it with the adjacent passage anchor; both return
+// the changed passages as well and only preview them if preview is set.
+func handlePassageStructure(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
 
- 	var bolturns []gocite.Passage
- 	lastTextID := len(texturns)-1
- 	for i := range texturns {
- 		prevEx := true
- 		nextEx := true
- 		if i == 0 {prevEx = false}
- 		if i == lastTextID {nextEx = false}
- 		bolturns = append(bolturns, gocite.Passage{PassageID: texturns[i],
- 			Range: false,
- 			Text:     gocite.EncText{Brucheion: texts[i],
- 			TXT: linetexts[i]},
- 			Previous: gocite.PassLoc{Exists: prevEx,
- 				PassageID: previouss[i],
- 				index = i - 1},
- 			Next:     gocite.PassLoc{Exists: nextEx,
- 				PassageID: nexts[i],
- 				index = i + 1},
- 			First:    gocite.PassLoc{Exists: true,
- 				PassageID: firsts[i],
- 				index = 0},
- 			Last:     gocite.PassLoc{Exists: true,
- 				PassageID: lasts[i],
- 				index = lastTextID},
- 			Index:    indexs[i],
- 			ImageRef: imagerefs[i]})
- 	}
- 	for i := range bolturns {
- 		newkey := texturns[i]
- 		newnode, _ := json.Marshal(bolturns[i])
- 		key := []byte(newkey)
- 		value := []byte(newnode)
- 		err = db.Update(func(tx *bolt.Tx) error {
- 			bucket, err := tx.CreateBucketIfNotExists([]byte(newbucket))
- 			if err != nil {
- 				return err
- 			}
+	vars := mux.Vars(r)
+	urn := vars["urn"]
+	if !gocite.IsCTSURN(urn) {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+	var edit passageEdit
+	if r.Method != http.MethodDelete {
+		err = json.NewDecoder(r.Body).Decode(&edit)
+		if err != nil {
+			respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+			return
+		}
+	}
 
- 			err = bucket.Put(key, value)
- 			if err != nil {
- 				return err
- 			}
- 			return nil
- 		})
- 	}
- }
-*/
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
 
-/* Has to be rebuild anyway. Overhauled until mark
+	var work gocite.Work
+	var change PassageChange
+	switch {
+	case r.Method == http.MethodDelete:
+		work, err = deletePassage(db, urn)
+	case vars["operation"] == "insert":
+		passage := gocite.Passage{PassageID: urn,
+			Text: gocite.EncText{TXT: strings.Join(edit.Lines, "\r\n"), Brucheion: strings.Join(edit.Lines, "")}}
+		work, err = insertPassage(db, passage, edit.Anchor, edit.Position)
+	case vars["operation"] == "move":
+		work, err = movePassage(db, urn, edit.Anchor, edit.Position)
+	case vars["operation"] == "renumber":
+		work, err = renumberPassage(db, urn, edit.URN)
+	case vars["operation"] == "split":
+		var catalog BoltCatalog
+		catalog, err = db.GetCatalog(workBucket(urn))
+		if err == nil {
+			change, err = changePassages(db, workBucket(urn), edit.Preview, func(work gocite.Work) (gocite.Work, []string, error) {
+				return splitPassage(work, catalog.Citation, urn, edit.Offset, edit.URN)
+			})
+		}
+	case vars["operation"] == "merge":
+		change, err = changePassages(db, workBucket(urn), edit.Preview, func(work gocite.Work) (gocite.Work, []string, error) {
+			return mergePassage(work, urn, edit.Anchor)
+		})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case errors.Is(err, errPassageNotFound):
+		respondWithJSON(w, "error", "passage_not_found", err.Error(), 404)
+	case errors.Is(err, errPassageExists):
+		respondWithJSON(w, "error", "passage_exists", err.Error(), 409)
+	case errors.Is(err, errBadPassage):
+		respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+	case err != nil:
+		log.Printf("handlePassageStructure: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	case change.Work != "":
+		respondWithData(w, change, 200)
+	default:
+		respondWithData(w, workOrder(work), 200)
+	}
+}
 
-// AddNodeAfter adds
-func AddNodeAfter(res http.ResponseWriter, req *http.Request) {
+// AddFirstNode adds the new passage {key} at the beginning of its work
+// and opens it in the editor.
+func AddFirstNode(res http.ResponseWriter, req *http.Request) {
 	//First get the session..
 	session, err := getSession(req)
 	if err != nil {
@@ -340,7 +359,7 @@ func AddNodeAfter(res http.ResponseWriter, req *http.Request) {
 	}
 
 	//..and check if user is logged in.
-	user, message, loggedin := testLoginStatus("AddNodeAfter", session)
+	user, message, loggedin := testLoginStatus("AddFirstNode", session)
 	if loggedin {
 		log.Println(message)
 	} else {
@@ -349,212 +368,23 @@ func AddNodeAfter(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	var texturns, texts, previouss, nexts, firsts, lasts []string
-	//var imagerefs, linetexts [][]string
-	var imagerefs [][]string
-	var indexs []int
-	vars := mux.Vars(req)
-	PassageURNString := vars["key"]
-	URNString := strings.Join(strings.Split(PassageURNString, ":")[0:4], ":") + ":" //
-	passageIdentifier := strings.Split(PassageURNString, ":")[5]
-	dbname := user + ".db"
-	retrievedPassage := BoltRetrievePassage(dbname, URNString, passageIdentifier)
-	//retrievedData, _ := BoltRetrieve(dbname, URNString, PassageURNString)
-	//retrievednodejson := BoltURN{}
-	//retrievedPassage := gocite.Passage{}
-	//json.Unmarshal([]byte(retrievedData.JSON), &retrievedPassage)
-	bookmark := retrievedPassage.Index
-	lastnode := false
-	//if retrievednodejson.Last == retrievednodejson.URN {
-	if BoltRetrieveWork(dbname, URNString).Last.PassageID == retrievedPassage.PassageID {
-		lastnode = true
-	}
-	*** OVERHAULED UNTIL HERE ***
-
-
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	key := mux.Vars(req)["key"]
+	db, err := openUserDB(user)
 	if err != nil {
-		log.Println(fmt.Printf("AddNodeAfter: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
 
-	db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		bucket := tx.Bucket([]byte(URNString))
-
-		cursor := bucket.Cursor()
-
-		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
-			retrievedjson := BoltURN{}
-			json.Unmarshal([]byte(v), &retrievedjson)
-			ctsurn := retrievedjson.URN
-			text := retrievedjson.Text
-			linetext := retrievedjson.LineText
-			previous := retrievedjson.Previous
-			next := retrievedjson.Next
-			first := retrievedjson.First
-			imageref := retrievedjson.ImageRef
-			last := retrievedjson.Last
-			index := retrievedjson.Index
-
-			retrievedjson := gocite.Passage{}
-			json.Unmarshal([]byte(value), &retrievedjson)
-			ctsurn := retrievedjson.PassageID
-			text := retrievedjson.Text.TXT
-			//linetext is being retired and replaced with to gocite.Text
-			previous := retrievedjson.Prev.PassageID
-			next := retrievedjson.Next.PassageID
-			first := retrievedjson.First.PassageID
-			last := retrievedjson.Last.PassageID
-			imageref := []string{}
-			for _, tmp := range retrievedjson.ImageLinks {
-				imageref = append(imageref, tmp.Object)
-			}
-			index := retrievedjson.Index
-
-			switch {
-			case index < bookmark:
-				texturns = append(texturns, ctsurn)
-				texts = append(texts, text)
-				//linetexts = append(linetexts, linetext)
-				previouss = append(previouss, previous)
-				nexts = append(nexts, next)
-				firsts = append(firsts, first)
-				switch lastnode {
-				case false:
-					lasts = append(lasts, last)
-				case true:
-					newlast := URNString + "newNode" + strconv.Itoa(bookmark)
-					lasts = append(lasts, newlast)
-				}
-				indexs = append(indexs, index)
-				imagerefs = append(imagerefs, imageref)
-			case index > bookmark+1:
-				newindex := index + 1
-				texturns = append(texturns, ctsurn)
-				texts = append(texts, text)
-				//linetexts = append(linetexts, linetext)
-				previouss = append(previouss, previous)
-				nexts = append(nexts, next)
-				firsts = append(firsts, first)
-				switch lastnode {
-				case false:
-					lasts = append(lasts, last)
-				case true:
-					newlast := URNString + "newNode" + strconv.Itoa(bookmark)
-					lasts = append(lasts, newlast)
-				}
-				indexs = append(indexs, newindex)
-				imagerefs = append(imagerefs, imageref)
-			case index == bookmark:
-				newnode := URNString + "newNode" + strconv.Itoa(index)
-				newindex := index + 1
-
-				texturns = append(texturns, ctsurn)
-				texts = append(texts, text)
-				//linetexts = append(linetexts, linetext)
-				previouss = append(previouss, previous)
-				nexts = append(nexts, newnode)
-				firsts = append(firsts, first)
-				switch lastnode {
-				case false:
-					lasts = append(lasts, last)
-				case true:
-					newlast := URNString + "newNode" + strconv.Itoa(bookmark)
-					lasts = append(lasts, newlast)
-				}
-				indexs = append(indexs, index)
-				imagerefs = append(imagerefs, imageref)
-
-				texturns = append(texturns, newnode)
-				texts = append(texts, "")
-				//linetexts = append(linetexts, []string{})
-				previouss = append(previouss, ctsurn)
-				nexts = append(nexts, next)
-				firsts = append(firsts, first)
-				switch lastnode {
-				case false:
-					lasts = append(lasts, last)
-				case true:
-					newlast := URNString + "newNode" + strconv.Itoa(bookmark)
-					lasts = append(lasts, newlast)
-				}
-				indexs = append(indexs, newindex)
-				imagerefs = append(imagerefs, []string{})
-			case index == bookmark+1:
-				newnode := URNString + "newNode" + strconv.Itoa(bookmark)
-				newindex := index + 1
-				texturns = append(texturns, ctsurn)
-				texts = append(texts, text)
-				//linetexts = append(linetexts, linetext)
-				previouss = append(previouss, newnode)
-				nexts = append(nexts, next)
-				firsts = append(firsts, first)
-				switch lastnode {
-				case false:
-					lasts = append(lasts, last)
-				case true:
-					newlast := URNString + "newNode" + strconv.Itoa(bookmark)
-					lasts = append(lasts, newlast)
-				}
-				indexs = append(indexs, newindex)
-				imagerefs = append(imagerefs, imageref)
-			}
-		}
-		return nil
-	})
-
-	//var bolturns []BoltURN
-	var gocitePassages []gocite.Passage
-	for i := range texturns {
-		bolturns = append(bolturns, BoltURN{URN: texturns[i],
-		Text:     texts[i],
-		//LineText: linetexts[i],
-		Previous: previouss[i],
-		Next:     nexts[i],
-		First:    firsts[i],
-		Last:     lasts[i],
-		Index:    indexs[i],
-		ImageRef: imagerefs[i]})
-
-		text := gocite.EncText{}
-		text.TXT = texts[i]
-		var previous, next, first, last gocite.PassLoc
-		previous.PassageID = previouss[i]
-		next.PassageID = nexts[i]
-		first.PassageID = firsts[i]
-		last.PassageID = lasts[i]
-
-		gocitePassages = append(gocitePassages, gocite.Passage{
-			PassageID: texturns[i],
-			Text:      text,
-			Prev:      previous,
-			Next:      next,
-			First:     first,
-			Last:      last,
-			Index:     indexs[i]})
-		//ImageRef:  imagerefs[i]}) //What to do with the imagerefs?
+	work, err := db.GetWork(workBucket(key))
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
 	}
-	//for i := range bolturns {
-	for i := range gocitePassages {
-		newkey := texturns[i]
-		newnode, _ := json.Marshal(gocitePassages[i])
-		key := []byte(newkey)
-		value := []byte(newnode)
-		err = db.Update(func(tx *bolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists([]byte(URNString))
-			if err != nil {
-				return err
-			}
-
-			err = bucket.Put(key, value)
-			if err != nil {
-				return err
-			}
-			return nil
-		})
+	_, err = insertPassage(db, gocite.Passage{PassageID: key}, work.First.PassageID, positionBefore)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
 	}
+	http.Redirect(res, req, "/edit/"+key+"/", http.StatusFound)
 }
-*/
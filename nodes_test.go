@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+)
+
+func TestPassageStructure(t *testing.T) {
+	newPassage := func(reference string) gocite.Passage {
+		return gocite.Passage{PassageID: testWork + reference, Text: gocite.EncText{Brucheion: "navam", TXT: "navam"}}
+	}
+	tests := []struct {
+		name    string
+		edit    func(db *UserDB) (gocite.Work, error)
+		want    []string
+		wantErr error
+	}{
+		{"insert after", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage("1.5"), testWork+"1.2", positionAfter)
+		}, []string{"1.1", "1.2", "1.5", "1.9", "1.10"}, nil},
+		{"insert before the first", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage("1.0"), testWork+"1.1", positionBefore)
+		}, []string{"1.0", "1.1", "1.2", "1.9", "1.10"}, nil},
+		{"insert at the end", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage("1.11"), "", "")
+		}, []string{"1.1", "1.2", "1.9", "1.10", "1.11"}, nil},
+		{"insert existing", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage("1.9"), testWork+"1.1", positionAfter)
+		}, nil, errPassageExists},
+		{"insert next to a missing anchor", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage("1.5"), testWork+"1.4", positionAfter)
+		}, nil, errPassageNotFound},
+		{"insert at an unknown position", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage("1.5"), testWork+"1.2", "below")
+		}, nil, errBadPassage},
+		{"insert without reference", func(db *UserDB) (gocite.Work, error) {
+			return insertPassage(db, newPassage(""), testWork+"1.2", positionAfter)
+		}, nil, errBadPassage},
+		{"delete", func(db *UserDB) (gocite.Work, error) {
+			return deletePassage(db, testWork+"1.2")
+		}, []string{"1.1", "1.9", "1.10"}, nil},
+		{"delete the last", func(db *UserDB) (gocite.Work, error) {
+			return deletePassage(db, testWork+"1.10")
+		}, []string{"1.1", "1.2", "1.9"}, nil},
+		{"delete missing", func(db *UserDB) (gocite.Work, error) {
+			return deletePassage(db, testWork+"1.4")
+		}, nil, errPassageNotFound},
+		{"move before", func(db *UserDB) (gocite.Work, error) {
+			return movePassage(db, testWork+"1.10", testWork+"1.1", positionBefore)
+		}, []string{"1.10", "1.1", "1.2", "1.9"}, nil},
+		{"move after", func(db *UserDB) (gocite.Work, error) {
+			return movePassage(db, testWork+"1.1", testWork+"1.9", positionAfter)
+		}, []string{"1.2", "1.9", "1.1", "1.10"}, nil},
+		{"move next to itself", func(db *UserDB) (gocite.Work, error) {
+			return movePassage(db, testWork+"1.1", testWork+"1.1", positionAfter)
+		}, nil, errBadPassage},
+		{"move missing", func(db *UserDB) (gocite.Work, error) {
+			return movePassage(db, testWork+"1.4", testWork+"1.1", positionAfter)
+		}, nil, errPassageNotFound},
+		{"renumber", func(db *UserDB) (gocite.Work, error) {
+			return renumberPassage(db, testWork+"1.9", testWork+"1.3")
+		}, []string{"1.1", "1.2", "1.3", "1.10"}, nil},
+		{"renumber to an existing passage", func(db *UserDB) (gocite.Work, error) {
+			return renumberPassage(db, testWork+"1.9", testWork+"1.10")
+		}, nil, errPassageExists},
+		{"renumber into another work", func(db *UserDB) (gocite.Work, error) {
+			return renumberPassage(db, testWork+"1.9", "urn:cts:sktlit:skt0001.nyaya002.J1D:1.9")
+		}, nil, errBadPassage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := loadTestCEX(t, testCEX)
+			work, err := test.edit(db)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("error %v, want %v", err, test.wantErr)
+				}
+				if got, want := readingOrder(t, db, testWork), []string{"1.1", "1.2", "1.9", "1.10"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("order %v after a failed edit", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var returned []string
+			for _, urn := range workOrder(work).Passages {
+				returned = append(returned, passageReference(urn))
+			}
+			if !reflect.DeepEqual(returned, test.want) {
+				t.Errorf("returned order %v, want %v", returned, test.want)
+			}
+			if got := readingOrder(t, db, testWork); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("stored order %v, want %v", got, test.want)
+			}
+			report, err := checkIntegrity(db)
+			if err != nil || len(report.Issues) != 0 {
+				t.Errorf("issues after the edit: %+v, %v", report.Issues, err)
+			}
+		})
+	}
+}
+
+func TestRenumberPassageKeepsContent(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	passage, _ := getPassage(t, db, testWork, testWork+"1.9")
+	passage.ImageLinks = []gocite.Triple{{Subject: passage.PassageID, Verb: "urn:cite2:dse:verbs.v1:appears_on",
+		Object: "urn:cite2:test:img.v1:f1"}}
+	putPassages(t, db, testWork, map[string]gocite.Passage{passage.PassageID: passage})
+
+	_, err := renumberPassage(db, testWork+"1.9", testWork+"1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := getPassage(t, db, testWork, testWork+"1.9"); found {
+		t.Error("the old URN is still stored")
+	}
+	renumbered, _ := getPassage(t, db, testWork, testWork+"1.3")
+	if renumbered.Text != passage.Text || len(renumbered.ImageLinks) != 1 ||
+		renumbered.ImageLinks[0].Subject != testWork+"1.3" {
+		t.Errorf("renumbered passage %+v", renumbered)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// muxPattern matches the pattern of a route variable, e.g. :insert|move in {operation:insert|move}
+var muxPattern = regexp.MustCompile(`\{([^{}:]+):[^{}]*\}`)
+
+func TestOpenAPIMatchesRouter(t *testing.T) {
+	var spec struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatalf("openapi.json is no valid JSON: %s", err)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/api/v1" {
+		t.Fatalf("openapi.json should have the single server /api/v1, has %v", spec.Servers)
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range spec.Paths {
+		for method := range item {
+			if method != "parameters" && method != "summary" && method != "description" {
+				documented[strings.ToUpper(method)+" /api/v1"+path] = true
+			}
+		}
+	}
+
+	//createRouter needs the flag set up by initializeFlags
+	localAssets = new(bool)
+	registered := make(map[string]bool)
+	err = createRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/v1/") {
+			return nil
+		}
+		path = muxPattern.ReplaceAllString(path, "{$1}")
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("%s is registered without methods", path)
+			return nil
+		}
+		for _, method := range methods {
+			registered[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range sortedKeys(registered) {
+		if !documented[route] {
+			t.Errorf("%s is registered but missing from openapi.json", route)
+		}
+	}
+	for _, route := range sortedKeys(documented) {
+		if !registered[route] {
+			t.Errorf("%s is in openapi.json but not registered", route)
+		}
+	}
+	if len(registered) == 0 {
+		t.Error("no API routes found")
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	localAssets = new(bool)
+	r, err := http.NewRequest("GET", "/api/v1/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	createRouter().ServeHTTP(w, r)
+	if w.Code != 200 || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("GET /api/v1/openapi.json: got %d, want 200 and the JSON document", w.Code)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -65,7 +65,7 @@ func GetWorkLangFromCatalog(work_urn, dbname string) string {
 	work_bucket_id := work_urn + ":"
 
 	// fetch language_code from work bucket, using bucket_id as key to specify catalog data
-	retrieved_catalog_value_data, _ := BoltRetrieve(dbname, work_bucket_id, work_bucket_id)
+	retrieved_catalog_value_data, _ := BoltRetrieve(dbname, catalogBucket, work_bucket_id)
 	retrieved_cat_json := BoltCatalog{}
 	json.Unmarshal([]byte(retrieved_catalog_value_data.JSON), &retrieved_cat_json)
 	work_language_code := retrieved_cat_json.Language
@@ -121,13 +121,16 @@ type PassageList struct {
 func GetAllPassages(dbname string) PassageList {
 	passage_list := PassageList{}
 	buckets := Buckets(dbname)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		fmt.Printf("Error opening userDB: %s", err)
 		return passage_list
 	}
 	defer db.Close()
 	for i := range buckets {
+		if !gocite.IsCTSURN(buckets[i]) { //only work buckets hold passages
+			continue
+		}
 		db.View(func(tx *bolt.Tx) error {
 			// Assume bucket exists and has keys
 			b := tx.Bucket([]byte(buckets[i]))
@@ -180,7 +183,7 @@ func normalizeOrthographyTemporarily(res http.ResponseWriter, req *http.Request)
 	}
 
 	// construct dbname
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	// extract passage urn(s)
 	vars := mux.Vars(req)
@@ -262,7 +265,7 @@ func normalizeOrthographyAndSave(res http.ResponseWriter, req *http.Request) {
 	}
 
 	// construct dbname
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	// extract passage urn(s)
 	vars := mux.Vars(req)
@@ -312,31 +315,19 @@ func normalizeOrthographyAndSave(res http.ResponseWriter, req *http.Request) {
 
 		// DIFFERENT BELOW HERE
 
-		// update temporary object with result
-		passage.Text.Normalised = normalized_text_result
-
-		// save updated object to database
-		updatednode, _ := json.Marshal(passage)
-		db, err := openBoltDB(dbname)
+		// save the result to the database and record it in the history of the passage
+		db, err := userDBs.Open(dbname)
 		if err != nil {
 			fmt.Printf("Error opening userDB: %s", err)
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		key := []byte(passage.PassageID) //
-		value := []byte(updatednode)     //
-		// store some data
 		err = db.Update(func(tx *bolt.Tx) error {
-			bucket, err := tx.CreateBucketIfNotExists([]byte(work_urn + ":"))
-			if err != nil {
-				return err
-			}
-			err = bucket.Put(key, value)
-			if err != nil {
-				fmt.Println(err)
-				return err
-			}
-			return nil
+			_, err := updatePassage(tx, passage.PassageID, user, func(passage *gocite.Passage) error {
+				passage.Text.Normalised = normalized_text_result
+				return nil
+			})
+			return err
 		})
 		if err != nil {
 			log.Fatal(err)
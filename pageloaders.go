@@ -37,7 +37,7 @@ func loadPage(transcription Transcription, kind string) (*Page, error) {
 	caton := transcription.CatOn
 	catlan := transcription.CatLan
 
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	var previouslink, nextlink string
 	switch {
 	case previous == "":
@@ -55,7 +55,7 @@ func loadPage(transcription Transcription, kind string) (*Page, error) {
 	}
 	var textrefrences []string
 	for i := range transcription.TextRef {
-		if transcription.TextRef[i] == "imgCollection" || transcription.TextRef[i] == "meta" {
+		if !gocite.IsCTSURN(transcription.TextRef[i]) {
 			continue
 		}
 		requestedbucket := transcription.TextRef[i]
@@ -132,6 +132,7 @@ func loadPage(transcription Transcription, kind string) (*Page, error) {
 		ImageHTML:    imagehtml,
 		TextHTML:     texthtml,
 		ImageRef:     imageref,
+		Version:      transcription.Version,
 		CatID:        catid,
 		CatCit:       catcit,
 		CatGroup:     catgroup,
@@ -144,7 +145,7 @@ func loadPage(transcription Transcription, kind string) (*Page, error) {
 		ImageJS:      imagejs}, nil
 }
 
-func loadCompPage(transcription, transcription2 Transcription) (*CompPage, error) {
+func loadCompPage(transcription, transcription2 Transcription, settings AlignmentSettings) (*CompPage, error) {
 	user := transcription.Transcriber
 	title := transcription.CTSURN
 	text := transcription.Transcription
@@ -168,7 +169,7 @@ func loadCompPage(transcription, transcription2 Transcription) (*CompPage, error
 	caton2 := transcription2.CatOn
 	catlan2 := transcription2.CatLan
 
-	texts := nwa(text, text2)
+	texts := nwa(text, text2, settings)
 
 	return &CompPage{User: user,
 		Title:     title,
@@ -196,10 +197,10 @@ func loadCompPage(transcription, transcription2 Transcription) (*CompPage, error
 
 func loadMultiPage(transcription Transcription) (*Page, error) {
 	user := transcription.Transcriber
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	var textrefrences []string
 	for i := range transcription.TextRef {
-		if transcription.TextRef[i] == "imgCollection" || transcription.TextRef[i] == "meta" {
+		if !gocite.IsCTSURN(transcription.TextRef[i]) {
 			continue
 		}
 		requestedbucket := transcription.TextRef[i]
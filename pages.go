@@ -16,7 +16,6 @@ import (
 	"github.com/boltdb/bolt"
 
 	"github.com/ThomasK81/gocite"
-	"github.com/ThomasK81/gonwr"
 
 	"github.com/gorilla/mux"
 )
@@ -62,14 +61,14 @@ func ViewPage(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	urn := vars["urn"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 
 	// adding testing if requestedbucket exists...
 	retrieveddata, _ := BoltRetrieve(dbname, requestedbucket, urn)
-	retrievedcat, _ := BoltRetrieve(dbname, requestedbucket, requestedbucket)
+	retrievedcat, _ := BoltRetrieve(dbname, catalogBucket, requestedbucket)
 	retrievedcatjson := BoltCatalog{}
 	retrievedPassage := gocite.Passage{}
 	json.Unmarshal([]byte(retrieveddata.JSON), &retrievedPassage)
@@ -162,14 +161,27 @@ func comparePage(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	urn := vars["urn"]
 	urn2 := vars["urn2"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 
+	//the alignment settings of the first work, changed by the query values
+	db, err := openUserDB(user)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settings, err := requestAlignmentSettings(db, requestedbucket, req.URL.Query())
+	db.Close()
+	if err != nil {
+		http.Error(res, err.Error(), alignmentErrorStatus(err))
+		return
+	}
+
 	// adding testing if requestedbucket exists...
 	retrieveddata, _ := BoltRetrieve(dbname, requestedbucket, urn)
-	retrievedcat, _ := BoltRetrieve(dbname, requestedbucket, requestedbucket)
+	retrievedcat, _ := BoltRetrieve(dbname, catalogBucket, requestedbucket)
 	retrievedcatjson := BoltCatalog{}
 	//retrievedPassage := BoltURN{}
 	retrievedPassage := gocite.Passage{}
@@ -177,7 +189,7 @@ func comparePage(res http.ResponseWriter, req *http.Request) {
 	json.Unmarshal([]byte(retrievedcat.JSON), &retrievedcatjson)
 
 	ctsurn := retrievedPassage.PassageID
-	text := retrievedPassage.Text.TXT
+	text := alignmentText(retrievedPassage, settings)
 	previous := retrievedPassage.Prev.PassageID
 	next := retrievedPassage.Next.PassageID
 	imageref := []string{}
@@ -226,7 +238,7 @@ func comparePage(res http.ResponseWriter, req *http.Request) {
 
 	// adding testing if requestedbucket exists...
 	retrieveddata, _ = BoltRetrieve(dbname, requestedbucket, urn2)
-	retrievedcat, _ = BoltRetrieve(dbname, requestedbucket, requestedbucket)
+	retrievedcat, _ = BoltRetrieve(dbname, catalogBucket, requestedbucket)
 	retrievedcatjson = BoltCatalog{}
 	//retrievedPassage = BoltURN{}
 	retrievedPassage = gocite.Passage{}
@@ -234,7 +246,7 @@ func comparePage(res http.ResponseWriter, req *http.Request) {
 	json.Unmarshal([]byte(retrievedcat.JSON), &retrievedcatjson)
 
 	ctsurn = retrievedPassage.PassageID
-	text = retrievedPassage.Text.TXT
+	text = alignmentText(retrievedPassage, settings)
 	previous = retrievedPassage.Prev.PassageID
 	next = retrievedPassage.Next.PassageID
 	imageref = []string{}
@@ -279,7 +291,7 @@ func comparePage(res http.ResponseWriter, req *http.Request) {
 		CatOn:         caton,
 		CatLan:        catlan}
 
-	compPage, _ := loadCompPage(transcription, transcription2)
+	compPage, _ := loadCompPage(transcription, transcription2, settings)
 	renderCompTemplate(res, "compare", compPage)
 }
 
@@ -305,33 +317,43 @@ func consolidatePage(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	urn := vars["urn"]
 	urn2 := vars["urn2"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 
+	//the alignment settings of the first work, changed by the query values
+	db, err := openUserDB(user)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settings, err := requestAlignmentSettings(db, requestedbucket, req.URL.Query())
+	db.Close()
+	if err != nil {
+		http.Error(res, err.Error(), alignmentErrorStatus(err))
+		return
+	}
+
 	// adding testing if requestedbucket exists...
 	retrieveddata, _ := BoltRetrieve(dbname, requestedbucket, urn)
-	retrievedcat, _ := BoltRetrieve(dbname, requestedbucket, requestedbucket)
+	retrievedcat, _ := BoltRetrieve(dbname, catalogBucket, requestedbucket)
 	retrievedcatjson := BoltCatalog{}
-	retrievedPassage := BoltURN{}
+	retrievedPassage := gocite.Passage{}
 	json.Unmarshal([]byte(retrieveddata.JSON), &retrievedPassage)
 	json.Unmarshal([]byte(retrievedcat.JSON), &retrievedcatjson)
 
-	ctsurn := retrievedPassage.URN
-	text := ""
-	linetext := retrievedPassage.LineText
-	for i := range linetext {
-		text = text + linetext[i]
-		if i < len(linetext)-1 {
-			text = text + " "
-		}
+	ctsurn := retrievedPassage.PassageID
+	text := strings.Replace(alignmentText(retrievedPassage, settings), "\r\n", " ", -1)
+	previous := retrievedPassage.Prev.PassageID
+	next := retrievedPassage.Next.PassageID
+	imageref := []string{}
+	for _, tmp := range retrievedPassage.ImageLinks {
+		imageref = append(imageref, tmp.Object)
 	}
-	previous := retrievedPassage.Previous
-	next := retrievedPassage.Next
-	imageref := retrievedPassage.ImageRef
-	first := retrievedPassage.First
-	last := retrievedPassage.Last
+	work, _ := BoltRetrieveWork(dbname, requestedbucket)
+	first := work.First.PassageID
+	last := work.Last.PassageID
 	imagejs := "urn:cite2:test:googleart.positive:DuererHare1502"
 	switch len(imageref) > 0 {
 	case true:
@@ -369,26 +391,23 @@ func consolidatePage(res http.ResponseWriter, req *http.Request) {
 
 	// adding testing if requestedbucket exists...
 	retrieveddata, _ = BoltRetrieve(dbname, requestedbucket, urn2)
-	retrievedcat, _ = BoltRetrieve(dbname, requestedbucket, requestedbucket)
+	retrievedcat, _ = BoltRetrieve(dbname, catalogBucket, requestedbucket)
 	retrievedcatjson = BoltCatalog{}
-	retrievedPassage = BoltURN{}
+	retrievedPassage = gocite.Passage{}
 	json.Unmarshal([]byte(retrieveddata.JSON), &retrievedPassage)
 	json.Unmarshal([]byte(retrievedcat.JSON), &retrievedcatjson)
 
-	ctsurn = retrievedPassage.URN
-	text = ""
-	linetext = retrievedPassage.LineText
-	for i := range linetext {
-		text = text + linetext[i]
-		if i < len(linetext)-1 {
-			text = text + " "
-		}
+	ctsurn = retrievedPassage.PassageID
+	text = strings.Replace(alignmentText(retrievedPassage, settings), "\r\n", " ", -1)
+	previous = retrievedPassage.Prev.PassageID
+	next = retrievedPassage.Next.PassageID
+	imageref = []string{}
+	for _, tmp := range retrievedPassage.ImageLinks {
+		imageref = append(imageref, tmp.Object)
 	}
-	previous = retrievedPassage.Previous
-	next = retrievedPassage.Next
-	imageref = retrievedPassage.ImageRef
-	first = retrievedPassage.First
-	last = retrievedPassage.Last
+	work, _ = BoltRetrieveWork(dbname, requestedbucket)
+	first = work.First.PassageID
+	last = work.Last.PassageID
 	imagejs = "urn:cite2:test:googleart.positive:DuererHare1502"
 	switch len(imageref) > 0 {
 	case true:
@@ -422,7 +441,7 @@ func consolidatePage(res http.ResponseWriter, req *http.Request) {
 		CatOn:         caton,
 		CatLan:        catlan}
 
-	compPage, _ := loadCompPage(transcription, transcription2)
+	compPage, _ := loadCompPage(transcription, transcription2, settings)
 	renderCompTemplate(res, "consolidate", compPage)
 }
 
@@ -449,7 +468,7 @@ func EditPage(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	urn := vars["urn"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 	work, _ := BoltRetrieveWork(dbname, requestedbucket)
@@ -470,6 +489,7 @@ func EditPage(res http.ResponseWriter, req *http.Request) {
 		imagejs = imageref[0]
 	}
 
+	version, _ := BoltRetrieveVersion(dbname, urn)
 	transcription := Transcription{
 		CTSURN:        retrievedPassage.PassageID,
 		Transcriber:   user,
@@ -480,7 +500,8 @@ func EditPage(res http.ResponseWriter, req *http.Request) {
 		Last:          work.Last.PassageID,
 		TextRef:       textref,
 		ImageRef:      imageref,
-		ImageJS:       imagejs}
+		ImageJS:       imagejs,
+		Version:       version}
 
 	kind := "/edit/"
 	page, _ := loadPage(transcription, kind)
@@ -511,7 +532,7 @@ func EditPageFormat(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	urn := vars["urn"]
 	format := vars["format"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 	work, _ := BoltRetrieveWork(dbname, requestedbucket)
@@ -532,6 +553,7 @@ func EditPageFormat(res http.ResponseWriter, req *http.Request) {
 		imagejs = imageref[0]
 	}
 
+	version, _ := BoltRetrieveVersion(dbname, urn)
 	transcription := Transcription{
 		CTSURN:        retrievedPassage.PassageID,
 		Transcriber:   user,
@@ -542,7 +564,8 @@ func EditPageFormat(res http.ResponseWriter, req *http.Request) {
 		Last:          work.Last.PassageID,
 		TextRef:       textref,
 		ImageRef:      imageref,
-		ImageJS:       imagejs}
+		ImageJS:       imagejs,
+		Version:       version}
 
 	kind := "/edit/"
 	page, _ := loadPage(transcription, kind)
@@ -575,7 +598,7 @@ func Edit2Page(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	urn := vars["urn"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 
@@ -602,6 +625,7 @@ func Edit2Page(res http.ResponseWriter, req *http.Request) {
 	case true:
 		imagejs = imageref[0]
 	}
+	version, _ := BoltRetrieveVersion(dbname, urn)
 	transcription := Transcription{CTSURN: ctsurn,
 		Transcriber:   user,
 		Transcription: text,
@@ -611,7 +635,8 @@ func Edit2Page(res http.ResponseWriter, req *http.Request) {
 		Last:          last,
 		TextRef:       textref,
 		ImageRef:      imageref,
-		ImageJS:       imagejs}
+		ImageJS:       imagejs,
+		Version:       version}
 	kind := "/edit2/"
 	page, _ := loadPage(transcription, kind)
 	renderTemplate(res, "edit2", page)
@@ -639,13 +664,29 @@ func EditCatPage(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	urn := vars["urn"]
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	textref := Buckets(dbname)
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
 
+	//Save the submitted catalog entry of the work. Its URN is the one of the requested work.
+	if req.Method == "POST" {
+		req.ParseForm()
+		meta := cexMeta{URN: requestedbucket, CitationScheme: req.FormValue("scheme"), GroupName: req.FormValue("workgroup"),
+			WorkTitle: req.FormValue("title"), VersionLabel: req.FormValue("version"), ExemplarLabel: req.FormValue("exemplar"),
+			Online: req.FormValue("online"), Language: req.FormValue("language")}
+		err = updateWorkMeta(user, meta)
+		if err != nil {
+			log.Printf("EditCatPage: %s\n", err)
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(res, req, config.Host+"/editcat/"+urn+"/", http.StatusSeeOther)
+		return
+	}
+
 	// adding testing if requestedbucket exists...
 	retrieveddata, _ := BoltRetrieve(dbname, requestedbucket, urn)
-	retrievedcat, _ := BoltRetrieve(dbname, requestedbucket, requestedbucket)
+	retrievedcat, _ := BoltRetrieve(dbname, catalogBucket, requestedbucket)
 	retrievedWork, _ := BoltRetrieveWork(dbname, requestedbucket)
 	retrievedcatjson := BoltCatalog{}
 	retrievedPassage := gocite.Passage{}
@@ -698,7 +739,7 @@ func MultiPage(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	urn := vars["urn"]
 
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	vquery := req.URL.Query()
 	keep := vquery.Get("keep")
@@ -706,153 +747,64 @@ func MultiPage(res http.ResponseWriter, req *http.Request) {
 	var alignments Alignments
 
 	requestedbucket := strings.Join(strings.Split(urn, ":")[0:4], ":") + ":"
-	work := strings.Join(strings.Split(strings.Split(requestedbucket, ":")[3], ".")[0:1], ".")
 	retrieveddata, _ := BoltRetrieve(dbname, requestedbucket, urn)
 	retrievedPassage := gocite.Passage{}
 	retrievedWork, _ := BoltRetrieveWork(dbname, requestedbucket)
 	json.Unmarshal([]byte(retrieveddata.JSON), &retrievedPassage)
 	id1 := retrievedPassage.PassageID
-	text1 := retrievedPassage.Text.TXT
-	if config.UseNormalization && retrievedPassage.Text.Normalised != "" {
-		text1 = retrievedPassage.Text.Normalised
-	} // config setting updated only on restart since loadConfiguration() in brucheion.go
 	next1 := retrievedPassage.Next.PassageID
 	previous1 := retrievedPassage.Prev.PassageID
 	first1 := retrievedWork.First.PassageID
 	last1 := retrievedWork.Last.PassageID
-	ids := []string{}
-	texts := []string{}
-	passageID := strings.Split(urn, ":")[4]
 
 	buckets := Buckets(dbname)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("MultiPage: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	for i := range buckets {
-		if buckets[i] == requestedbucket {
-			continue
-		}
-		if !gocite.IsCTSURN(buckets[i]) {
-			continue
-		}
-		if strings.Join(strings.Split(strings.Split(buckets[i], ":")[3], ".")[0:1], ".") != work {
-			continue
-		}
-		db.View(func(tx *bolt.Tx) error {
-			// Assume bucket exists and has keys
-			b := tx.Bucket([]byte(buckets[i]))
-
-			c := b.Cursor()
-
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				retrievedPassage := gocite.Passage{}
-				json.Unmarshal([]byte(v), &retrievedPassage)
-				ctsurn := retrievedPassage.PassageID
-				if ctsurn == "" {
-					continue
-				}
-				if passageID != strings.Split(ctsurn, ":")[4] {
-					continue
-				}
-				text := retrievedPassage.Text.TXT
-				if config.UseNormalization && retrievedPassage.Text.Normalised != "" {
-					text = retrievedPassage.Text.Normalised
-				} // config setting updated only on restart since loadConfiguration() in brucheion.go
-
-				// make sure only witness that contain text are included
-				if len(strings.Replace(text, " ", "", -1)) > 5 {
-					ids = append(ids, ctsurn)
-					texts = append(texts, text)
-				}
-			}
-
-			return nil
-		})
+	settings, err := requestAlignmentSettings(db, requestedbucket, vquery)
+	if err != nil {
+		db.Close()
+		http.Error(res, err.Error(), alignmentErrorStatus(err))
+		return
 	}
+	text1 := alignmentText(retrievedPassage, settings)
+	var ids, texts []string
+	db.View(func(tx *bolt.Tx) error {
+		ids, texts = passageWitnesses(tx, urn, settings)
+		return nil
+	})
+	siglum, err := loadSigla(db)
 	db.Close()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	switch keep == "true" {
-	case true:
-		dbkey := []byte(id1)
-		db, err := openBoltDB(dbname) //open bolt DB using helper function
+	if keep == "true" {
+		db, err := openUserDB(user)
 		if err != nil {
-			log.Println(fmt.Printf("requestImgID: error opening userDB: %s", err))
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = db.View(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte("alignmentsCollection"))
-			if bucket == nil {
-				return errors.New("failed to get bucket")
-			}
-			val := bucket.Get(dbkey)
-			if val == nil {
-				return errors.New("failed to retrieve value")
-			}
-			alignments, err = gobDecodeAlignments(val)
-			if err != nil {
-				return err
-			}
-			return nil
-		})
-		if err != nil {
+		alignments, err = getAlignments(db, id1)
+		db.Close()
+		switch {
+		case errors.Is(err, errStaleCollation):
+			keep = "false" //collated before the witnesses shared their columns, so collate again
+		case err != nil:
 			log.Println(fmt.Printf("error retrieving alignments: %s", err))
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		db.Close()
-	default:
-		alignments = nwa2(text1, id1, texts, ids)
+	}
+	if keep != "true" {
+		alignments = nwa2(text1, id1, texts, ids, settings)
 		aligntime := time.Now()
 		alignments.AlignmentTime = aligntime.Format("20060102150405")
 		alignments.AlignmentID = id1
-		// building the lemmata
-		slsl := [][]string{}
-		for i := range alignments.Alignment {
-			slsl = append(slsl, alignments.Alignment[i].Source)
-		}
-		reordered, ok := testStringSl(slsl)
-		if !ok {
-			panic(ok)
-		}
-		for i := range alignments.Alignment {
-			newset := reordered[i]
-			newsource := []string{}
-			newtarget := []string{}
-			newscore := []float32{}
-			for j := range newset {
-				tmpstr := ""
-				tmpstr2 := ""
-				for _, v := range newset[j] {
-					tmpstr = tmpstr + alignments.Alignment[i].Source[v]
-					tmpstr2 = tmpstr2 + alignments.Alignment[i].Target[v]
-				}
-				newsource = append(newsource, tmpstr)
-				newtarget = append(newtarget, tmpstr2)
-				var highlight float32
-				_, _, score := gonwr.Align([]rune(tmpstr), []rune(tmpstr2), rune('#'), 1, -1, -1)
-				base := len([]rune(tmpstr))
-				if len([]rune(tmpstr2)) > base {
-					base = len([]rune(tmpstr2))
-				}
-				switch {
-				case score <= 0:
-					highlight = 1.0
-				case score >= base:
-					highlight = 0.0
-				default:
-					highlight = 1.0 - float32(score)/(3*float32(base))
-				}
-				newscore = append(newscore, highlight)
-			}
-			alignments.Alignment[i].Score = newscore
-			alignments.Alignment[i].Source = newsource
-			alignments.Alignment[i].Target = newtarget
-		}
-
 		AlignmentsToDB(dbname, alignments)
 	}
 	start := `<div class="tile is-child" lnum="L`
@@ -863,52 +815,45 @@ func MultiPage(res http.ResponseWriter, req *http.Request) {
 	tmpstr := start + strconv.Itoa(1) + `">`
 	tmpstr2 := `<div class="items2">`
 
-	for j, v := range alignments.Alignment[0].Source {
-		var sc float32
-		tmpstr2 = tmpstr2 + `<div id="crit` + strconv.Itoa(j+1) + `" class="content" style="display:none;">`
-		appcrit := make(map[string]string)
-		for k := range alignments.Alignment {
-			sc = sc + alignments.Alignment[k].Score[j]
-			if alignments.Alignment[k].Score[j] > float32(0) {
-				newid := strings.Split(ids[k], ":")[3]
-				newid = strings.Split(newid, ".")[2]
-				item := alignments.Alignment[k].Target[j]
-				newvalue := appcrit[item]
-				if newvalue == "" {
-					newvalue = newvalue + newid
-				} else {
-					newvalue = newvalue + "," + newid
-				}
-				appcrit[item] = newvalue
-			}
+	//the apparatus of the base text, or just its words if there are no other witnesses
+	apparatus := buildApparatus(alignments, siglum)
+	if len(apparatus.Lemmata) == 0 {
+		for j, word := range alignWitnesses([]string{text1}, settings)[0] {
+			apparatus.Lemmata = append(apparatus.Lemmata, ApparatusEntry{Column: j, Text: word})
 		}
-		appcount := 1
-		for key, value := range appcrit {
-			tmpstr2 = tmpstr2 + strconv.Itoa(appcount) + "."
-			valueSl := strings.Split(value, ",")
-			for _, valui := range valueSl {
-				tmpstr2 = tmpstr2 + `<a href="#` + valui + `" onclick="highlfunc(this);">` + valui + `</a> `
+	}
+	for j, lemma := range apparatus.Lemmata {
+		tmpstr2 = tmpstr2 + `<div id="crit` + strconv.Itoa(j+1) + `" class="content" style="display:none;">`
+		for n, reading := range lemma.Readings {
+			tmpstr2 = tmpstr2 + strconv.Itoa(n+1) + "."
+			for _, siglum := range reading.Witnesses {
+				tmpstr2 = tmpstr2 + `<a href="#` + siglum + `" onclick="highlfunc(this);">` + siglum + `</a> `
 			}
-			tmpstr2 = tmpstr2 + addSansHyphens(key) + `<br/>`
-			appcount++
+			tmpstr2 = tmpstr2 + readingHTML(reading) + `<br/>`
 		}
 		tmpstr2 = tmpstr2 + end
-		sc = sc / float32(len(alignments.Alignment))
-		s := fmt.Sprintf("%.2f", sc)
-		tmpstr = tmpstr + "<span hyphens=\"manual\" style=\"background: rgba(255, 221, 87, " + s + ");\" id=\"" + strconv.Itoa(j+1) + "\" alignment=\"" + strconv.Itoa(j+1) + "\">" + addSansHyphens(v) + "</span>" + " "
+		s := fmt.Sprintf("%.2f", lemma.Divergence)
+		text := addSansHyphens(lemma.Text)
+		if lemma.Text == "" {
+			text = "‸" //the witnesses add words here
+		}
+		tmpstr = tmpstr + "<span hyphens=\"manual\" style=\"background: rgba(255, 221, 87, " + s + ");\" id=\"" + strconv.Itoa(j+1) + "\" alignment=\"" + strconv.Itoa(j+1) + "\">" + text + "</span>" + " "
 	}
 	tmpstr2 = tmpstr2 + end
 	tmpstr = tmpstr + end
 	tmpsl = append(tmpsl, tmpstr)
 	for i := range alignments.Alignment {
-		newid := strings.Split(ids[i], ":")[3]
-		newid = strings.Split(newid, ".")[2]
+		newid := siglum(alignments.Name[i])
 		tmpstr := start1 + newid + start2 + strconv.Itoa(i+2) + `">`
 		for j, v := range alignments.Alignment[i].Target {
-			s := fmt.Sprintf("%.2f", alignments.Alignment[i].Score[j])
+			var score float32
+			if j < len(alignments.Alignment[i].Score) {
+				score = alignments.Alignment[i].Score[j]
+			}
+			s := fmt.Sprintf("%.2f", score)
 			tmpstr = tmpstr + "<span hyphens=\"manual\" style=\"background: rgba(165, 204, 107, " + s + ");\" id=\"" + strconv.Itoa(j+1) + "\" alignment=\"" + strconv.Itoa(j+1) + "\">" + addSansHyphens(v) + "</span>" + " "
 		}
-		tmpstr = tmpstr + `<br><br/><a class="button is-small is-primary" href = "#" onClick="MyWindow=window.open('` + config.Host + "/view/" + ids[i] + `','MyWindow'); return false;">PassageView</a>` + end
+		tmpstr = tmpstr + `<br><br/><a class="button is-small is-primary" href = "#" onClick="MyWindow=window.open('` + config.Host + "/view/" + alignments.Name[i] + `','MyWindow'); return false;">PassageView</a>` + end
 		tmpsl = append(tmpsl, tmpstr)
 	}
 
@@ -920,9 +865,8 @@ func MultiPage(res http.ResponseWriter, req *http.Request) {
 	tmpstr = tmpstr + end
 	tmpstr = tmpstr + end
 	tmpstr = tmpstr + `<div class="tile is-parent column is-6"><div class="container"><div id="trmenu">`
-	for _, v := range ids {
-		newid := strings.Split(v, ":")[3]
-		newid = strings.Split(newid, ".")[2]
+	for _, v := range alignments.Name {
+		newid := siglum(v)
 		tmpstr = tmpstr + `<a class="button" id="button_` + newid + `" href="#` + newid + `" onclick="highlfunc(this);">` + newid + `</a>`
 	}
 	tmpstr = tmpstr + end
@@ -975,16 +919,16 @@ func SeeAlignment(res http.ResponseWriter, req *http.Request) {
 	urn := vars["urn"]
 	var alignments Alignments
 
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	dbkey := []byte(urn)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("requestImgID: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("alignmentsCollection"))
+		bucket := tx.Bucket([]byte(alignmentsBucket))
 		if bucket == nil {
 			return errors.New("failed to get bucket")
 		}
@@ -992,7 +936,7 @@ func SeeAlignment(res http.ResponseWriter, req *http.Request) {
 		if val == nil {
 			return errors.New("failed to retrieve value")
 		}
-		alignments, err = gobDecodeAlignments(val)
+		alignments, err = decodeAlignments(val)
 		if err != nil {
 			return err
 		}
@@ -1032,16 +976,16 @@ func TableAlignments(res http.ResponseWriter, req *http.Request) {
 	urn := vars["urn"]
 	var alignments Alignments
 
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	dbkey := []byte(urn)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("requestImgID: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("alignmentsCollection"))
+		bucket := tx.Bucket([]byte(alignmentsBucket))
 		if bucket == nil {
 			return errors.New("failed to get bucket")
 		}
@@ -1049,7 +993,7 @@ func TableAlignments(res http.ResponseWriter, req *http.Request) {
 		if val == nil {
 			return errors.New("failed to retrieve value")
 		}
-		alignments, err = gobDecodeAlignments(val)
+		alignments, err = decodeAlignments(val)
 		if err != nil {
 			return err
 		}
@@ -1111,7 +1055,7 @@ func TreePage(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	textref := Buckets(dbname)
 
@@ -1146,7 +1090,7 @@ func CrudPage(res http.ResponseWriter, req *http.Request) {
 
 	log.Println("Breakpoint 3: Before getting the dbname")
 
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 
 	log.Println("Breakpoint 4: In the middle")
 
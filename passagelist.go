@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// boundsBucket holds the WorkBounds of every work by work URN
+const boundsBucket = "bounds"
+
+// Limits of the number of passages of a PassagePage
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// WorkBounds records the first and last passage of a work in reading order and its number
+// of passages, so that they are known without loading the whole work.
+type WorkBounds struct {
+	Work  string `json:"work"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Count int    `json:"count"`
+}
+
+// PassageFilter selects the passages of a PassagePage.
+type PassageFilter struct {
+	Prefix string //passage reference prefix, e.g. "3.1."
+	Empty  *bool  //whether the TXT layer is empty
+	Images *bool  //whether the passage has image links
+}
+
+// PassagePage is a page of the passages of a work in the order of their keys.
+// Next is the cursor of the following page, empty on the last page.
+type PassagePage struct {
+	WorkBounds
+	Passages []gocite.Passage `json:"passages,omitempty"`
+	IDs      []string         `json:"ids,omitempty"`
+	Next     string           `json:"next"`
+}
+
+// boundsOf returns the WorkBounds of a linked work.
+func boundsOf(work gocite.Work) WorkBounds {
+	return WorkBounds{Work: work.WorkID, First: work.First.PassageID, Last: work.Last.PassageID, Count: len(work.Passages)}
+}
+
+// putWorkBounds saves the WorkBounds of a linked work within tx.
+func putWorkBounds(tx *bolt.Tx, work gocite.Work) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(boundsBucket))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(boundsOf(work))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(work.WorkID), value)
+}
+
+// updateWorkBounds recomputes and saves the WorkBounds of the work with the given URN within tx,
+// or deletes them if the work has no bucket.
+func updateWorkBounds(tx *bolt.Tx, workID string) error {
+	bucket := tx.Bucket([]byte(workID))
+	if bucket == nil {
+		if bounds := tx.Bucket([]byte(boundsBucket)); bounds != nil {
+			return bounds.Delete([]byte(workID))
+		}
+		return nil
+	}
+	return putWorkBounds(tx, linkPassages(workID, bucketPassages(bucket)))
+}
+
+// recordedBounds returns the WorkBounds saved for the work with the given URN within tx,
+// and false if none are saved.
+func recordedBounds(tx *bolt.Tx, workID string) (WorkBounds, bool) {
+	var bounds WorkBounds
+	recorded := tx.Bucket([]byte(boundsBucket))
+	if recorded == nil {
+		return bounds, false
+	}
+	value := recorded.Get([]byte(workID))
+	if value == nil || json.Unmarshal(value, &bounds) != nil {
+		return bounds, false
+	}
+	return bounds, true
+}
+
+// workBounds returns the WorkBounds of the work with the given URN within tx.
+// They are computed from the passages if they have not been recorded.
+func workBounds(tx *bolt.Tx, workID string) (WorkBounds, error) {
+	var bounds WorkBounds
+	if recorded := tx.Bucket([]byte(boundsBucket)); recorded != nil {
+		if value := recorded.Get([]byte(workID)); value != nil {
+			err := json.Unmarshal(value, &bounds)
+			return bounds, err
+		}
+	}
+	bucket := tx.Bucket([]byte(workID))
+	if bucket == nil {
+		return bounds, fmt.Errorf("%s: %w", workID, errWorkNotFound)
+	}
+	return boundsOf(linkPassages(workID, bucketPassages(bucket))), nil
+}
+
+// WorkBounds returns the first and last passage of the work with the given URN.
+func (udb *UserDB) WorkBounds(workID string) (WorkBounds, error) {
+	var bounds WorkBounds
+	err := udb.View(func(tx *bolt.Tx) error {
+		var err error
+		bounds, err = workBounds(tx, workID)
+		return err
+	})
+	return bounds, err
+}
+
+// matches reports whether passage passes the filter.
+func (filter PassageFilter) matches(passage gocite.Passage) bool {
+	if filter.Empty != nil && (passage.Text.TXT == "") != *filter.Empty {
+		return false
+	}
+	if filter.Images != nil && (len(passage.ImageLinks) > 0) != *filter.Images {
+		return false
+	}
+	return true
+}
+
+// listPassages returns up to limit passages of the work with the given URN that pass filter,
+// in the order of their keys, starting after the key cursor. Only the IDs are returned with idsOnly.
+// With a prefix filter only the keys starting with it are visited.
+func listPassages(db *UserDB, workID, cursor string, limit int, filter PassageFilter, idsOnly bool) (PassagePage, error) {
+	page := PassagePage{}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workID))
+		if bucket == nil {
+			return fmt.Errorf("%s: %w", workID, errWorkNotFound)
+		}
+		var err error
+		page.WorkBounds, err = workBounds(tx, workID)
+		if err != nil {
+			return err
+		}
+		if idsOnly {
+			page.IDs = []string{}
+		} else {
+			page.Passages = []gocite.Passage{}
+		}
+
+		prefix := []byte(workID + filter.Prefix)
+		c := bucket.Cursor()
+		key, value := c.Seek(prefix)
+		if cursor != "" && bytes.Compare([]byte(cursor), prefix) >= 0 {
+			key, value = c.Seek([]byte(cursor))
+			if key != nil && string(key) == cursor {
+				key, value = c.Next()
+			}
+		}
+		found := 0
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, value = c.Next() {
+			var passage gocite.Passage
+			if json.Unmarshal(value, &passage) != nil || passage.PassageID == "" || !filter.matches(passage) {
+				continue
+			}
+			if found == limit {
+				page.Next = cursor
+				return nil
+			}
+			found++
+			cursor = string(key)
+			if idsOnly {
+				page.IDs = append(page.IDs, passage.PassageID)
+			} else {
+				page.Passages = append(page.Passages, passage)
+			}
+		}
+		return nil
+	})
+	return page, err
+}
+
+// parseBool parses an optional boolean query value; an empty value gives nil.
+func parseBool(value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	result, err := strconv.ParseBool(value)
+	return &result, err
+}
+
+// handleWorkPassages lists the passages of the work {urn} page by page in the order of their keys.
+// The query values are limit (default 100, at most 1000), cursor (the next value of the
+// previous page), idsOnly=true, empty=true|false (whether the text is empty),
+// images=true|false (whether there are image links), and prefix (of the passage reference).
+func handleWorkPassages(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	err = checkWorkURN(urn)
+	if err != nil {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultPageLimit
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			respondWithJSON(w, "error", "bad_request", fmt.Sprintf("limit must be between 1 and %d", maxPageLimit), 400)
+			return
+		}
+	}
+	filter := PassageFilter{Prefix: query.Get("prefix")}
+	var errEmpty, errImages error
+	filter.Empty, errEmpty = parseBool(query.Get("empty"))
+	filter.Images, errImages = parseBool(query.Get("images"))
+	idsOnly, errIDs := parseBool(query.Get("idsOnly"))
+	if errEmpty != nil || errImages != nil || errIDs != nil {
+		respondWithJSON(w, "error", "bad_request", "empty, images, and idsOnly must be true or false", 400)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	page, err := listPassages(db, urn, query.Get("cursor"), limit, filter, idsOnly != nil && *idsOnly)
+	if errors.Is(err, errWorkNotFound) {
+		respondWithError(w, "work_not_found", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("handleWorkPassages: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	respondWithData(w, page, 200)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+func TestListPassages(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	empty, err := db.GetPassage(testWork + "1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty.Text = gocite.EncText{}
+	pictured, _ := db.GetPassage(testWork + "1.9")
+	pictured.ImageLinks = []gocite.Triple{{Subject: pictured.PassageID, Verb: "urn:cite2:dse:verbs.v1:appears_on",
+		Object: "urn:cite2:test:img.v1:f1"}}
+	putPassages(t, db, testWork, map[string]gocite.Passage{empty.PassageID: empty, pictured.PassageID: pictured})
+	yes, no := true, false
+
+	tests := []struct {
+		name   string
+		cursor string
+		limit  int
+		filter PassageFilter
+		want   []string
+		next   string
+	}{
+		{"first page", "", 3, PassageFilter{}, []string{"1.1", "1.10", "1.2"}, "1.2"},
+		{"last page", testWork + "1.2", 3, PassageFilter{}, []string{"1.9"}, ""},
+		//a page ending with the last passage has no next page
+		{"exactly limit", "", 4, PassageFilter{}, []string{"1.1", "1.10", "1.2", "1.9"}, ""},
+		{"exactly limit after the cursor", testWork + "1.10", 2, PassageFilter{}, []string{"1.2", "1.9"}, ""},
+		{"after the last", testWork + "1.9", 2, PassageFilter{}, []string{}, ""},
+		{"cursor not stored", testWork + "1.15", 2, PassageFilter{}, []string{"1.2", "1.9"}, ""},
+		{"prefix", "", 1, PassageFilter{Prefix: "1.1"}, []string{"1.1"}, "1.1"},
+		{"prefix after the cursor", testWork + "1.1", 1, PassageFilter{Prefix: "1.1"}, []string{"1.10"}, ""},
+		//a cursor before the prefix starts at the prefix
+		{"cursor before the prefix", testWork + "1.1", 5, PassageFilter{Prefix: "1.9"}, []string{"1.9"}, ""},
+		{"cursor before the work", "urn:cts:", 5, PassageFilter{Prefix: "1.2"}, []string{"1.2"}, ""},
+		{"cursor after the prefix", testWork + "1.9", 5, PassageFilter{Prefix: "1.2"}, []string{}, ""},
+		{"empty", "", 5, PassageFilter{Empty: &yes}, []string{"1.2"}, ""},
+		{"not empty", "", 2, PassageFilter{Empty: &no}, []string{"1.1", "1.10"}, "1.10"},
+		{"not empty, exactly limit after the cursor", testWork + "1.10", 1, PassageFilter{Empty: &no}, []string{"1.9"}, ""},
+		{"images", "", 5, PassageFilter{Images: &yes}, []string{"1.9"}, ""},
+	}
+	for _, test := range tests {
+		for _, idsOnly := range []bool{false, true} {
+			page, err := listPassages(db, testWork, test.cursor, test.limit, test.filter, idsOnly)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			got := []string{}
+			for _, id := range page.IDs {
+				got = append(got, passageReference(id))
+			}
+			for _, passage := range page.Passages {
+				got = append(got, passageReference(passage.PassageID))
+			}
+			if idsOnly && page.Passages != nil || !idsOnly && page.IDs != nil {
+				t.Errorf("%s, idsOnly %v: %+v", test.name, idsOnly, page)
+			}
+			next := test.next
+			if next != "" {
+				next = testWork + next
+			}
+			if !reflect.DeepEqual(got, test.want) || page.Next != next {
+				t.Errorf("%s, idsOnly %v: %v next %q, want %v next %q", test.name, idsOnly, got, page.Next, test.want, next)
+			}
+			want := WorkBounds{Work: testWork, First: testWork + "1.1", Last: testWork + "1.10", Count: 4}
+			if page.WorkBounds != want {
+				t.Errorf("%s: bounds %+v, want %+v", test.name, page.WorkBounds, want)
+			}
+		}
+	}
+
+	if _, err := listPassages(db, "urn:cts:sktlit:skt0001.nyaya002.J1D:", "", 5, PassageFilter{}, false); !errors.Is(err, errWorkNotFound) {
+		t.Errorf("listing a missing work: %v", err)
+	}
+}
+
+func TestPutPassageBounds(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	bounds := func() WorkBounds {
+		var bounds WorkBounds
+		db.View(func(tx *bolt.Tx) error {
+			var ok bool
+			if bounds, ok = recordedBounds(tx, testWork); !ok {
+				t.Error("no bounds recorded")
+			}
+			return nil
+		})
+		return bounds
+	}
+	if got, want := bounds(), (WorkBounds{testWork, testWork + "1.1", testWork + "1.10", 4}); got != want {
+		t.Errorf("bounds after the import: %+v, want %+v", got, want)
+	}
+
+	middle, _ := db.GetPassage(testWork + "1.2")
+	middle.Text = gocite.EncText{TXT: "dvitīyaḥ", Brucheion: "dvitīyaḥ"}
+	last, _ := db.GetPassage(testWork + "1.10")
+	last.Next = gocite.PassLoc{Exists: true, PassageID: testWork + "1.11", Index: 4}
+	for _, passage := range []gocite.Passage{middle, last, {PassageID: testWork + "1.11", Index: 4,
+		Prev: gocite.PassLoc{Exists: true, PassageID: testWork + "1.10", Index: 3}}} {
+		err := db.PutPassage(passage)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := bounds(), (WorkBounds{testWork, testWork + "1.1", testWork + "1.11", 5}); got != want {
+		t.Errorf("bounds after appending a passage: %+v, want %+v", got, want)
+	}
+
+	_, err := movePassage(db, testWork+"1.1", testWork+"1.11", positionAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bounds(), (WorkBounds{testWork, testWork + "1.2", testWork + "1.1", 5}); got != want {
+		t.Errorf("bounds after moving the first passage: %+v, want %+v", got, want)
+	}
+}
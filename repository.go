@@ -0,0 +1,353 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// userDBCacheSize is the number of Bolt databases kept open by userDBs
+const userDBCacheSize = 32
+
+// userDBs holds the open user databases. Bolt locks its file exclusively,
+// so every user database must only be opened through it.
+var userDBs = newRepository(userDBCacheSize, migrateUserDB)
+
+// sharedDBs holds the open databases shared by all users, i.e. config.UserDB.
+var sharedDBs = newRepository(1, nil)
+
+// Repository keeps one long-lived *bolt.DB per database file. Handles are reference counted
+// and the least recently used unreferenced handles are closed when more than size are open.
+type Repository struct {
+	mu      sync.Mutex
+	size    int
+	handles map[string]*list.Element //path -> element of lru holding a *repositoryEntry
+	lru     *list.List               //most recently used first
+	migrate func(db *bolt.DB) error  //run when a database is opened, may be nil
+}
+
+// repositoryEntry is an open database in a Repository.
+type repositoryEntry struct {
+	path     string
+	db       *bolt.DB
+	refs     int
+	migrated bool //whether migrate has been run on db
+}
+
+// UserDB is a database handle borrowed from a Repository. It offers the
+// methods of *bolt.DB; Close returns the handle instead of closing the file.
+type UserDB struct {
+	*bolt.DB
+	repo  *Repository
+	entry *repositoryEntry
+	once  sync.Once
+}
+
+// newRepository returns a Repository that keeps up to size unreferenced databases open.
+// migrate is run on every database when it is opened.
+func newRepository(size int, migrate func(db *bolt.DB) error) *Repository {
+	return &Repository{size: size, handles: make(map[string]*list.Element), lru: list.New(), migrate: migrate}
+}
+
+// userDBPath returns the path of the database of user.
+func userDBPath(user string) string {
+	return user + ".db"
+}
+
+// openUserDB returns the database of user from userDBs.
+func openUserDB(user string) (*UserDB, error) {
+	return userDBs.Open(userDBPath(user))
+}
+
+// openDB returns a handle to the database at path from sharedDBs if it is config.UserDB,
+// and from userDBs otherwise.
+func openDB(path string) (*UserDB, error) {
+	abs, _ := filepath.Abs(path)
+	shared, _ := filepath.Abs(config.UserDB)
+	if abs == shared {
+		return sharedDBs.Open(path)
+	}
+	return userDBs.Open(path)
+}
+
+// Open returns a handle to the Bolt database at path, opening the file if it is not open yet.
+// Relative paths are resolved against the working directory. The handle must be closed after use.
+func (repo *Repository) Open(path string) (*UserDB, error) {
+	return repo.open(path, true)
+}
+
+// OpenUnmigrated returns a handle to the Bolt database at path like Open, but does not
+// migrate it if it has not been opened through Open yet, e.g. to look at it without changing it.
+func (repo *Repository) OpenUnmigrated(path string) (*UserDB, error) {
+	return repo.open(path, false)
+}
+
+// open returns a handle to the Bolt database at path, running migrate on it first
+// if migrate is set and it has not been migrated yet.
+func (repo *Repository) open(path string, migrate bool) (*UserDB, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	element, ok := repo.handles[abs]
+	if !ok {
+		db, err := openBoltDB(abs)
+		if err != nil {
+			return nil, err
+		}
+		element = repo.lru.PushFront(&repositoryEntry{path: abs, db: db, migrated: repo.migrate == nil})
+		repo.handles[abs] = element
+	}
+	entry := element.Value.(*repositoryEntry)
+	if migrate && !entry.migrated {
+		err = repo.migrate(entry.db)
+		if err != nil {
+			if entry.refs == 0 {
+				entry.db.Close()
+				repo.lru.Remove(element)
+				delete(repo.handles, abs)
+			}
+			return nil, err
+		}
+		entry.migrated = true
+	}
+	repo.lru.MoveToFront(element)
+	entry.refs++
+	repo.evict()
+	return &UserDB{DB: entry.db, repo: repo, entry: entry}, nil
+}
+
+// release returns a reference to entry.
+func (repo *Repository) release(entry *repositoryEntry) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	entry.refs--
+	repo.evict()
+}
+
+// evict closes the least recently used unreferenced databases while more than size are open.
+// Databases in use are never closed, so the cache may temporarily grow beyond size.
+func (repo *Repository) evict() {
+	for element := repo.lru.Back(); element != nil && repo.lru.Len() > repo.size; {
+		prev := element.Prev()
+		entry := element.Value.(*repositoryEntry)
+		if entry.refs == 0 {
+			entry.db.Close()
+			repo.lru.Remove(element)
+			delete(repo.handles, entry.path)
+		}
+		element = prev
+	}
+}
+
+// CloseAll closes all databases that are not in use, e.g. before shutting down.
+func (repo *Repository) CloseAll() {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	size := repo.size
+	repo.size = 0
+	repo.evict()
+	repo.size = size
+}
+
+// Close returns the handle to its Repository. The database stays open for later use.
+func (udb *UserDB) Close() error {
+	udb.once.Do(func() { udb.repo.release(udb.entry) })
+	return nil
+}
+
+// workBucket returns the name of the bucket a passage or work URN is stored in.
+func workBucket(urn string) string {
+	parts := strings.Split(urn, ":")
+	if len(parts) < 4 {
+		return urn
+	}
+	return strings.Join(parts[0:4], ":") + ":"
+}
+
+// Buckets returns the names of all buckets of the database.
+func (udb *UserDB) Buckets() ([]string, error) {
+	var result []string
+	err := udb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			result = append(result, string(name))
+			return nil
+		})
+	})
+	return result, err
+}
+
+// ListWorks returns the URNs of the works in the database in sorted order.
+func (udb *UserDB) ListWorks() ([]string, error) {
+	buckets, err := udb.Buckets()
+	var works []string
+	for _, bucket := range buckets {
+		if gocite.IsCTSURN(bucket) {
+			works = append(works, bucket)
+		}
+	}
+	return works, err
+}
+
+// Get returns a copy of the value stored under key in bucket, or nil if there is none.
+func (udb *UserDB) Get(bucket, key string) ([]byte, error) {
+	var result []byte
+	err := udb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %q not found", bucket)
+		}
+		if value := b.Get([]byte(key)); value != nil {
+			result = append([]byte{}, value...)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetPassage returns the passage with the given URN. The error wraps errPassageNotFound
+// if neither the passage nor its work exists.
+func (udb *UserDB) GetPassage(urn string) (gocite.Passage, error) {
+	var passage gocite.Passage
+	var value []byte
+	err := udb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workBucket(urn)))
+		if bucket != nil {
+			value = append([]byte{}, bucket.Get([]byte(urn))...)
+		}
+		return nil
+	})
+	if err != nil {
+		return passage, err
+	}
+	if len(value) == 0 {
+		return passage, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+	}
+	err = json.Unmarshal(value, &passage)
+	return passage, err
+}
+
+// PutPassage saves passage in the bucket of its work, which is created if necessary.
+// The WorkBounds of the work are only recomputed if the passage is new or is the
+// recorded first or last passage, since editing any other passage cannot change them.
+func (udb *UserDB) PutPassage(passage gocite.Passage) error {
+	value, err := json.Marshal(passage)
+	if err != nil {
+		return err
+	}
+	workID := workBucket(passage.PassageID)
+	return udb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(workID))
+		if err != nil {
+			return err
+		}
+		existed := bucket.Get([]byte(passage.PassageID)) != nil
+		err = bucket.Put([]byte(passage.PassageID), value)
+		if err != nil {
+			return err
+		}
+		if existed {
+			if bounds, ok := recordedBounds(tx, workID); ok && passage.PassageID != bounds.First && passage.PassageID != bounds.Last {
+				return nil
+			}
+		}
+		return updateWorkBounds(tx, workID)
+	})
+}
+
+// GetWork returns the work with the given URN and its passages in reading order.
+func (udb *UserDB) GetWork(workID string) (gocite.Work, error) {
+	var work gocite.Work
+	err := udb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workID))
+		if bucket == nil {
+			return fmt.Errorf("work %q not found", workID)
+		}
+		work = linkPassages(workID, bucketPassages(bucket))
+		return nil
+	})
+	return work, err
+}
+
+// GetCatalog returns the catalog entry of the work with the given URN.
+// An empty BoltCatalog is returned if the work has no catalog entry.
+func (udb *UserDB) GetCatalog(workID string) (BoltCatalog, error) {
+	var catalog BoltCatalog
+	err := udb.View(func(tx *bolt.Tx) error {
+		var err error
+		catalog, err = getCatalog(tx, workID)
+		return err
+	})
+	return catalog, err
+}
+
+// PutCatalog saves the catalog entry of a work.
+func (udb *UserDB) PutCatalog(catalog BoltCatalog) error {
+	return udb.Update(func(tx *bolt.Tx) error {
+		return putCatalog(tx, catalog)
+	})
+}
+
+// getCatalog returns the catalog entry of a work within tx.
+func getCatalog(tx *bolt.Tx, workID string) (BoltCatalog, error) {
+	var catalog BoltCatalog
+	bucket := tx.Bucket([]byte(catalogBucket))
+	if bucket == nil {
+		return catalog, nil
+	}
+	value := bucket.Get([]byte(workID))
+	if value == nil {
+		return catalog, nil
+	}
+	err := json.Unmarshal(value, &catalog)
+	return catalog, err
+}
+
+// putCatalog saves the catalog entry of a work within tx.
+func putCatalog(tx *bolt.Tx, catalog BoltCatalog) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(catalogBucket))
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(catalog)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(catalog.URN), value)
+}
+
+// ListImageCollections returns the names of the image collections in the database.
+func (udb *UserDB) ListImageCollections() ([]string, error) {
+	var result []string
+	err := udb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("imgCollection"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, _ []byte) error {
+			result = append(result, string(key))
+			return nil
+		})
+	})
+	return result, err
+}
+
+// GetImageCollection returns the image collection stored under name.
+func (udb *UserDB) GetImageCollection(name string) (imageCollection, error) {
+	value, err := udb.Get("imgCollection", name)
+	if err != nil {
+		return imageCollection{}, err
+	}
+	if value == nil {
+		return imageCollection{}, fmt.Errorf("image collection %q not found", name)
+	}
+	return decodeImgCol(value)
+}
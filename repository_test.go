@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// loadTestCEX imports cex for the user test in a temporary working directory, which is
+// removed after the test, and returns the database of the user.
+func loadTestCEX(t *testing.T, cex string) *UserDB {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	err = loadCEX(strings.NewReader(cex), "test")
+	if err != nil {
+		t.Fatalf("loadCEX: %s", err)
+	}
+	db, err := openUserDB("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		userDBs.CloseAll()
+	})
+	return db
+}
+
+// openPaths returns the base names of the databases open in repo, sorted.
+func openPaths(repo *Repository) []string {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	var names []string
+	for path := range repo.handles {
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRepositoryEviction(t *testing.T) {
+	dir := t.TempDir()
+	repo := newRepository(2, nil)
+	defer repo.CloseAll()
+	open := func(name string) *UserDB {
+		db, err := repo.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	a := open("a.db")
+	b := open("b.db")
+	c := open("c.db")
+	if got := openPaths(repo); !reflect.DeepEqual(got, []string{"a.db", "b.db", "c.db"}) {
+		t.Fatalf("referenced databases must stay open beyond the size, open: %v", got)
+	}
+	again := open("a.db")
+	if again.DB != a.DB {
+		t.Errorf("a second handle of a.db has another *bolt.DB")
+	}
+	again.Close()
+	again.Close() //closing twice returns the handle once
+
+	b.Close() //b is the least recently used unreferenced database
+	if got := openPaths(repo); !reflect.DeepEqual(got, []string{"a.db", "c.db"}) {
+		t.Errorf("after closing b, open: %v, want a.db and c.db", got)
+	}
+	c.Close()
+	open("d.db").Close() //a is still referenced, so c is evicted
+	if got := openPaths(repo); !reflect.DeepEqual(got, []string{"a.db", "d.db"}) {
+		t.Errorf("after opening d, open: %v, want a.db and d.db", got)
+	}
+	err := a.View(func(tx *bolt.Tx) error { return nil })
+	if err != nil {
+		t.Errorf("the referenced a.db was closed: %s", err)
+	}
+	a.Close()
+	repo.CloseAll()
+	if got := openPaths(repo); len(got) != 0 {
+		t.Errorf("after CloseAll, open: %v", got)
+	}
+}
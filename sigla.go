@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// siglaBucket holds the sigla chosen for the witnesses of a user by work URN
+const siglaBucket = "witnessSigla"
+
+// maxSiglumLength is the number of characters a siglum may have at most
+const maxSiglumLength = 16
+
+// siglumPunctuation are the characters besides letters and numbers a siglum may contain
+const siglumPunctuation = ".-_*'+()"
+
+// Errors of the witness sigla
+var (
+	errSiglumNotFound = errors.New("no siglum chosen for the work")
+	errBadSiglum      = errors.New("bad siglum")
+	errSiglumInUse    = errors.New("the siglum is used for another witness")
+)
+
+// WitnessSiglum is the siglum a witness (a version of a work) is cited by in the apparatus and the exports.
+type WitnessSiglum struct {
+	Work   string `json:"work"`
+	Siglum string `json:"siglum"`
+	Chosen bool   `json:"chosen"` //false for the exemplar part of the work identifier used without a chosen siglum
+}
+
+// checkSiglum returns an error wrapping errBadSiglum if siglum cannot cite a witness.
+func checkSiglum(siglum string) error {
+	switch {
+	case siglum == "":
+		return fmt.Errorf("the siglum must not be empty: %w", errBadSiglum)
+	case len([]rune(siglum)) > maxSiglumLength:
+		return fmt.Errorf("the siglum must not be longer than %d characters: %w", maxSiglumLength, errBadSiglum)
+	case strings.IndexFunc(siglum, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsMark(r) && !strings.ContainsRune(siglumPunctuation, r)
+	}) >= 0:
+		return fmt.Errorf("the siglum may only contain letters, numbers, and %s: %w", siglumPunctuation, errBadSiglum)
+	}
+	return nil
+}
+
+// getSigla returns the chosen sigla within tx by work URN.
+func getSigla(tx *bolt.Tx) map[string]string {
+	sigla := make(map[string]string)
+	bucket := tx.Bucket([]byte(siglaBucket))
+	if bucket == nil {
+		return sigla
+	}
+	bucket.ForEach(func(work, siglum []byte) error {
+		sigla[string(work)] = string(siglum)
+		return nil
+	})
+	return sigla
+}
+
+// loadSigla returns a function returning the siglum of the witness with the given passage
+// or work URN: the siglum chosen for its work, or witnessSiglum for works without one.
+func loadSigla(db *UserDB) (func(urn string) string, error) {
+	var sigla map[string]string
+	err := db.View(func(tx *bolt.Tx) error {
+		sigla = getSigla(tx)
+		return nil
+	})
+	return func(urn string) string {
+		if siglum, ok := sigla[workBucket(urn)]; ok {
+			return siglum
+		}
+		return witnessSiglum(urn)
+	}, err
+}
+
+// putSiglum saves siglum as the siglum of the work with the given URN within tx.
+// No two works may share a siglum, whether chosen or the default of witnessSiglum,
+// nor sigla that only differ in the characters teiID replaces.
+func putSiglum(tx *bolt.Tx, workID, siglum string) error {
+	if !workExists(tx, workID) {
+		return fmt.Errorf("%s: %w", workID, errWorkNotFound)
+	}
+	chosen := getSigla(tx)
+	for _, work := range workBuckets(tx) {
+		other, ok := chosen[work]
+		if !ok {
+			other = witnessSiglum(work)
+		}
+		if work != workID && teiID(other) == teiID(siglum) {
+			return fmt.Errorf("%s is the siglum of %s: %w", other, work, errSiglumInUse)
+		}
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(siglaBucket))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(workID), []byte(siglum))
+}
+
+// handleSigla returns the WitnessSiglum of every work of the user, sorted by work URN.
+func handleSigla(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	sigla := []WitnessSiglum{}
+	db.View(func(tx *bolt.Tx) error {
+		chosen := getSigla(tx)
+		works := workBuckets(tx)
+		sort.Strings(works)
+		for _, work := range works {
+			siglum, ok := chosen[work]
+			if !ok {
+				siglum = witnessSiglum(work)
+			}
+			sigla = append(sigla, WitnessSiglum{Work: work, Siglum: siglum, Chosen: ok})
+		}
+		return nil
+	})
+	respondWithData(w, sigla, 200)
+}
+
+// handleWorkSiglum returns (GET), chooses (PUT), or resets (DELETE) the siglum the work {urn}
+// is cited by as a witness. PUT takes a WitnessSiglum of which only the siglum is read.
+func handleWorkSiglum(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	err = checkWorkURN(urn)
+	if err != nil {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	result := WitnessSiglum{Work: urn}
+	switch r.Method {
+	case http.MethodGet:
+		err = db.View(func(tx *bolt.Tx) error {
+			if !workExists(tx, urn) {
+				return fmt.Errorf("%s: %w", urn, errWorkNotFound)
+			}
+			result.Siglum, result.Chosen = getSigla(tx)[urn]
+			return nil
+		})
+	case http.MethodPut:
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		var request WitnessSiglum
+		err = json.Unmarshal(body.Bytes(), &request)
+		if err != nil {
+			respondWithJSON(w, "error", "bad_siglum", err.Error(), 400)
+			return
+		}
+		result.Siglum, result.Chosen = strings.TrimSpace(request.Siglum), true
+		err = checkSiglum(result.Siglum)
+		if err == nil {
+			err = db.Update(func(tx *bolt.Tx) error {
+				return putSiglum(tx, urn, result.Siglum)
+			})
+		}
+	case http.MethodDelete:
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(siglaBucket))
+			if bucket == nil || bucket.Get([]byte(urn)) == nil {
+				return fmt.Errorf("%s: %w", urn, errSiglumNotFound)
+			}
+			return bucket.Delete([]byte(urn))
+		})
+		if err == nil {
+			respondWithJSON(w, "success", "siglum_deleted", nil, 200)
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, errWorkNotFound):
+		respondWithError(w, "work_not_found", 404)
+	case errors.Is(err, errSiglumNotFound):
+		respondWithError(w, "siglum_not_found", 404)
+	case errors.Is(err, errBadSiglum):
+		respondWithJSON(w, "error", "bad_siglum", err.Error(), 400)
+	case errors.Is(err, errSiglumInUse):
+		respondWithJSON(w, "error", "siglum_in_use", err.Error(), 409)
+	case err != nil:
+		log.Printf("handleWorkSiglum: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	default:
+		if !result.Chosen {
+			result.Siglum = witnessSiglum(urn)
+		}
+		respondWithData(w, result, 200)
+	}
+}
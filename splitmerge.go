@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// folioMarker matches the folio annotations of a transcription, e.g. {1r}
+var folioMarker = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// PassageChange is the result of a split or merge: the new reading order
+// of the work and the passages that were created or changed.
+type PassageChange struct {
+	WorkOrder
+	Changed []gocite.Passage `json:"changed"`
+}
+
+// viewWork applies edit to the work with the given URN like editWork, but does not save the result.
+func viewWork(db *UserDB, workID string, edit func(work gocite.Work) (gocite.Work, error)) (gocite.Work, error) {
+	var result gocite.Work
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(workID))
+		if bucket == nil {
+			return fmt.Errorf("work %s: %w", workID, errPassageNotFound)
+		}
+		work, err := edit(linkPassages(workID, bucketPassages(bucket)))
+		if err != nil {
+			return err
+		}
+		result = relink(work)
+		return nil
+	})
+	return result, err
+}
+
+// changePassages runs edit on the work with the given URN, saving the result unless preview is set,
+// and returns the new reading order together with the passages whose URNs edit reported.
+func changePassages(db *UserDB, workID string, preview bool, edit func(work gocite.Work) (gocite.Work, []string, error)) (PassageChange, error) {
+	var changed []string
+	run := editWork
+	if preview {
+		run = viewWork
+	}
+	work, err := run(db, workID, func(work gocite.Work) (gocite.Work, error) {
+		var err error
+		work, changed, err = edit(work)
+		return work, err
+	})
+	if err != nil {
+		return PassageChange{}, err
+	}
+	result := PassageChange{WorkOrder: workOrder(work), Changed: []gocite.Passage{}}
+	for _, urn := range changed {
+		passage, err := gocite.GetPassageByID(urn, work)
+		if err == nil {
+			result.Changed = append(result.Changed, passage)
+		}
+	}
+	return result, nil
+}
+
+// splitReferences returns the references of the two parts of a passage with the given
+// reference, following citationScheme. A range a-b of adjacent references is split into a and b.
+// A reference with fewer levels than the scheme gets a sub-level (1.2 becomes 1.2.1 and 1.2.2);
+// otherwise, and for the other ranges, the first part keeps the reference and the second gets
+// the next free letter (1.2.3 and 1.2.3a, 1.2.3a and 1.2.3b). taken reports whether a reference
+// is used already. The error wraps errPassageExists if no letter is free.
+func splitReferences(reference, citationScheme string, taken func(string) bool) (string, string, error) {
+	parts := strings.Split(reference, "-")
+	if len(parts) == 2 && adjacentReferences(parts[0], parts[1]) && !taken(parts[0]) && !taken(parts[1]) {
+		return parts[0], parts[1], nil
+	}
+	if len(parts) == 1 && citationScheme != "" && strings.Count(reference, ".") < strings.Count(citationScheme, ".") {
+		first, second := reference+".1", reference+".2"
+		if !taken(first) && !taken(second) {
+			return first, second, nil
+		}
+	}
+	base, letter := reference, 'a'
+	if last := rune(reference[len(reference)-1]); last >= 'a' && last < 'z' {
+		base, letter = reference[:len(reference)-1], last+1
+	}
+	for ; letter <= 'z'; letter++ {
+		if !taken(base + string(letter)) {
+			return reference, base + string(letter), nil
+		}
+	}
+	return "", "", fmt.Errorf("no free reference after %s: %w", reference, errPassageExists)
+}
+
+// adjacentReferences reports whether the reference b follows a on the same level,
+// e.g. 1.3 follows 1.2, so that no reference lies between them.
+func adjacentReferences(a, b string) bool {
+	i, j := strings.LastIndex(a, "."), strings.LastIndex(b, ".")
+	if a[:i+1] != b[:j+1] {
+		return false
+	}
+	first, err := strconv.Atoi(a[i+1:])
+	if err != nil {
+		return false
+	}
+	second, err := strconv.Atoi(b[j+1:])
+	return err == nil && second == first+1
+}
+
+// mergeReference returns the range covering the references first and second,
+// which may be ranges themselves (1.2 and 1.3 give 1.2-1.3, 1.2-1.3 and 1.4 give 1.2-1.4).
+func mergeReference(first, second string) string {
+	start := strings.Split(first, "-")[0]
+	parts := strings.Split(second, "-")
+	return start + "-" + parts[len(parts)-1]
+}
+
+// folioOf returns the folio marker an image link refers to, if its object ID
+// is the marker or ends with it after a separator (B1_1v for {1v}).
+func folioOf(link gocite.Triple, markers []string) (string, bool) {
+	object := imageObject(link.Object)
+	id := object[strings.LastIndex(object, ":")+1:]
+	for _, marker := range markers {
+		if id == marker || strings.HasSuffix(id, "_"+marker) || strings.HasSuffix(id, "."+marker) || strings.HasSuffix(id, "-"+marker) {
+			return marker, true
+		}
+	}
+	return "", false
+}
+
+// folioMarkers returns the folio markers of text in order.
+func folioMarkers(text string) []string {
+	var markers []string
+	for _, match := range folioMarker.FindAllStringSubmatch(text, -1) {
+		markers = append(markers, match[1])
+	}
+	return markers
+}
+
+// splitImageLinks distributes the image links of a passage split into first and second.
+// Links to a folio marked in one part go to that part. Links to no marked folio, i.e. to the
+// folio the passage starts on, go to the first part. The second part also starts on the folio
+// the first part ends on, unless it begins with a folio marker itself.
+func splitImageLinks(links []gocite.Triple, first, second string) ([]gocite.Triple, []gocite.Triple) {
+	firstMarkers, secondMarkers := folioMarkers(first), folioMarkers(second)
+	continued := ""
+	if len(firstMarkers) > 0 {
+		continued = firstMarkers[len(firstMarkers)-1]
+	}
+	startsOnFolio := folioMarker.FindStringIndex(second) != nil && folioMarker.FindStringIndex(second)[0] == 0
+
+	var firstLinks, secondLinks []gocite.Triple
+	for _, link := range links {
+		marker, marked := folioOf(link, append(append([]string{}, firstMarkers...), secondMarkers...))
+		inFirst := !marked || contains(firstMarkers, marker)
+		inSecond := marked && contains(secondMarkers, marker)
+		if !startsOnFolio && (marked && marker == continued || !marked && continued == "") {
+			inSecond = true
+		}
+		if inFirst {
+			firstLinks = append(firstLinks, link)
+		}
+		if inSecond {
+			secondLinks = append(secondLinks, link)
+		}
+	}
+	return firstLinks, secondLinks
+}
+
+// setSubject returns a copy of links with urn as their subject.
+func setSubject(links []gocite.Triple, urn string) []gocite.Triple {
+	var result []gocite.Triple
+	for _, link := range links {
+		link.Subject = urn
+		result = append(result, link)
+	}
+	return result
+}
+
+// splitText returns the TXT text of a passage split at offset, counted in characters,
+// without the white space around the cut. Folio markers cannot be split. The other text layers are derived from
+// TXT (e.g. by normalisation) and are not kept, since they cannot be split at the same place.
+func splitText(text string, offset int) (gocite.EncText, gocite.EncText, error) {
+	runes := []rune(text)
+	if offset <= 0 || offset >= len(runes) {
+		return gocite.EncText{}, gocite.EncText{}, fmt.Errorf("offset %d is outside of the text: %w", offset, errBadPassage)
+	}
+	cut := len(string(runes[:offset]))
+	for _, marker := range folioMarker.FindAllStringIndex(text, -1) {
+		if marker[0] < cut && cut < marker[1] {
+			return gocite.EncText{}, gocite.EncText{}, fmt.Errorf("offset %d is within a folio marker: %w", offset, errBadPassage)
+		}
+	}
+	first := strings.TrimRightFunc(string(runes[:offset]), unicode.IsSpace)
+	second := strings.TrimLeftFunc(string(runes[offset:]), unicode.IsSpace)
+	return gocite.EncText{TXT: first, Brucheion: strings.Replace(first, "\r\n", "", -1)},
+		gocite.EncText{TXT: second, Brucheion: strings.Replace(second, "\r\n", "", -1)}, nil
+}
+
+// splitPassage splits the passage with the given URN at offset into two passages.
+// The URN of the new passage is newURN, or chosen by splitReferences following citationScheme.
+func splitPassage(work gocite.Work, citationScheme, urn string, offset int, newURN string) (gocite.Work, []string, error) {
+	index, found := gocite.GetIndexByID(urn, work)
+	if !found {
+		return work, nil, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+	}
+	passage := work.Passages[index]
+	firstText, secondText, err := splitText(passage.Text.TXT, offset)
+	if err != nil {
+		return work, nil, err
+	}
+
+	firstURN := urn
+	if newURN == "" {
+		taken := func(reference string) bool {
+			_, found := gocite.GetIndexByID(work.WorkID+reference, work)
+			return found
+		}
+		first, second, err := splitReferences(passageReference(urn), citationScheme, taken)
+		if err != nil {
+			return work, nil, err
+		}
+		firstURN, newURN = work.WorkID+first, work.WorkID+second
+	}
+	if firstURN != urn {
+		err = checkNewPassage(work, firstURN)
+		if err != nil {
+			return work, nil, err
+		}
+	}
+	err = checkNewPassage(work, newURN)
+	if err != nil {
+		return work, nil, err
+	}
+
+	firstLinks, secondLinks := splitImageLinks(passage.ImageLinks, firstText.TXT, secondText.TXT)
+	work.Passages[index].PassageID = firstURN
+	work.Passages[index].Range = false
+	work.Passages[index].Text = firstText
+	work.Passages[index].ImageLinks = setSubject(firstLinks, firstURN)
+	work = relink(work)
+	second := gocite.Passage{PassageID: newURN, Text: secondText, ImageLinks: setSubject(secondLinks, newURN)}
+	work, err = placePassage(work, second, firstURN, positionAfter)
+	return work, []string{firstURN, newURN}, err
+}
+
+// joinText joins the text layers of two passages, TXT and the other layers with a line break.
+func joinText(first, second gocite.EncText) gocite.EncText {
+	join := func(a, b, separator string) string {
+		switch {
+		case a == "":
+			return b
+		case b == "":
+			return a
+		}
+		return a + separator + b
+	}
+	return gocite.EncText{TXT: join(first.TXT, second.TXT, "\r\n"),
+		Brucheion:  join(first.Brucheion, second.Brucheion, ""),
+		MarkDown:   join(first.MarkDown, second.MarkDown, "\r\n"),
+		CEX:        join(first.CEX, second.CEX, "-NEWLINE-"),
+		XML:        join(first.XML, second.XML, "\r\n"),
+		Diplomatic: join(first.Diplomatic, second.Diplomatic, "\r\n"),
+		Normalised: join(first.Normalised, second.Normalised, "\r\n")}
+}
+
+// mergePassage merges the adjacent passages with the URNs urn and other into one passage
+// at the position of the first of them. It is cited by the range of both references.
+func mergePassage(work gocite.Work, urn, other string) (gocite.Work, []string, error) {
+	index, found := gocite.GetIndexByID(urn, work)
+	if !found {
+		return work, nil, fmt.Errorf("%s: %w", urn, errPassageNotFound)
+	}
+	passage := work.Passages[index]
+	var first, second gocite.Passage
+	switch {
+	case passage.Next.Exists && passage.Next.PassageID == other:
+		first, second = passage, work.Passages[passage.Next.Index]
+	case passage.Prev.Exists && passage.Prev.PassageID == other:
+		first, second = work.Passages[passage.Prev.Index], passage
+	default:
+		return work, nil, fmt.Errorf("%s does not follow or precede %s: %w", other, urn, errBadPassage)
+	}
+
+	merged := work.WorkID + mergeReference(passageReference(first.PassageID), passageReference(second.PassageID))
+	links := append([]gocite.Triple{}, first.ImageLinks...)
+	for _, link := range second.ImageLinks {
+		if !containsObject(links, link.Object) {
+			links = append(links, link)
+		}
+	}
+
+	work, err := gocite.DelPassage(second.PassageID, work)
+	if err != nil {
+		return work, nil, err
+	}
+	work = relink(work)
+	if merged != first.PassageID {
+		err = checkNewPassage(work, merged)
+		if err != nil {
+			return work, nil, err
+		}
+	}
+	index, _ = gocite.GetIndexByID(first.PassageID, work)
+	work.Passages[index].PassageID = merged
+	work.Passages[index].Range = true
+	work.Passages[index].Text = joinText(first.Text, second.Text)
+	work.Passages[index].ImageLinks = setSubject(links, merged)
+	return relink(work), []string{merged}, nil
+}
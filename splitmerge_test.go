@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		text          string
+		offset        int
+		first, second gocite.EncText
+		wantErr       bool
+	}{
+		{text: "abc def", offset: 3,
+			first: gocite.EncText{TXT: "abc", Brucheion: "abc"}, second: gocite.EncText{TXT: "def", Brucheion: "def"}},
+		{text: "ṛṣir muniḥ", offset: 4,
+			first: gocite.EncText{TXT: "ṛṣir", Brucheion: "ṛṣir"}, second: gocite.EncText{TXT: "muniḥ", Brucheion: "muniḥ"}},
+		//a line break counts as the two characters \r and \n
+		{text: "ab\r\ncd", offset: 4,
+			first: gocite.EncText{TXT: "ab", Brucheion: "ab"}, second: gocite.EncText{TXT: "cd", Brucheion: "cd"}},
+		{text: "ab\r\ncd", offset: 3,
+			first: gocite.EncText{TXT: "ab", Brucheion: "ab"}, second: gocite.EncText{TXT: "cd", Brucheion: "cd"}},
+		{text: "a b\r\ncd", offset: 1,
+			first: gocite.EncText{TXT: "a", Brucheion: "a"}, second: gocite.EncText{TXT: "b\r\ncd", Brucheion: "bcd"}},
+		{text: "ab{1v}cd", offset: 2,
+			first: gocite.EncText{TXT: "ab", Brucheion: "ab"}, second: gocite.EncText{TXT: "{1v}cd", Brucheion: "{1v}cd"}},
+		{text: "ab{1v}cd", offset: 6,
+			first: gocite.EncText{TXT: "ab{1v}", Brucheion: "ab{1v}"}, second: gocite.EncText{TXT: "cd", Brucheion: "cd"}},
+		{text: "ab{1v}cd", offset: 4, wantErr: true},
+		{text: "abc", offset: 0, wantErr: true},
+		{text: "abc", offset: 3, wantErr: true},
+		{text: "ṛṣi", offset: 4, wantErr: true},
+	}
+	for _, test := range tests {
+		first, second, err := splitText(test.text, test.offset)
+		if test.wantErr {
+			if !errors.Is(err, errBadPassage) {
+				t.Errorf("splitText(%q, %d): error %v, want errBadPassage", test.text, test.offset, err)
+			}
+			continue
+		}
+		if err != nil || first != test.first || second != test.second {
+			t.Errorf("splitText(%q, %d) = %+v, %+v, %v, want %+v, %+v",
+				test.text, test.offset, first, second, err, test.first, test.second)
+		}
+	}
+}
+
+func TestSplitReferences(t *testing.T) {
+	tests := []struct {
+		reference, scheme string
+		taken             []string
+		first, second     string
+	}{
+		{"1.2-1.3", "adhyāya.sūtra", nil, "1.2", "1.3"},
+		{"1.9-1.10", "adhyāya.sūtra", nil, "1.9", "1.10"},
+		//1.3 would be lost between 1.2 and 1.4
+		{"1.2-1.4", "adhyāya.sūtra", nil, "1.2-1.4", "1.2-1.4a"},
+		{"1.2-2.1", "adhyāya.sūtra", nil, "1.2-2.1", "1.2-2.1a"},
+		{"1.2-1.3", "adhyāya.sūtra", []string{"1.3"}, "1.2-1.3", "1.2-1.3a"},
+		{"1.2", "adhyāya.āhnika.sūtra", nil, "1.2.1", "1.2.2"},
+		{"1.2", "adhyāya.āhnika.sūtra", []string{"1.2.1"}, "1.2", "1.2a"},
+		{"1.2-1.3", "adhyāya.āhnika.sūtra", nil, "1.2", "1.3"},
+		{"1.2.3", "adhyāya.āhnika.sūtra", nil, "1.2.3", "1.2.3a"},
+		{"1.2.3", "", []string{"1.2.3a"}, "1.2.3", "1.2.3b"},
+		{"1.2.3a", "adhyāya.āhnika.sūtra", nil, "1.2.3a", "1.2.3b"},
+		{"1.2.3a", "adhyāya.āhnika.sūtra", []string{"1.2.3b"}, "1.2.3a", "1.2.3c"},
+		{"1.2.3y", "adhyāya.āhnika.sūtra", nil, "1.2.3y", "1.2.3z"},
+	}
+	for _, test := range tests {
+		taken := func(reference string) bool { return contains(test.taken, reference) }
+		first, second, err := splitReferences(test.reference, test.scheme, taken)
+		if err != nil || first != test.first || second != test.second {
+			t.Errorf("splitReferences(%q, %q) with %v taken = %q, %q, %v, want %q, %q",
+				test.reference, test.scheme, test.taken, first, second, err, test.first, test.second)
+		}
+	}
+
+	_, _, err := splitReferences("1.2.3x", "", func(reference string) bool { return reference != "1.2.3x" })
+	if !errors.Is(err, errPassageExists) {
+		t.Errorf("splitReferences without a free letter: error %v, want errPassageExists", err)
+	}
+}
+
+func TestMergeReference(t *testing.T) {
+	tests := []struct{ first, second, want string }{
+		{"1.2", "1.3", "1.2-1.3"},
+		{"1.2-1.3", "1.4", "1.2-1.4"},
+		{"1.2", "1.3-1.4", "1.2-1.4"},
+		{"1.2-1.3", "1.4-1.5", "1.2-1.5"},
+		{"1.2.3", "1.2.3a", "1.2.3-1.2.3a"},
+	}
+	for _, test := range tests {
+		if got := mergeReference(test.first, test.second); got != test.want {
+			t.Errorf("mergeReference(%q, %q) = %q, want %q", test.first, test.second, got, test.want)
+		}
+	}
+}
+
+func TestSplitImageLinks(t *testing.T) {
+	link := func(id string) gocite.Triple {
+		return gocite.Triple{Subject: testWork + "1.1", Verb: "urn:cite2:dse:verbs.v1:appears_on",
+			Object: "urn:cite2:test:img.v1:" + id}
+	}
+	links := []gocite.Triple{link("B1_1r"), link("B1_1v@0.1,0.2,0.3,0.4"), link("B1_2r")}
+	tests := []struct {
+		name          string
+		first, second string
+		wantFirst     []gocite.Triple
+		wantSecond    []gocite.Triple
+	}{
+		{"no markers", "ab", "cd",
+			links, links},
+		{"marker in the first part", "a {1v} b", "c",
+			[]gocite.Triple{link("B1_1r"), link("B1_1v@0.1,0.2,0.3,0.4"), link("B1_2r")},
+			[]gocite.Triple{link("B1_1v@0.1,0.2,0.3,0.4")}},
+		{"second part starts on a folio", "a", "{1v} b",
+			[]gocite.Triple{link("B1_1r"), link("B1_2r")},
+			[]gocite.Triple{link("B1_1v@0.1,0.2,0.3,0.4")}},
+		{"marker in the second part", "a", "b {1v} c",
+			[]gocite.Triple{link("B1_1r"), link("B1_2r")},
+			[]gocite.Triple{link("B1_1r"), link("B1_1v@0.1,0.2,0.3,0.4"), link("B1_2r")}},
+		{"markers in both parts", "a {1v} b", "c {2r} d",
+			[]gocite.Triple{link("B1_1r"), link("B1_1v@0.1,0.2,0.3,0.4")},
+			[]gocite.Triple{link("B1_1v@0.1,0.2,0.3,0.4"), link("B1_2r")}},
+	}
+	for _, test := range tests {
+		first, second := splitImageLinks(links, test.first, test.second)
+		if !reflect.DeepEqual(first, test.wantFirst) || !reflect.DeepEqual(second, test.wantSecond) {
+			t.Errorf("%s: splitImageLinks = %v, %v, want %v, %v", test.name, first, second, test.wantFirst, test.wantSecond)
+		}
+	}
+}
+
+func TestSplitMergePassage(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	split := func(urn string, offset int, newURN string, preview bool) (PassageChange, error) {
+		return changePassages(db, testWork, preview, func(work gocite.Work) (gocite.Work, []string, error) {
+			return splitPassage(work, "adhyāya.sūtra", testWork+urn, offset, newURN)
+		})
+	}
+	merge := func(urn, other string, preview bool) (PassageChange, error) {
+		return changePassages(db, testWork, preview, func(work gocite.Work) (gocite.Work, []string, error) {
+			return mergePassage(work, testWork+urn, testWork+other)
+		})
+	}
+	references := func(change PassageChange) []string {
+		var references []string
+		for _, urn := range change.Passages {
+			references = append(references, passageReference(urn))
+		}
+		return references
+	}
+	unchanged := []string{"1.1", "1.2", "1.9", "1.10"}
+
+	change, err := split("1.2", 3, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := references(change), []string{"1.1", "1.2", "1.2a", "1.9", "1.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("previewed split: order %v, want %v", got, want)
+	}
+	if len(change.Changed) != 2 || change.Changed[0].Text.TXT != "dvi" || change.Changed[1].Text.TXT != "tīyam" {
+		t.Errorf("previewed split: changed %+v", change.Changed)
+	}
+	if got := readingOrder(t, db, testWork); !reflect.DeepEqual(got, unchanged) {
+		t.Errorf("a preview changed the order to %v", got)
+	}
+
+	_, err = split("1.2", 3, testWork+"1.9", false)
+	if !errors.Is(err, errPassageExists) {
+		t.Errorf("split into an existing passage: error %v, want errPassageExists", err)
+	}
+	_, err = merge("1.1", "1.9", false)
+	if !errors.Is(err, errBadPassage) {
+		t.Errorf("merge of passages that are not adjacent: error %v, want errBadPassage", err)
+	}
+
+	change, err = merge("1.10", "1.9", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := references(change), []string{"1.1", "1.2", "1.9-1.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merge: order %v, want %v", got, want)
+	}
+	merged, _ := getPassage(t, db, testWork, testWork+"1.9-1.10")
+	if merged.Text.TXT != "navamam\r\ndaśamam" || !merged.Range {
+		t.Errorf("merged passage %+v", merged)
+	}
+	if got, want := readingOrder(t, db, testWork), []string{"1.1", "1.2", "1.9-1.10"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merge: stored order %v, want %v", got, want)
+	}
+
+	//splitting the merged passage where it was merged restores both passages
+	_, err = split("1.9-1.10", 7, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readingOrder(t, db, testWork); !reflect.DeepEqual(got, unchanged) {
+		t.Errorf("split of the merged passage: order %v, want %v", got, unchanged)
+	}
+	for reference, text := range map[string]string{"1.9": "navamam", "1.10": "daśamam"} {
+		passage, _ := getPassage(t, db, testWork, testWork+reference)
+		if passage.Text.TXT != text || passage.Range {
+			t.Errorf("passage %s after the split: %+v", reference, passage)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// teiNamespace is the namespace of TEI P5 documents
+const teiNamespace = "http://www.tei-c.org/ns/1.0"
+
+// xmlText returns s escaped as XML character data.
+func xmlText(s string) string {
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(s))
+	return escaped.String()
+}
+
+// teiID returns the siglum made a valid xml:id: characters that cannot appear in an
+// XML name become underscores, and a w is put in front if it does not start with a letter.
+func teiID(siglum string) string {
+	id := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, siglum)
+	if first := []rune(id + " ")[0]; !unicode.IsLetter(first) && first != '_' {
+		id = "w" + id
+	}
+	return id
+}
+
+// teiWit returns the value of a wit attribute pointing to the witnesses with the given sigla.
+func teiWit(sigla []string) string {
+	var refs []string
+	for _, siglum := range sigla {
+		refs = append(refs, "#"+teiID(siglum))
+	}
+	return strings.Join(refs, " ")
+}
+
+// witnessLabel returns the description of a witness in a listWit or the sigla of an edition.
+func witnessLabel(witness EditionWitness) string {
+	var label []string
+	for _, part := range []string{witness.Catalog.ExemplarLabel, witness.Catalog.VersionLabel} {
+		if part != "" {
+			label = append(label, part)
+		}
+	}
+	if len(label) == 0 {
+		return witness.Work
+	}
+	return strings.Join(label, ", ")
+}
+
+// writeTEI writes edition to w as a TEI P5 document with the apparatus encoded by parallel
+// segmentation: every lemma with variants becomes an app with the lem of the base text
+// and a rdg per variant reading, citing the witnesses declared in the listWit.
+func writeTEI(w io.Writer, edition Edition) error {
+	out := bufio.NewWriter(w)
+	title := edition.Catalog.WorkTitle
+	if title == "" {
+		title = edition.Work
+	}
+	out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	out.WriteString(`<TEI xmlns="` + teiNamespace + `">` + "\n")
+	out.WriteString("  <teiHeader>\n    <fileDesc>\n")
+	out.WriteString("      <titleStmt>\n        <title>" + xmlText(title) + "</title>\n")
+	if edition.Catalog.GroupName != "" {
+		out.WriteString("        <author>" + xmlText(edition.Catalog.GroupName) + "</author>\n")
+	}
+	out.WriteString("      </titleStmt>\n")
+	out.WriteString("      <publicationStmt>\n        <p>Exported from Brucheion</p>\n      </publicationStmt>\n")
+	out.WriteString("      <sourceDesc>\n        <listWit>\n")
+	for _, witness := range edition.Witnesses {
+		out.WriteString(`          <witness xml:id="` + xmlText(teiID(witness.Siglum)) + `" corresp="` + xmlText(witness.Work) + `">` +
+			xmlText(witnessLabel(witness)) + "</witness>\n")
+	}
+	out.WriteString("        </listWit>\n      </sourceDesc>\n    </fileDesc>\n")
+	out.WriteString("    <encodingDesc>\n" + `      <variantEncoding method="parallel-segmentation" location="internal"/>` + "\n    </encodingDesc>\n")
+	if edition.Catalog.Language != "" {
+		out.WriteString("    <profileDesc>\n      <langUsage>\n" + `        <language ident="` + xmlText(edition.Catalog.Language) + `"/>` +
+			"\n      </langUsage>\n    </profileDesc>\n")
+	}
+	out.WriteString("  </teiHeader>\n  <text>\n    <body>\n")
+
+	for _, passage := range edition.Passages {
+		out.WriteString(`      <ab n="` + xmlText(passageRef(passage.URN)) + `" corresp="` + xmlText(passage.URN) + `">`)
+		for i, lemma := range passage.Apparatus.Lemmata {
+			if i > 0 {
+				out.WriteString(" ")
+			}
+			if len(lemma.Readings) == 0 {
+				out.WriteString(xmlText(lemma.Text))
+				continue
+			}
+			out.WriteString("<app>")
+			if lemma.Text == "" {
+				out.WriteString(`<lem wit="` + teiWit(lemma.Agreeing) + `"/>`)
+			} else {
+				out.WriteString(`<lem wit="` + teiWit(lemma.Agreeing) + `">` + xmlText(lemma.Text) + "</lem>")
+			}
+			for _, reading := range lemma.Readings {
+				attributes := `wit="` + teiWit(reading.Witnesses) + `" type="` + reading.Type + `"`
+				if reading.Text == "" {
+					out.WriteString("<rdg " + attributes + "/>")
+				} else {
+					out.WriteString("<rdg " + attributes + ">" + xmlText(reading.Text) + "</rdg>")
+				}
+			}
+			out.WriteString("</app>")
+		}
+		out.WriteString("</ab>\n")
+	}
+	out.WriteString("    </body>\n  </text>\n</TEI>\n")
+	return out.Flush()
+}
+
+// exportFilename returns the name of an export file of the work or passage with the given URN.
+func exportFilename(urn, extension string) string {
+	parts := strings.Split(urn, ":")
+	name := strings.Trim(strings.Join(parts[3:], "_"), "_")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name) + extension
+}
+
+// loadRequestedEdition returns the edition of the work or passage {urn} of r, with the
+// query values from and to (passage URNs) limiting the passages of a work. It answers the
+// request itself if that fails.
+func loadRequestedEdition(w http.ResponseWriter, r *http.Request, db *UserDB, siglum func(urn string) string) (Edition, bool) {
+	urn := mux.Vars(r)["urn"]
+	workID, from, to := urn, r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if checkWorkURN(urn) != nil {
+		workID, from, to = workBucket(urn), urn, urn
+	}
+	if checkWorkURN(workID) != nil || from != "" && workBucket(from) != workID || to != "" && workBucket(to) != workID {
+		respondWithError(w, "bad_urn", 400)
+		return Edition{}, false
+	}
+	edition, err := loadEdition(db, workID, from, to, siglum)
+	switch {
+	case errors.Is(err, errWorkNotFound):
+		respondWithError(w, "work_not_found", 404)
+	case errors.Is(err, errPassageNotFound):
+		respondWithError(w, "passage_not_found", 404)
+	case errors.Is(err, errStaleCollation):
+		respondWithJSON(w, "error", "stale_collation", err.Error(), 409)
+	case err != nil:
+		log.Printf("loadEdition: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	default:
+		return edition, true
+	}
+	return Edition{}, false
+}
+
+// handleTEIExport returns the collation of the passage or work {urn} as a TEI P5 document.
+func handleTEIExport(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	siglum, err := loadSigla(db)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	edition, ok := loadRequestedEdition(w, r, db, siglum)
+	if !ok {
+		return
+	}
+	var content bytes.Buffer
+	err = writeTEI(&content, edition)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/tei+xml; charset=utf-8")
+	w.Header().Set("Content-Disposition", "Attachment; filename="+exportFilename(mux.Vars(r)["urn"], ".xml"))
+	w.Write(content.Bytes())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testEdition returns an edition of one passage whose sigla and text need escaping in the exports.
+func testEdition() Edition {
+	return Edition{
+		Work:    "urn:cts:sktlit:skt0001.nyaya002.M3D:",
+		Catalog: BoltCatalog{WorkTitle: "Nyāya & <sūtra>"},
+		Witnesses: []EditionWitness{
+			{Work: "urn:cts:sktlit:skt0001.nyaya002.M3D:", Siglum: "M'"},
+			{Work: "urn:cts:sktlit:skt0001.nyaya002.C3D:", Siglum: "C(1)"},
+		},
+		Passages: []EditionPassage{{
+			URN:  "urn:cts:sktlit:skt0001.nyaya002.M3D:1",
+			Text: "a<b {2r}c&d",
+			Apparatus: Apparatus{Lemmata: []ApparatusEntry{
+				{Column: 0, Text: "a<b", Agreeing: []string{"M'"}, Readings: []Reading{{Text: "a>b", Type: variantSubstitution, Witnesses: []string{"C(1)"}}}},
+				{Column: 1, Text: "c&d", Agreeing: []string{"M'", "C(1)"}, Readings: []Reading{}},
+			}},
+			Folios: map[int][]string{1: {"2r"}},
+		}},
+	}
+}
+
+func TestTEIID(t *testing.T) {
+	tests := []struct {
+		siglum, want string
+	}{
+		{"M3D", "M3D"},
+		{"M'", "M_"},
+		{"C(1)", "C_1_"},
+		{"A*+", "A__"},
+		{"1", "w1"},
+		{"ṭ.b", "ṭ.b"},
+	}
+	for _, test := range tests {
+		if got := teiID(test.siglum); got != test.want {
+			t.Errorf("teiID(%q) = %q, want %q", test.siglum, got, test.want)
+		}
+	}
+}
+
+func TestWriteTEI(t *testing.T) {
+	var out bytes.Buffer
+	err := writeTEI(&out, testEdition())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<title>Nyāya &amp; &lt;sūtra&gt;</title>",
+		`<witness xml:id="M_" corresp="urn:cts:sktlit:skt0001.nyaya002.M3D:">`,
+		`<witness xml:id="C_1_" corresp="urn:cts:sktlit:skt0001.nyaya002.C3D:">`,
+		`<app><lem wit="#M_">a&lt;b</lem><rdg wit="#C_1_" type="substitution">a&gt;b</rdg></app> c&amp;d</ab>`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("writeTEI output lacks %s:\n%s", want, out.String())
+		}
+	}
+}
@@ -38,11 +38,11 @@ func newText(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	newkey := vars["key"]
 	newbucket := strings.Join(strings.Split(newkey, ":")[0:4], ":") + ":"
-	dbname := user + ".db"
+	dbname := userDBPath(user)
 	retrievedjson := gocite.Passage{}
 	retrievedjson.PassageID = newkey
 	newnode, _ := json.Marshal(retrievedjson)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := userDBs.Open(dbname) //open bolt DB using helper function
 	if err != nil {
 		log.Println(fmt.Printf("newText: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// tokensBucket holds the API tokens (APIToken) in config.UserDB by the SHA-256 hash of the token
+const tokensBucket = "tokens"
+
+// tokenPrefix starts every API token, which makes them easy to recognise in scripts and logs
+const tokenPrefix = "bru_"
+
+// tokenUserKey is the request context key of the user an API token belongs to
+const tokenUserKey = "tokenUser"
+
+// tokenUsageInterval is how often the last use of an API token is recorded at most
+const tokenUsageInterval = time.Minute
+
+// errTokenNotFound is returned for unknown or revoked API tokens
+var errTokenNotFound = errors.New("API token not found")
+
+// APIToken is a named API token of a user. Only the hash of the token is stored.
+type APIToken struct {
+	ID       string    `json:"id"`   //the first characters of the hash, used to revoke the token
+	Name     string    `json:"name"` //chosen by the user, e.g. "nightly export"
+	User     string    `json:"user"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// NewAPIToken is the response to the creation of an API token.
+// The token itself is only shown this once.
+type NewAPIToken struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+// hashToken returns the hex-encoded SHA-256 hash of token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createToken creates a new API token called name for user in config.UserDB.
+func createToken(user, name string) (NewAPIToken, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return NewAPIToken{}, err
+	}
+	token := tokenPrefix + hex.EncodeToString(secret)
+	hash := hashToken(token)
+	result := NewAPIToken{APIToken: APIToken{ID: hash[:12], Name: name, User: user, Created: time.Now().UTC()}, Token: token}
+
+	db, err := sharedDBs.Open(config.UserDB)
+	if err != nil {
+		return NewAPIToken{}, err
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(tokensBucket))
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(result.APIToken)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(hash), value)
+	})
+	return result, err
+}
+
+// resolveToken returns the user an API token belongs to and records its use.
+// The use is written at most once per tokenUsageInterval, so that authenticating
+// a request is a read and does not wait for a write transaction of config.UserDB.
+func resolveToken(token string) (string, error) {
+	db, err := sharedDBs.Open(config.UserDB)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	hash := []byte(hashToken(token))
+	var stored APIToken
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tokensBucket))
+		if bucket == nil || bucket.Get(hash) == nil {
+			return errTokenNotFound
+		}
+		return json.Unmarshal(bucket.Get(hash), &stored)
+	})
+	if err != nil || time.Since(stored.LastUsed) < tokenUsageInterval {
+		return stored.User, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tokensBucket))
+		if bucket == nil || bucket.Get(hash) == nil {
+			return errTokenNotFound //revoked meanwhile
+		}
+		stored.LastUsed = time.Now().UTC()
+		value, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(hash, value)
+	})
+	return stored.User, err
+}
+
+// listTokens returns the API tokens of user, oldest first.
+func listTokens(user string) ([]APIToken, error) {
+	result := []APIToken{}
+	db, err := sharedDBs.Open(config.UserDB)
+	if err != nil {
+		return result, err
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tokensBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, value []byte) error {
+			var token APIToken
+			err := json.Unmarshal(value, &token)
+			if err == nil && token.User == user {
+				result = append(result, token)
+			}
+			return err
+		})
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result, err
+}
+
+// revokeToken deletes the API token of user with the given ID.
+func revokeToken(user, id string) error {
+	db, err := sharedDBs.Open(config.UserDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tokensBucket))
+		if bucket == nil || id == "" {
+			return fmt.Errorf("%s: %w", id, errTokenNotFound)
+		}
+		c := bucket.Cursor()
+		for key, value := c.Seek([]byte(id)); key != nil && strings.HasPrefix(string(key), id); key, value = c.Next() {
+			var token APIToken
+			err := json.Unmarshal(value, &token)
+			if err != nil {
+				return err
+			}
+			if token.ID == id && token.User == user {
+				return bucket.Delete(key)
+			}
+		}
+		return fmt.Errorf("%s: %w", id, errTokenNotFound)
+	})
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header of r, if there is one.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// handleTokens lists (GET) or creates (POST) the API tokens of the user.
+// POST takes the name of the new token as {"name": ...} and returns the token.
+// Tokens can only be created from a login session, not with another token.
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		tokens, err := listTokens(user)
+		if err != nil {
+			respondWithError(w, "internal_error", 500)
+			return
+		}
+		respondWithData(w, tokens, 200)
+		return
+	}
+
+	if _, ok := r.Context().Value(tokenUserKey).(string); ok {
+		respondWithError(w, "session_required", 403)
+		return
+	}
+	var input struct {
+		Name string `json:"name"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&input)
+	if err != nil || strings.TrimSpace(input.Name) == "" {
+		respondWithError(w, "bad_request", 400)
+		return
+	}
+	token, err := createToken(user, strings.TrimSpace(input.Name))
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	respondWithData(w, token, 201)
+}
+
+// handleToken revokes the API token {id} of the user.
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	err = revokeToken(user, mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, errTokenNotFound):
+		respondWithError(w, "token_not_found", 404)
+	case err != nil:
+		respondWithError(w, "internal_error", 500)
+	default:
+		respondWithJSON(w, "success", "token_revoked", nil, 200)
+	}
+}
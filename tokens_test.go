@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// useTestUserDB points config.UserDB to a new database for the duration of the test.
+func useTestUserDB(t *testing.T) {
+	t.Helper()
+	previous := config.UserDB
+	config.UserDB = filepath.Join(t.TempDir(), "users.db")
+	t.Cleanup(func() {
+		sharedDBs.CloseAll()
+		config.UserDB = previous
+	})
+}
+
+func TestBearerToken(t *testing.T) {
+	useTestUserDB(t)
+	var created NewAPIToken
+	w := serveAsUser(t, handleTokens, "POST", nil, `{"name": " nightly export "}`, &created)
+	if w.Code != 201 || created.Name != "nightly export" || created.User != "test" ||
+		!strings.HasPrefix(created.Token, tokenPrefix) || created.ID != hashToken(created.Token)[:12] {
+		t.Fatalf("created token: %d %+v", w.Code, created)
+	}
+
+	//GET requests the user, POST creates a token
+	authenticated := func(token, method string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/v1/user", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		if method == "GET" {
+			requireAuth(handleUser)(w, r)
+		} else {
+			requireAuth(handleTokens)(w, r)
+		}
+		return w
+	}
+
+	w = authenticated(created.Token, "GET", "")
+	var user User
+	json.Unmarshal(w.Body.Bytes(), &JSONResponse{Data: &user})
+	if w.Code != 200 || user.Name != "test" {
+		t.Errorf("request with a valid token: %d %s", w.Code, w.Body)
+	}
+	if w := authenticated(tokenPrefix+"unknown", "GET", ""); w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("request with an unknown token: %d %v", w.Code, w.Header())
+	}
+	if w := authenticated(created.Token, "POST", `{"name": "another"}`); w.Code != 403 {
+		t.Errorf("token creation with a token: %d, want 403", w.Code)
+	}
+
+	var tokens []APIToken
+	serveAsUser(t, handleTokens, "GET", nil, "", &tokens)
+	if len(tokens) != 1 || tokens[0].ID != created.ID || tokens[0].LastUsed.IsZero() {
+		t.Errorf("tokens after their use: %+v", tokens)
+	}
+
+	if err := revokeToken("other", created.ID); !errors.Is(err, errTokenNotFound) {
+		t.Errorf("revoking the token of another user: %v", err)
+	}
+	if w := serveAsUser(t, handleToken, "DELETE", map[string]string{"id": created.ID}, "", nil); w.Code != 200 {
+		t.Errorf("revoking the token: %d", w.Code)
+	}
+	if w := authenticated(created.Token, "GET", ""); w.Code != 401 {
+		t.Errorf("request with a revoked token: %d, want 401", w.Code)
+	}
+	if w := serveAsUser(t, handleToken, "DELETE", map[string]string{"id": created.ID}, "", nil); w.Code != 404 {
+		t.Errorf("revoking the token twice: %d, want 404", w.Code)
+	}
+}
+
+func TestTokenStorage(t *testing.T) {
+	useTestUserDB(t)
+	created, err := createToken("test", "nightly export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sharedDBs.Open(config.UserDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	lastUsed := func() (stored APIToken) {
+		db.View(func(tx *bolt.Tx) error {
+			return json.Unmarshal(tx.Bucket([]byte(tokensBucket)).Get([]byte(hashToken(created.Token))), &stored)
+		})
+		return stored
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tokensBucket)).ForEach(func(key, value []byte) error {
+			if string(key) != hashToken(created.Token) {
+				t.Errorf("token stored under %s, want its SHA-256 hash", key)
+			}
+			if bytes.Contains(value, []byte(created.Token)) || bytes.Contains(key, []byte(created.Token)) {
+				t.Errorf("the token itself is stored: %s", value)
+			}
+			return nil
+		})
+	})
+
+	user, err := resolveToken(created.Token)
+	if err != nil || user != "test" {
+		t.Fatalf("resolveToken = %q, %v", user, err)
+	}
+	first := lastUsed().LastUsed
+	if first.IsZero() {
+		t.Fatal("the use of the token was not recorded")
+	}
+	resolveToken(created.Token)
+	if again := lastUsed().LastUsed; !again.Equal(first) {
+		t.Errorf("the use was recorded again after %s, within %s", again.Sub(first), tokenUsageInterval)
+	}
+	if _, err := resolveToken(created.Token + "0"); !errors.Is(err, errTokenNotFound) {
+		t.Errorf("resolveToken of an unknown token: %v", err)
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -37,43 +37,45 @@ func SaveTranscription(res http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	newkey := vars["key"]
-	newbucket := strings.Join(strings.Split(newkey, ":")[0:4], ":") + ":"
 	text := req.FormValue("text")
 	linetext := text
 	//linetext := strings.Split(text, "\r\n")
 	text = strings.Replace(text, "\r\n", "", -1)
-	dbname := user + ".db"
-	retrieveddata, _ := BoltRetrieve(dbname, newbucket, newkey)
-	retrievedjson := gocite.Passage{}
-	json.Unmarshal([]byte(retrieveddata.JSON), &retrievedjson)
-	retrievedjson.Text.Brucheion = text //gocite.Passage.Text.Brucheion is the text representation with newline tags
-	retrievedjson.Text.TXT = linetext   //gocite.Passage.Text.TXT is the text representation with real line breaks instead of newline tags
-	newnode, _ := json.Marshal(retrievedjson)
-	db, err := openBoltDB(dbname) //open bolt DB using helper function
+	db, err := openUserDB(user)
 	if err != nil {
 		log.Println(fmt.Printf("SaveTranscription: error opening userDB: %s", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer db.Close()
-	key := []byte(newkey)    //
-	value := []byte(newnode) //
-	// store some data
+	// store the text and record it in the history of the passage
 	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(newbucket))
+		err := checkVersion(tx, newkey, req.FormValue("version"))
 		if err != nil {
 			return err
 		}
-
-		err = bucket.Put(key, value)
-		if err != nil {
-			return err
-		}
-		return nil
+		_, err = updatePassage(tx, newkey, user, func(passage *gocite.Passage) error {
+			passage.Text.Brucheion = text //gocite.Passage.Text.Brucheion is the text representation with newline tags
+			passage.Text.TXT = linetext   //gocite.Passage.Text.TXT is the text representation with real line breaks instead of newline tags
+			return nil
+		})
+		return err
 	})
-
-	if err != nil {
-		log.Fatal(err)
+	var stale *StaleVersionError
+	switch {
+	case errors.As(err, &stale):
+		http.Error(res, stale.Error()+". Its current text is:\n\n"+stale.Text.TXT, http.StatusConflict)
+		return
+	case errors.Is(err, errPassageNotFound):
+		http.Error(res, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errBadPassage):
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("SaveTranscription: %s\n", err)
+		http.Error(res, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 	http.Redirect(res, req, "/view/"+newkey, http.StatusFound)
 }
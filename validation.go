@@ -62,7 +62,7 @@ func validateNoAuthUser(req *http.Request) (*Validation, error) {
 	}
 
 	//open the user database
-	userDB, err := openBoltDB(config.UserDB)
+	userDB, err := sharedDBs.Open(config.UserDB)
 	if err != nil {
 		return nil, err
 	}
@@ -154,7 +154,7 @@ func validateUser(req *http.Request) (*Validation, error) {
 		log.Println("func validateUser: Did not get a ProviderUserID from the cookie value. User not registered, or not logged in yet.")
 	}
 
-	userDB, err := openBoltDB(config.UserDB)
+	userDB, err := sharedDBs.Open(config.UserDB)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// versionsBucket holds the version of every saved passage by passage URN.
+// The version counts the saves of a passage; passages never saved have version 0.
+const versionsBucket = "versions"
+
+// StaleVersionError is returned when a passage is saved based on an outdated version.
+type StaleVersionError struct {
+	URN     string         `json:"urn"`
+	Version int            `json:"version"` //the current version
+	Text    gocite.EncText `json:"text"`    //the current text
+}
+
+func (e *StaleVersionError) Error() string {
+	return fmt.Sprintf("%s was changed in the meantime, its current version is %d", e.URN, e.Version)
+}
+
+// passageVersion returns the version of the passage urn within tx.
+func passageVersion(tx *bolt.Tx, urn string) int {
+	version := 0
+	if bucket := tx.Bucket([]byte(versionsBucket)); bucket != nil {
+		json.Unmarshal(bucket.Get([]byte(urn)), &version)
+	}
+	return version
+}
+
+// nextVersion increments the version of the passage urn within tx.
+func nextVersion(tx *bolt.Tx, urn string) (int, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(versionsBucket))
+	if err != nil {
+		return 0, err
+	}
+	version := passageVersion(tx, urn) + 1
+	value, _ := json.Marshal(version)
+	return version, bucket.Put([]byte(urn), value)
+}
+
+// moveVersion gives the version of the passage from to the passage to within tx.
+func moveVersion(tx *bolt.Tx, from, to string) error {
+	bucket := tx.Bucket([]byte(versionsBucket))
+	if bucket == nil || bucket.Get([]byte(from)) == nil {
+		return nil
+	}
+	err := bucket.Put([]byte(to), append([]byte{}, bucket.Get([]byte(from))...))
+	if err != nil {
+		return err
+	}
+	return bucket.Delete([]byte(from))
+}
+
+// checkVersion returns a *StaleVersionError if version, as sent by a client, is not the
+// current version of the passage urn. An empty version is not checked, so clients
+// unaware of versions can still save. ETag quotes around the version are ignored.
+func checkVersion(tx *bolt.Tx, urn, version string) error {
+	if version == "" {
+		return nil
+	}
+	expected, err := strconv.Atoi(strings.Trim(version, `W/"`))
+	if err != nil {
+		return fmt.Errorf("bad version %q: %w", version, errBadPassage)
+	}
+	current := passageVersion(tx, urn)
+	if expected == current {
+		return nil
+	}
+	stale := &StaleVersionError{URN: urn, Version: current}
+	if bucket := tx.Bucket([]byte(workBucket(urn))); bucket != nil {
+		var passage gocite.Passage
+		json.Unmarshal(bucket.Get([]byte(urn)), &passage)
+		stale.Text = passage.Text
+	}
+	return stale
+}
+
+// etag returns the ETag header value of a passage version.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// PassageVersion returns the version of the passage with the given URN.
+func (udb *UserDB) PassageVersion(urn string) (int, error) {
+	version := 0
+	err := udb.View(func(tx *bolt.Tx) error {
+		version = passageVersion(tx, urn)
+		return nil
+	})
+	return version, err
+}
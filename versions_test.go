@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+)
+
+// passageState returns the version of the passage urn and the TXT layer of its revisions.
+func passageState(t *testing.T, db *UserDB, urn string) (int, []string) {
+	t.Helper()
+	var version int
+	var texts []string
+	err := db.View(func(tx *bolt.Tx) error {
+		version = passageVersion(tx, urn)
+		history, err := revisions(tx, urn)
+		for _, revision := range history {
+			texts = append(texts, revision.Text.TXT)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version, texts
+}
+
+// setText saves text as the text of the passage urn by the user alice.
+func setText(t *testing.T, db *UserDB, urn, text string) {
+	t.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := updatePassage(tx, urn, "alice", func(passage *gocite.Passage) error {
+			passage.Text = gocite.EncText{TXT: text, Brucheion: text}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	urn := testWork + "1.1"
+	setText(t, db, urn, "prathamaḥ")
+	db.View(func(tx *bolt.Tx) error {
+		for _, version := range []string{"", "2", `"2"`, `W/"2"`} {
+			if err := checkVersion(tx, urn, version); err != nil {
+				t.Errorf("checkVersion(%q): %v", version, err)
+			}
+		}
+		var stale *StaleVersionError
+		if err := checkVersion(tx, urn, "1"); !errors.As(err, &stale) || stale.Version != 2 || stale.Text.TXT != "prathamaḥ" {
+			t.Errorf("checkVersion of an outdated version: %v", err)
+		}
+		if err := checkVersion(tx, urn, "second"); !errors.Is(err, errBadPassage) {
+			t.Errorf("checkVersion of a bad version: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestImportVersions(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	if version, history := passageState(t, db, testWork+"1.1"); version != 1 || len(history) != 0 {
+		t.Errorf("imported passage: version %d, history %v", version, history)
+	}
+
+	changed := strings.Replace(testCEX, "1.1#prathamam", "1.1#prathamaḥ", 1)
+	cex, err := ParseCEX(strings.NewReader(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importCEX(cex, "test", CEXImportOptions{Strategy: cexOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, history := passageState(t, db, testWork+"1.1")
+	if version != 2 || strings.Join(history, "|") != "prathamam|prathamaḥ" {
+		t.Errorf("replaced passage: version %d, history %v", version, history)
+	}
+	if version, history := passageState(t, db, testWork+"1.2"); version != 1 || len(history) != 0 {
+		t.Errorf("unchanged passage: version %d, history %v", version, history)
+	}
+}
+
+func TestEditWorkVersions(t *testing.T) {
+	db := loadTestCEX(t, testCEX)
+	setText(t, db, testWork+"1.9", "navamaḥ")
+	setText(t, db, testWork+"1.2", "dvitīyaḥ")
+
+	_, err := renumberPassage(db, testWork+"1.9", testWork+"1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the renumbered passage continues the version of 1.9, the renumbering being a change of its own
+	if version, history := passageState(t, db, testWork+"1.3"); version != 3 || strings.Join(history, "|") != "navamam|navamaḥ" {
+		t.Errorf("renumbered passage: version %d, history %v", version, history)
+	}
+	if version, history := passageState(t, db, testWork+"1.9"); version != 0 || len(history) != 0 {
+		t.Errorf("old URN of the renumbered passage: version %d, history %v", version, history)
+	}
+
+	_, err = deletePassage(db, testWork+"1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, history := passageState(t, db, testWork+"1.2"); version != 2 || len(history) != 2 {
+		t.Errorf("deleted passage: version %d, history %v", version, history)
+	}
+	_, err = insertPassage(db, gocite.Passage{PassageID: testWork + "1.2"}, testWork+"1.1", positionAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := passageState(t, db, testWork+"1.2"); version != 3 {
+		t.Errorf("passage inserted under a deleted URN: version %d, want 3", version)
+	}
+	if version, _ := passageState(t, db, testWork+"1.10"); version != 1 {
+		t.Errorf("passage only relinked: version %d, want 1", version)
+	}
+}
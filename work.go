@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"text/template"
+
+	"github.com/ThomasK81/gocite"
 )
 
 //newWork extracts cexMeta data from the *http.Request form values and
@@ -57,3 +59,29 @@ func newWork(res http.ResponseWriter, req *http.Request) {
 		}
 	}
 }
+
+//linkPassages returns a gocite.Work with the given passages in the given order.
+//Index, Prev, and Next of every passage as well as First and Last of the work are set accordingly.
+func linkPassages(workID string, passages []gocite.Passage) gocite.Work {
+	work := gocite.Work{WorkID: workID, Passages: passages, Ordered: true}
+	for j := range passages {
+		passages[j].Index = j
+		switch {
+		case j+1 == len(passages):
+			passages[j].Next = gocite.PassLoc{Exists: false}
+		default:
+			passages[j].Next = gocite.PassLoc{Exists: true, PassageID: passages[j+1].PassageID, Index: j + 1}
+		}
+		switch {
+		case j == 0:
+			passages[j].Prev = gocite.PassLoc{Exists: false}
+		default:
+			passages[j].Prev = gocite.PassLoc{Exists: true, PassageID: passages[j-1].PassageID, Index: j - 1}
+		}
+	}
+	if len(passages) > 0 {
+		work.First = gocite.PassLoc{Exists: true, PassageID: passages[0].PassageID, Index: 0}
+		work.Last = gocite.PassLoc{Exists: true, PassageID: passages[len(passages)-1].PassageID, Index: len(passages) - 1}
+	}
+	return work
+}
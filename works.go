@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ThomasK81/gocite"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Errors of the work operations
+var (
+	errWorkNotFound = errors.New("work not found")
+	errWorkExists   = errors.New("work exists already")
+	errBadWork      = errors.New("bad work")
+)
+
+// WorkSummary is a work as listed by /api/v1/works.
+type WorkSummary struct {
+	Catalog  BoltCatalog `json:"catalog"`
+	Passages int         `json:"passages"` //the number of passages
+}
+
+// WorkDetail is a work with its catalog entry and its passages in reading order.
+type WorkDetail struct {
+	Catalog BoltCatalog `json:"catalog"`
+	WorkOrder
+}
+
+// checkWorkURN returns an error wrapping errBadWork unless urn is the URN of a work,
+// i.e. a CTS URN ending with the colon before the passage reference.
+func checkWorkURN(urn string) error {
+	if !gocite.IsCTSURN(urn) || workBucket(urn) != urn {
+		return fmt.Errorf("%q is no work URN: %w", urn, errBadWork)
+	}
+	return nil
+}
+
+// workExists reports whether the work with the given URN has a bucket or a catalog entry within tx.
+func workExists(tx *bolt.Tx, workID string) bool {
+	if tx.Bucket([]byte(workID)) != nil {
+		return true
+	}
+	catalog := tx.Bucket([]byte(catalogBucket))
+	return catalog != nil && catalog.Get([]byte(workID)) != nil
+}
+
+// listWorks returns the works of a user database with their catalog entries and
+// passage counts, sorted by URN. Works with a catalog entry but no passages are included.
+func listWorks(db *UserDB) ([]WorkSummary, error) {
+	result := []WorkSummary{}
+	err := db.View(func(tx *bolt.Tx) error {
+		counts := map[string]int{}
+		for _, work := range workBuckets(tx) {
+			bounds, err := workBounds(tx, work)
+			if err != nil {
+				return err
+			}
+			counts[work] = bounds.Count
+		}
+		if catalog := tx.Bucket([]byte(catalogBucket)); catalog != nil {
+			catalog.ForEach(func(key, _ []byte) error {
+				if _, found := counts[string(key)]; !found {
+					counts[string(key)] = 0
+				}
+				return nil
+			})
+		}
+		for work, count := range counts {
+			catalog, err := getCatalog(tx, work)
+			if err != nil {
+				return err
+			}
+			if catalog.URN == "" {
+				catalog.URN = work
+			}
+			result = append(result, WorkSummary{Catalog: catalog, Passages: count})
+		}
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Catalog.URN < result[j].Catalog.URN })
+	return result, err
+}
+
+// getWorkDetail returns the catalog entry and reading order of the work with the given URN.
+func getWorkDetail(db *UserDB, workID string) (WorkDetail, error) {
+	var detail WorkDetail
+	err := db.View(func(tx *bolt.Tx) error {
+		if !workExists(tx, workID) {
+			return fmt.Errorf("%s: %w", workID, errWorkNotFound)
+		}
+		var err error
+		detail.Catalog, err = getCatalog(tx, workID)
+		if err != nil {
+			return err
+		}
+		if detail.Catalog.URN == "" {
+			detail.Catalog.URN = workID
+		}
+		var passages []gocite.Passage
+		if bucket := tx.Bucket([]byte(workID)); bucket != nil {
+			passages = bucketPassages(bucket)
+		}
+		detail.WorkOrder = workOrder(linkPassages(workID, passages))
+		return nil
+	})
+	return detail, err
+}
+
+// createWork saves the catalog entry of a new work together with its empty work bucket.
+func createWork(db *UserDB, catalog BoltCatalog) error {
+	err := checkWorkURN(catalog.URN)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if workExists(tx, catalog.URN) {
+			return fmt.Errorf("%s: %w", catalog.URN, errWorkExists)
+		}
+		_, err := tx.CreateBucket([]byte(catalog.URN))
+		if err != nil {
+			return err
+		}
+		err = putWorkBounds(tx, gocite.Work{WorkID: catalog.URN})
+		if err != nil {
+			return err
+		}
+		return putCatalog(tx, catalog)
+	})
+}
+
+// updateCatalog replaces the catalog entry of an existing work.
+func updateCatalog(db *UserDB, catalog BoltCatalog) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if !workExists(tx, catalog.URN) {
+			return fmt.Errorf("%s: %w", catalog.URN, errWorkNotFound)
+		}
+		return putCatalog(tx, catalog)
+	})
+}
+
+// deleteWork deletes the work with the given URN: its passages, its catalog entry, bounds,
+// siglum, and alignment settings, and the versions and revision histories of its passages.
+func deleteWork(db *UserDB, workID string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if !workExists(tx, workID) {
+			return fmt.Errorf("%s: %w", workID, errWorkNotFound)
+		}
+		if tx.Bucket([]byte(workID)) != nil {
+			err := tx.DeleteBucket([]byte(workID))
+			if err != nil {
+				return err
+			}
+		}
+		for _, name := range []string{catalogBucket, siglaBucket, alignmentDefaultsBucket} {
+			if bucket := tx.Bucket([]byte(name)); bucket != nil {
+				err := bucket.Delete([]byte(workID))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err := updateWorkBounds(tx, workID)
+		if err != nil {
+			return err
+		}
+		if versions := tx.Bucket([]byte(versionsBucket)); versions != nil {
+			err := deletePrefix(versions, workID, versions.Delete)
+			if err != nil {
+				return err
+			}
+		}
+		if history := tx.Bucket([]byte(historyBucket)); history != nil {
+			return deletePrefix(history, workID, history.DeleteBucket)
+		}
+		return nil
+	})
+}
+
+// deletePrefix calls remove for every key of bucket starting with prefix.
+func deletePrefix(bucket *bolt.Bucket, prefix string, remove func(key []byte) error) error {
+	var keys [][]byte
+	c := bucket.Cursor()
+	for key, _ := c.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = c.Next() {
+		keys = append(keys, append([]byte{}, key...))
+	}
+	for _, key := range keys {
+		err := remove(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleWorks lists the works of the user (GET) or creates a new, empty work (POST)
+// from a BoltCatalog in the request body.
+func handleWorks(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	if r.Method == http.MethodGet {
+		works, err := listWorks(db)
+		if err != nil {
+			log.Printf("handleWorks: %s\n", err)
+			respondWithError(w, "internal_error", 500)
+			return
+		}
+		respondWithData(w, works, 200)
+		return
+	}
+
+	var catalog BoltCatalog
+	err = json.NewDecoder(r.Body).Decode(&catalog)
+	if err != nil {
+		respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+		return
+	}
+	catalog.URN = strings.TrimSpace(catalog.URN)
+	err = createWork(db, catalog)
+	if err != nil {
+		respondWithWorkError(w, err)
+		return
+	}
+	detail, err := getWorkDetail(db, catalog.URN)
+	if err != nil {
+		respondWithWorkError(w, err)
+		return
+	}
+	respondWithData(w, detail, 201)
+}
+
+// handleWork returns (GET), edits the catalog entry of (PUT, PATCH), or deletes (DELETE)
+// the work {urn}. PUT replaces the catalog entry with the request body, PATCH only changes
+// the fields given in it. The URN of a work cannot be changed.
+func handleWork(w http.ResponseWriter, r *http.Request) {
+	user, err := getSessionUser(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	urn := mux.Vars(r)["urn"]
+	err = checkWorkURN(urn)
+	if err != nil {
+		respondWithError(w, "bad_urn", 400)
+		return
+	}
+
+	db, err := openUserDB(user)
+	if err != nil {
+		respondWithError(w, "internal_error", 500)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case http.MethodDelete:
+		err = deleteWork(db, urn)
+		if err != nil {
+			respondWithWorkError(w, err)
+			return
+		}
+		respondWithJSON(w, "success", "work_deleted", nil, 200)
+		return
+	case http.MethodPut, http.MethodPatch:
+		var catalog BoltCatalog
+		if r.Method == http.MethodPatch {
+			catalog, err = db.GetCatalog(urn)
+			if err != nil {
+				respondWithWorkError(w, err)
+				return
+			}
+		}
+		err = json.NewDecoder(r.Body).Decode(&catalog)
+		if err != nil {
+			respondWithJSON(w, "error", "bad_request", err.Error(), 400)
+			return
+		}
+		if catalog.URN != "" && catalog.URN != urn {
+			respondWithJSON(w, "error", "bad_request", "the URN of a work cannot be changed", 400)
+			return
+		}
+		catalog.URN = urn
+		err = updateCatalog(db, catalog)
+		if err != nil {
+			respondWithWorkError(w, err)
+			return
+		}
+	}
+
+	detail, err := getWorkDetail(db, urn)
+	if err != nil {
+		respondWithWorkError(w, err)
+		return
+	}
+	respondWithData(w, detail, 200)
+}
+
+// respondWithWorkError answers with the status code matching an error of a work operation.
+func respondWithWorkError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errWorkNotFound):
+		respondWithError(w, "work_not_found", 404)
+	case errors.Is(err, errWorkExists):
+		respondWithError(w, "work_exists", 409)
+	case errors.Is(err, errBadWork):
+		respondWithJSON(w, "error", "bad_urn", err.Error(), 400)
+	default:
+		log.Printf("work operation: %s\n", err)
+		respondWithError(w, "internal_error", 500)
+	}
+}